@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type clientSummary struct {
+	Client  string `json:"client"`
+	A       int    `json:"a"`
+	Cname   int    `json:"cname"`
+	Ptr     int    `json:"ptr"`
+	Txt     int    `json:"txt"`
+	Tlsa    int    `json:"tlsa"`
+	Srv     int    `json:"srv"`
+	Https   int    `json:"https"`
+	Records int    `json:"records"`
+}
+
+type zoneSummary struct {
+	Zone    string `json:"zone"`
+	Records int    `json:"records"`
+	Serial  uint32 `json:"serial"`
+}
+
+// One entry per top-level key in the answers, with how many records it has
+func (answers *Answers) Clients() []clientSummary {
+	out := []clientSummary{}
+	for key, client := range *answers {
+		summary := clientSummary{
+			Client: key,
+			A:      len(client.A),
+			Cname:  len(client.Cname),
+			Ptr:    len(client.Ptr),
+			Txt:    len(client.Txt),
+			Tlsa:   len(client.Tlsa),
+			Srv:    len(client.Srv),
+			Https:  len(client.Https),
+		}
+		summary.Records = summary.A + summary.Cname + summary.Ptr + summary.Txt + summary.Tlsa + summary.Srv + summary.Https
+		out = append(out, summary)
+	}
+
+	sort.Sort(byClient(out))
+	return out
+}
+
+// The distinct zones the record names are in. A name belongs to the authoritative suffix it falls under,
+// otherwise to its parent domain.
+func (answers *Answers) Zones() []zoneSummary {
+	counts := make(map[string]int)
+	add := func(name string) {
+		counts[answers.zoneOf(name)]++
+	}
+
+	for _, client := range *answers {
+		for name := range client.A {
+			add(name)
+		}
+		for name := range client.Cname {
+			add(name)
+		}
+		for name := range client.Ptr {
+			add(name)
+		}
+		for name := range client.Txt {
+			add(name)
+		}
+		for name := range client.Tlsa {
+			add(name)
+		}
+		for name := range client.Srv {
+			add(name)
+		}
+		for name := range client.Https {
+			add(name)
+		}
+	}
+
+	out := []zoneSummary{}
+	for zone, records := range counts {
+		out = append(out, zoneSummary{Zone: zone, Records: records, Serial: zoneSerial(zone)})
+	}
+
+	sort.Sort(byZone(out))
+	return out
+}
+
+func (answers *Answers) zoneOf(name string) string {
+	if suffix, ok := answers.AuthoritativeFor(name); ok {
+		return strings.TrimLeft(suffix, ".")
+	}
+
+	labels := strings.SplitN(strings.TrimRight(name, "."), ".", 2)
+	if len(labels) < 2 {
+		return "."
+	}
+	return labels[1] + "."
+}
+
+type byClient []clientSummary
+
+func (c byClient) Len() int           { return len(c) }
+func (c byClient) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byClient) Less(i, j int) bool { return c[i].Client < c[j].Client }
+
+type byZone []zoneSummary
+
+func (z byZone) Len() int           { return len(z) }
+func (z byZone) Swap(i, j int)      { z[i], z[j] = z[j], z[i] }
+func (z byZone) Less(i, j int) bool { return z[i].Zone < z[j].Zone }
+
+func httpClients(w http.ResponseWriter, req *http.Request) {
+	answers := getAnswers()
+	writeJson(w, answers.Clients())
+}
+
+func httpZones(w http.ResponseWriter, req *http.Request) {
+	answers := getAnswers()
+	writeJson(w, answers.Zones())
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"path/filepath"
+
+	"gopkg.in/check.v1"
+)
+
+type AdminTests struct{}
+
+var _ = check.Suite(&AdminTests{})
+
+func (t *AdminTests) TestClientsAndZones(c *check.C) {
+	answers := Answers{
+		"10.1.1.1": ClientAnswers{
+			A: map[string]RecordA{
+				"web.": {Answer: []string{"10.0.0.1"}},
+			},
+		},
+		DEFAULT_KEY: ClientAnswers{
+			Authoritative: []string{"rancher.internal"},
+			A: map[string]RecordA{
+				"a.rancher.internal.":       {Answer: []string{"10.0.0.2"}},
+				"b.stack.rancher.internal.": {Answer: []string{"10.0.0.3"}},
+				"www.example.com.":          {Answer: []string{"10.0.0.4"}},
+			},
+			Cname: map[string]RecordCname{
+				"app.example.com.": {Answer: "www.example.com."},
+			},
+		},
+	}
+
+	c.Check(answers.Clients(), check.DeepEquals, []clientSummary{
+		{Client: "10.1.1.1", A: 1, Records: 1},
+		{Client: DEFAULT_KEY, A: 3, Cname: 1, Records: 4},
+	})
+
+	c.Check(answers.Zones(), check.DeepEquals, []zoneSummary{
+		{Zone: ".", Records: 1, Serial: startSerial},
+		{Zone: "example.com.", Records: 2, Serial: startSerial},
+		{Zone: "rancher.internal.", Records: 2, Serial: startSerial},
+	})
+}
+
+func (t *AdminTests) TestLabels(c *check.C) {
+	prod := map[string]string{"env": "prod", "dc": "us-east"}
+	answers := Answers{
+		"10.1.1.1": ClientAnswers{
+			A: map[string]RecordA{
+				"db.": {Answer: []string{"10.0.0.5"}, Labels: map[string]string{"env": "prod", "dc": "us-west"}},
+			},
+		},
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"web.":  {Answer: []string{"10.0.0.1", "10.0.0.2"}, Canary: "10.0.0.3", Labels: prod},
+				"api.":  {Answer: []string{"10.0.0.2", "10.0.0.4"}, Labels: prod},
+				"dev.":  {Answer: []string{"10.0.0.6"}, Labels: map[string]string{"env": "dev"}},
+				"bare.": {Answer: []string{"10.0.0.7"}},
+			},
+			Cname: map[string]RecordCname{
+				"www.": {Answer: "web.", Labels: prod},
+			},
+		},
+	}
+
+	_, err := parseSelector("env")
+	c.Check(err, check.NotNil)
+	_, err = parseSelector("")
+	c.Check(err, check.NotNil)
+
+	selector, err := parseSelector("env=prod, dc=us-east")
+	c.Assert(err, check.IsNil)
+	c.Check(answers.Labeled(selector), check.DeepEquals, []labeledRecord{
+		{Client: DEFAULT_KEY, Name: "api.", Type: "A", Labels: prod, Answer: []string{"10.0.0.2", "10.0.0.4"}},
+		{Client: DEFAULT_KEY, Name: "web.", Type: "A", Labels: prod, Answer: []string{"10.0.0.1", "10.0.0.2"}},
+		{Client: DEFAULT_KEY, Name: "www.", Type: "CNAME", Labels: prod, Answer: []string{"web."}},
+	})
+	c.Check(answers.LabeledAddresses(selector), check.DeepEquals, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"})
+
+	selector, err = parseSelector("env=prod")
+	c.Assert(err, check.IsNil)
+	c.Check(answers.LabeledAddresses(selector), check.DeepEquals, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"})
+
+	defer func() { drained = map[string]map[string]bool{} }()
+	c.Assert(setDrained("10.0.0.1", true), check.IsNil)
+	c.Assert(drainIps(answers.LabeledAddresses(selector), drainBySelector(selector)), check.IsNil)
+	c.Check(isDrained("10.0.0.5"), check.Equals, true)
+	c.Check(isDrained("10.0.0.6"), check.Equals, false)
+	c.Check(drainIps([]string{"10.0.0.6", "bad"}, drainBySelector(selector)), check.NotNil)
+	c.Check(isDrained("10.0.0.6"), check.Equals, false)
+
+	// Undraining by the selector leaves what was drained some other way, whatever the records have now
+	other, _ := parseSelector("dc=us-east, env=prod")
+	c.Assert(drainIps([]string{"10.0.0.2"}, drainBySelector(other)), check.IsNil)
+	c.Check(drainBySelector(other), check.Equals, "selector dc=us-east,env=prod")
+	answers[DEFAULT_KEY].A["web."] = RecordA{Answer: []string{"10.0.0.9"}, Labels: prod}
+	ips, err := undrainOrigin(drainBySelector(selector))
+	c.Assert(err, check.IsNil)
+	c.Check(ips, check.DeepEquals, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"})
+	c.Check(drainedIps(), check.DeepEquals, []string{"10.0.0.1", "10.0.0.2"})
+	c.Check(drainedOrigins()["10.0.0.1"], check.DeepEquals, []string{DRAIN_BY_IP})
+}
+
+func (t *AdminTests) TestValidation(c *check.C) {
+	saved, savedFile := getAnswers(), *answersFile
+	defer func() {
+		setAnswers(saved)
+		*answersFile = savedFile
+	}()
+
+	dir := c.MkDir()
+	*answersFile = filepath.Join(dir, "answers.json")
+	writeFile(c, dir, "answers.json", `{"default": {
+		"a": {"web.": {"answer": ["10.0.0.1", "10.0.0.300"]}, "api.": {"answer": ["10.0.0.2"]}},
+		"cname": {"api.": {"answer": "web."}, "ping.": {"answer": "pong."}, "pong.": {"answer": "ping."}},
+		"a": {"db.": {"answer": ["10.0.0.3"]}}
+	}}`)
+	c.Assert(loadAnswers(), check.IsNil)
+
+	report := lastValidation()
+	c.Check(report.Errors, check.Equals, 0)
+	var messages []string
+	for _, issue := range report.Issues {
+		c.Check(issue.Severity, check.Equals, ISSUE_WARNING)
+		messages = append(messages, issue.Message)
+	}
+	c.Check(messages, check.DeepEquals, []string{
+		"Duplicate key default > a, only the last one is used",
+		"default: A record web. has invalid IPv4 address \"10.0.0.300\"",
+		"default: api. has both a CNAME and an A record, answered as --precedence=cname says",
+		"default: CNAME loop ping. -> pong. -> ping.",
+		"default: CNAME loop pong. -> ping. -> pong.",
+	})
+	c.Check(validationIssues.Get(ISSUE_WARNING), check.Equals, uint64(5))
+	c.Check(validationIssues.Get(ISSUE_ERROR), check.Equals, uint64(0))
+
+	// A file that doesn't load is an error, and the last good answers are still what is checked
+	writeFile(c, dir, "answers.json", `{"default": {"a": {"web.": {"answer": [`)
+	c.Assert(loadAnswers(), check.NotNil)
+
+	report = lastValidation()
+	c.Check(report.Errors, check.Equals, 1)
+	c.Check(validationIssues.Get(ISSUE_ERROR), check.Equals, uint64(1))
+	c.Check(validationIssues.Get(ISSUE_WARNING), check.Equals, uint64(4))
+	c.Check(getAnswers()[DEFAULT_KEY].A, check.HasLen, 3)
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"math/rand"
 	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/miekg/dns"
@@ -18,6 +22,20 @@ const RECURSE_KEY = "recurse"
 // Maximum recursion when resolving CNAMEs
 const MAX_DEPTH = 10
 
+// Where an answer came from
+const (
+	SECTION_CLIENT    = "client"
+	SECTION_DEFAULT   = "default"
+	SECTION_RECURSION = "recursion"
+	SECTION_CACHE     = "cache"
+)
+
+// Which wins for A queries when a name has both a CNAME and an A record
+const (
+	PRECEDENCE_CNAME        = "cname"
+	PRECEDENCE_A_OVER_CNAME = "a-over-cname"
+)
+
 // Recursive servers
 func (answers *Answers) Recursers(clientIp string) []string {
 	var hosts []string
@@ -35,20 +53,50 @@ func (answers *Answers) Recursers(clientIp string) []string {
 
 func (answers *Answers) recursersFor(clientIp string) []string {
 	var hosts []string
-	client, ok := (*answers)[clientIp]
+	client, ok := (*answers)[answers.sectionFor(clientIp)]
 	if ok {
-		if ok && len(client.Recurse) > 0 {
-			hosts = client.Recurse
+		for _, recurser := range client.Recurse {
+			hosts = append(hosts, recurserAddresses(recurser)...)
 		}
 	}
 
 	return hosts
 }
 
+// The client's TTL floor for recursive answers, or else the default one
+func (answers *Answers) TtlFloor(clientIp string) uint32 {
+	if client, ok := (*answers)[answers.sectionFor(clientIp)]; ok && client.TtlFloor > 0 {
+		return client.TtlFloor
+	}
+	return (*answers)[DEFAULT_KEY].TtlFloor
+}
+
+// How long the client's queries get to be answered: its own timeout, else the default section's, else --query-timeout
+func (answers *Answers) QueryTimeout(clientIp string) time.Duration {
+	if client, ok := (*answers)[answers.sectionFor(clientIp)]; ok && client.Timeout > 0 {
+		return time.Duration(client.Timeout) * time.Millisecond
+	}
+	if def := (*answers)[DEFAULT_KEY].Timeout; def > 0 {
+		return time.Duration(def) * time.Millisecond
+	}
+	return *queryTimeout
+}
+
+// Raises the TTLs of recursive answers that are below the client's floor
+func (answers *Answers) applyTtlFloor(clientIp string, records []dns.RR) []dns.RR {
+	floor := answers.TtlFloor(clientIp)
+	for _, rr := range records {
+		if hdr := rr.Header(); hdr.Ttl < floor {
+			hdr.Ttl = floor
+		}
+	}
+	return records
+}
+
 // Search suffixes
 func (answers *Answers) SearchSuffixes(clientIp string) []string {
 	var suffixes []string
-	client, ok := (*answers)[clientIp]
+	client, ok := (*answers)[answers.sectionFor(clientIp)]
 	if ok {
 		if ok && len(client.Search) > 0 {
 			suffixes = client.Search
@@ -72,7 +120,122 @@ func (answers *Answers) AuthoritativeSuffixes() []string {
 	return suffixes
 }
 
-func (answers *Answers) Addresses(clientIp string, fqdn string, cnameParents []dns.RR, depth int) (records []dns.RR, ok bool) {
+// The authoritative suffix the label falls under, if any. Locally served reverse zones count as authoritative.
+func (answers *Answers) AuthoritativeFor(label string) (suffix string, ok bool) {
+	for _, suffix := range answers.AuthoritativeSuffixes() {
+		if strings.HasSuffix(label, suffix) {
+			return suffix, true
+		}
+	}
+
+	for _, zone := range splitTrim(*reverseZones, ",") {
+		suffix := "." + strings.Trim(zone, ".") + "."
+		if zone != "" && strings.HasSuffix(label, suffix) {
+			return suffix, true
+		}
+	}
+
+	return "", false
+}
+
+// The authoritative zone the name is the apex of, as a suffix like AuthoritativeFor's
+func (answers *Answers) ApexOf(fqdn string) (suffix string, ok bool) {
+	for _, suffix := range answers.AuthoritativeSuffixes() {
+		if "."+fqdn == suffix {
+			return suffix, true
+		}
+	}
+
+	for _, zone := range splitTrim(*reverseZones, ",") {
+		suffix := "." + strings.Trim(zone, ".") + "."
+		if zone != "" && "."+fqdn == suffix {
+			return suffix, true
+		}
+	}
+
+	return "", false
+}
+
+// Whether there are authoritative zones, and the name is in none of them
+func (answers *Answers) OutOfZone(fqdn string) bool {
+	if len(answers.AuthoritativeSuffixes()) == 0 {
+		return false
+	}
+	_, ok := answers.AuthoritativeFor(fqdn)
+	return !ok
+}
+
+// Whether there are records of any type for the name itself, for telling an absent type (NODATA) from an absent name
+func (answers *Answers) HasName(clientIp string, fqdn string) (section string, ok bool) {
+	for _, key := range []string{answers.sectionFor(clientIp), DEFAULT_KEY} {
+		client, found := (*answers)[key]
+		if !found {
+			continue
+		}
+
+		_, wildcard := client.wildcardName(fqdn)
+		_, _, pattern := client.matchPattern(fqdn)
+		_, suffix := client.suffixDefault(fqdn)
+		// Outside our zones, a name only others are under is still asked upstream
+		exists := client.hasName(fqdn)
+		if !exists && client.nonTerminals[fqdn] {
+			_, exists = answers.AuthoritativeFor(fqdn)
+		}
+		if exists || wildcard || pattern || suffix {
+			if key == DEFAULT_KEY {
+				return SECTION_DEFAULT, true
+			}
+			return SECTION_CLIENT, true
+		}
+	}
+
+	return "", false
+}
+
+// Reverse zones for private and special-use address space (RFC 1918, RFC 6303) that should never be
+// looked up on public resolvers
+func privateReverseZones() []string {
+	zones := []string{"10.in-addr.arpa", "127.in-addr.arpa", "254.169.in-addr.arpa", "168.192.in-addr.arpa"}
+	for i := 16; i <= 31; i++ {
+		zones = append(zones, fmt.Sprintf("%d.172.in-addr.arpa", i))
+	}
+	return zones
+}
+
+// The delegated suffix the name falls under and the name servers it is delegated to, the most specific
+// delegation wins and the client's own delegations are checked before the default ones
+func (answers *Answers) DelegationFor(clientIp string, fqdn string) (suffix string, ns []string, ok bool) {
+	for _, key := range []string{answers.sectionFor(clientIp), DEFAULT_KEY} {
+		client, found := (*answers)[key]
+		if !found {
+			continue
+		}
+
+		for delegated, servers := range client.Delegate {
+			withDot := dns.Fqdn(strings.ToLower(strings.Trim(delegated, ".")))
+			if fqdn != withDot && !strings.HasSuffix(fqdn, "."+withDot) {
+				continue
+			}
+			if len(withDot) > len(suffix) {
+				suffix, ns, ok = withDot, servers, true
+			}
+		}
+
+		if ok {
+			return
+		}
+	}
+
+	return "", nil, false
+}
+
+func (answers *Answers) Addresses(ctx context.Context, clientIp string, fqdn string, cnameParents []dns.RR, depth int) (records []dns.RR, ok bool) {
+	records, _, ok = answers.AddressesSection(ctx, clientIp, fqdn, cnameParents, depth)
+	return
+}
+
+// Like Addresses, also returning the section the name itself was found in
+func (answers *Answers) AddressesSection(ctx context.Context, clientIp string, fqdn string, cnameParents []dns.RR, depth int) (records []dns.RR, section string, ok bool) {
 	fqdn = dns.Fqdn(fqdn)
 
 	log.WithFields(log.Fields{"fqdn": fqdn, "client": clientIp, "depth": depth}).Debug("Trying to resolve addresses")
@@ -80,66 +243,184 @@ func (answers *Answers) Addresses(clientIp string, fqdn string, cnameParents []d
 	// Limit recursing for non-obvious loops
 	if len(cnameParents) >= MAX_DEPTH {
 		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientIp, "depth": depth}).Warn("Followed CNAME too many times ", cnameParents)
-		return nil, false
+		return nil, "", false
+	}
+
+	// While the service behind the name is up, its real answer comes from the recursive servers
+	if answers.gateOpen(clientIp, fqdn) && !isOffline() && !*noRecurse {
+		traceHop(ctx, "%s is up, recursing for %s", answers.gateOf(clientIp, fqdn), fqdn)
+		if records, section, ok := answers.recurseAddresses(ctx, clientIp, fqdn); ok && len(records) > 0 {
+			return records, section, true
+		}
+		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientIp, "depth": depth}).Info("Gated recursion failed, answering locally")
+	}
+
+	// Failed over by label selector, the recursive servers answer instead of the record's addresses
+	if answers.failedOver(clientIp, fqdn) && !isOffline() && !*noRecurse {
+		traceHop(ctx, "%s failed over, recursing", fqdn)
+		if records, section, ok := answers.recurseAddresses(ctx, clientIp, fqdn); ok && len(records) > 0 {
+			return records, section, true
+		}
+		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientIp, "depth": depth}).Info("Failover recursion failed, answering locally")
+	}
+
+	// A local A is used before the CNAME is even looked at
+	if *precedence == PRECEDENCE_A_OVER_CNAME {
+		if result, section, ok := answers.localAddresses(clientIp, fqdn, depth); ok {
+			traceHop(ctx, "A %s local (%s)", fqdn, section)
+			return result, section, true
+		}
 	}
 
 	// Look for a CNAME entry
 	log.WithFields(log.Fields{"fqdn": fqdn, "client": clientIp, "depth": depth}).Debug("Trying CNAME Records")
-	result, ok := answers.Matching(dns.TypeCNAME, clientIp, fqdn)
+	result, section, ok := answers.MatchingSection(dns.TypeCNAME, clientIp, fqdn)
 	if ok && len(result) > 0 {
 		cname := result[0].(*dns.CNAME)
 		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientIp, "depth": depth}).Debug("Matched CNAME ", cname.Target)
+		traceHop(ctx, "CNAME %s to %s local (%s)", fqdn, cname.Target, section)
 
 		// Stop obvious loops
 		if dns.Fqdn(cname.Target) == fqdn {
 			log.WithFields(log.Fields{"fqdn": fqdn, "client": clientIp, "depth": depth}).Warn("CNAME is a loop ", cname.Target)
-			return nil, false
+			return nil, "", false
 		}
 
 		// Recurse to find the eventual A for this CNAME
-		children, ok := answers.Addresses(clientIp, dns.Fqdn(cname.Target), append(cnameParents, cname), depth+1)
+		children, ok := answers.Addresses(ctx, clientIp, dns.Fqdn(cname.Target), append(cnameParents, cname), depth+1)
 		if ok && len(children) > 0 {
 			log.WithFields(log.Fields{"fqdn": fqdn, "target": cname.Target, "client": clientIp, "depth": depth}).Debug("Resolved CNAME ", children)
 			records = append(records, cname)
 			records = append(records, children...)
-			return records, true
+			return records, section, true
+		}
+	}
+
+	// Look for an ALIAS entry, answered with the target's addresses under this name
+	if alias, aliasSection, ok := answers.MatchingAlias(clientIp, fqdn); ok {
+		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientIp, "depth": depth}).Debug("Matched ALIAS ", alias.Answer)
+		traceHop(ctx, "ALIAS %s to %s local (%s)", fqdn, alias.Answer, aliasSection)
+		target := dns.Fqdn(alias.Answer)
+		if target == fqdn {
+			log.WithFields(log.Fields{"fqdn": fqdn, "client": clientIp, "depth": depth}).Warn("ALIAS is a loop ", target)
+			return nil, "", false
+		}
+
+		// Resolving the target may recurse, just like it would for a CNAME
+		hdr := dns.RR_Header{Name: fqdn, Rrtype: dns.TypeCNAME, Class: dns.ClassINET}
+		parent := &dns.CNAME{Hdr: hdr, Target: target}
+		children, ok := answers.Addresses(ctx, clientIp, target, append(cnameParents, parent), depth+1)
+		if flattened := flatten(fqdn, alias.Ttl, children); ok && len(flattened) > 0 {
+			log.WithFields(log.Fields{"fqdn": fqdn, "target": target, "client": clientIp, "depth": depth}).Debug("Resolved ALIAS ", flattened)
+			return flattened, aliasSection, true
 		}
 	}
 
 	// Look for an A entry
-	log.WithFields(log.Fields{"fqdn": fqdn, "client": clientIp, "depth": depth}).Debug("Trying A Records")
-	result, ok = answers.Matching(dns.TypeA, clientIp, fqdn)
-	if ok && len(result) > 0 {
-		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientIp, "depth": depth}).Debug("Matched A ", result)
-		shuffle(&result)
-		return result, true
+	if result, section, ok := answers.localAddresses(clientIp, fqdn, depth); ok {
+		traceHop(ctx, "A %s local (%s)", fqdn, section)
+		return result, section, true
+	}
+
+	// Every local address is down, and the record asked for upstream's answer instead of none
+	if answers.fallsBackToRecursion(clientIp, fqdn) && !isOffline() && !*noRecurse {
+		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientIp, "depth": depth}).Info("No healthy local address, falling back to recursion")
+		traceHop(ctx, "no healthy address for %s", fqdn)
+		return answers.recurseAddresses(ctx, clientIp, fqdn)
+	}
+
+	// Names in a zone we are authoritative for must never be recursed, that would leak them and could loop
+	if _, authoritative := answers.AuthoritativeFor(fqdn); authoritative {
+		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientIp, "depth": depth}).Debug("Not recursing, authoritative")
+		return nil, "", false
 	}
 
 	// When resolving CNAMES, check recursive server
-	if len(cnameParents) > 0 {
+	if len(cnameParents) > 0 && isOffline() {
+		markUnresolved(ctx)
+	} else if len(cnameParents) > 0 && !*noRecurse {
 		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientIp, "depth": depth}).Debug("Trying recursive servers")
-		r := new(dns.Msg)
-		r.SetQuestion(fqdn, dns.TypeA)
-		msg, err := ResolveTryAll(r, answers.Recursers(clientIp))
-		if err == nil {
-			return msg.Answer, true
+		if records, section, ok := answers.recurseAddresses(ctx, clientIp, fqdn); ok {
+			return records, section, true
 		}
 	}
 
 	log.WithFields(log.Fields{"fqdn": fqdn, "client": clientIp, "depth": depth}).Debug("Did not match anything")
-	return nil, false
+	return nil, "", false
 }
 
-func (answers *Answers) Matching(qtype uint16, clientIp string, label string) (records []dns.RR, ok bool) {
-	authoritativeFor := answers.AuthoritativeSuffixes()
-	authoritative := false
-	for _, suffix := range authoritativeFor {
-		if strings.HasSuffix(label, suffix) {
-			authoritative = true
-			break
+func (answers *Answers) localAddresses(clientIp string, fqdn string, depth int) (records []dns.RR, section string, ok bool) {
+	log.WithFields(log.Fields{"fqdn": fqdn, "client": clientIp, "depth": depth}).Debug("Trying A Records")
+	records, section, ok = answers.MatchingSection(dns.TypeA, clientIp, fqdn)
+	if !ok || len(records) == 0 {
+		return nil, "", false
+	}
+
+	log.WithFields(log.Fields{"fqdn": fqdn, "client": clientIp, "depth": depth}).Debug("Matched A ", records)
+	shuffle(&records)
+	return records, section, true
+}
+
+func (answers *Answers) recurseAddresses(ctx context.Context, clientIp string, fqdn string) (records []dns.RR, section string, ok bool) {
+	r := new(dns.Msg)
+	r.SetQuestion(fqdn, dns.TypeA)
+	msg, err := ResolveTryAll(ctx, r, answers.Recursers(clientIp))
+	if err != nil {
+		markUnresolved(ctx)
+		return nil, "", false
+	}
+	return answers.applyTtlFloor(clientIp, msg.Answer), SECTION_RECURSION, true
+}
+
+// The ALIAS for the exact name, from the client's answers or else the default ones
+func (answers *Answers) MatchingAlias(clientIp string, fqdn string) (alias RecordAlias, section string, ok bool) {
+	if client, found := (*answers)[answers.sectionFor(clientIp)]; found {
+		if alias, ok = client.Alias[fqdn]; ok {
+			return alias, SECTION_CLIENT, true
+		}
+	}
+
+	if client, found := (*answers)[DEFAULT_KEY]; found {
+		if alias, ok = client.Alias[fqdn]; ok {
+			return alias, SECTION_DEFAULT, true
+		}
+	}
+
+	return alias, "", false
+}
+
+// The A and AAAA records from a resolved ALIAS target, renamed to the ALIAS itself. The TTL is the
+// lowest of the ALIAS's and the records'.
+func flatten(fqdn string, ttl *uint32, records []dns.RR) (out []dns.RR) {
+	max := uint32(*defaultTtl)
+	if ttl != nil {
+		max = *ttl
+	}
+
+	for _, rr := range records {
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+			record := dns.Copy(rr)
+			record.Header().Name = fqdn
+			if record.Header().Ttl > max {
+				record.Header().Ttl = max
+			}
+			out = append(out, record)
 		}
 	}
 
+	return
+}
+
+func (answers *Answers) Matching(qtype uint16, clientIp string, label string) (records []dns.RR, ok bool) {
+	records, _, ok = answers.MatchingSection(qtype, clientIp, label)
+	return
+}
+
+// Like Matching, also returning whether the answer came from the client's or the default section
+func (answers *Answers) MatchingSection(qtype uint16, clientIp string, label string) (records []dns.RR, section string, ok bool) {
+	_, authoritative := answers.AuthoritativeFor(label)
+
 	// If we are authoritative for a suffix the label has, there's no point trying alternate search suffixes
 	var clientSearches []string
 	if authoritative {
@@ -150,31 +431,32 @@ func (answers *Answers) Matching(qtype uint16, clientIp string, label string) (r
 
 	// Client answers, client search
 	log.WithFields(log.Fields{"label": label, "client": clientIp}).Debug("Trying client answers, client search")
-	records, ok = answers.MatchingSearch(qtype, clientIp, label, clientSearches)
+	records, ok = answers.MatchingSearch(qtype, clientIp, label, clientSearches, clientIp)
 	if ok {
-		return
+		return records, SECTION_CLIENT, true
 	}
 
 	// Default answers, client search
 	log.WithFields(log.Fields{"label": label, "client": clientIp}).Debug("Trying default answers, client search")
-	records, ok = answers.MatchingSearch(qtype, DEFAULT_KEY, label, clientSearches)
+	records, ok = answers.MatchingSearch(qtype, DEFAULT_KEY, label, clientSearches, clientIp)
 	if ok {
-		return
+		return records, SECTION_DEFAULT, true
 	}
 
 	// Default answers, default search
 	log.WithFields(log.Fields{"label": label, "client": clientIp}).Debug("Trying default answers, default search")
 	defaultSearches := answers.SearchSuffixes(DEFAULT_KEY)
-	records, ok = answers.MatchingSearch(qtype, DEFAULT_KEY, label, defaultSearches)
+	records, ok = answers.MatchingSearch(qtype, DEFAULT_KEY, label, defaultSearches, clientIp)
 	if ok {
-		return
+		return records, SECTION_DEFAULT, true
 	}
 
-	return nil, false
+	return nil, "", false
 }
 
-func (answers *Answers) MatchingSearch(qtype uint16, clientIp string, label string, searches []string) (records []dns.RR, ok bool) {
-	records, ok = answers.MatchingExact(qtype, clientIp, label, label)
+// clientAddr is the address of the client asking, clientIp may be the default section instead
+func (answers *Answers) MatchingSearch(qtype uint16, clientIp string, label string, searches []string, clientAddr string) (records []dns.RR, ok bool) {
+	records, ok = answers.MatchingExact(qtype, clientIp, label, label, clientAddr)
 	if ok {
 		log.WithFields(log.Fields{"fqdn": label, "client": clientIp}).Debug("Matched exact FQDN")
 		return
@@ -188,7 +470,7 @@ func (answers *Answers) MatchingSearch(qtype uint16, clientIp string, label stri
 				newFqdn := base + "." + strings.TrimRight(suffix, ".") + "."
 				log.WithFields(log.Fields{"fqdn": newFqdn, "client": clientIp}).Debug("Trying alternate suffix")
 
-				records, ok = answers.MatchingExact(qtype, clientIp, newFqdn, label)
+				records, ok = answers.MatchingExact(qtype, clientIp, newFqdn, label, clientAddr)
 				if ok {
 					log.WithFields(log.Fields{"fqdn": newFqdn, "client": clientIp}).Debug("Matched alternate suffix")
 					return
@@ -200,27 +482,98 @@ func (answers *Answers) MatchingSearch(qtype uint16, clientIp string, label stri
 	return nil, false
 }
 
-func (answers *Answers) MatchingExact(qtype uint16, clientIp string, fqdn string, answerFqdn string) (records []dns.RR, ok bool) {
-	client, ok := (*answers)[clientIp]
+func (answers *Answers) MatchingExact(qtype uint16, clientIp string, fqdn string, answerFqdn string, clientAddr string) (records []dns.RR, ok bool) {
+	client, ok := (*answers)[answers.sectionFor(clientIp)]
 	if ok {
+		name := fqdn
+		if wildcard, covered := client.wildcardName(fqdn); covered {
+			fqdn = wildcard
+		}
+
 		switch qtype {
 		case dns.TypeA:
 			//log.WithFields(log.Fields{"qtype": "A", "client": clientIp, "fqdn": fqdn}).Debug("Searching for A")
 			res, ok := client.A[fqdn]
-			if ok && len(res.Answer) > 0 {
+			if !ok && fqdn == name {
+				// Names matching a pattern are more specific than a suffix default
+				if owner, covered := client.suffixDefault(name); covered {
+					if _, _, matched := client.matchPattern(name); !matched {
+						res, ok = client.SuffixDefaults[owner], true
+					}
+				}
+			}
+			if ok && (len(res.Answer) > 0 || res.Canary != "") {
 				ttl := uint32(*defaultTtl)
 				if res.Ttl != nil {
 					ttl = *res.Ttl
 				}
 
-				for i := 0; i < len(res.Answer); i++ {
+				weights := res.ActiveWeights(now())
+				self := ""
+				if res.ExcludeSelf || *excludeSelf {
+					self = clientAddr
+				}
+				var pool, addrs []string
+				for _, addr := range res.Answer {
+					if addr != res.Canary && addr != self && !isDrained(addr) {
+						pool = append(pool, addr)
+					}
+				}
+				if len(res.HealthyTtls) > 0 {
+					ttl = res.healthyTtl(countHealthy(pool, res), ttl)
+				}
+				if res.HealthPort > 0 {
+					pool = healthyAddrs(pool, res)
+				}
+				if reachable, ok := answers.reachableFrom(clientAddr); ok {
+					pool = filterReachable(pool, reachable)
+				}
+				if len(res.RegionPrefs) > 0 {
+					if region, ok := answers.regionOf(clientAddr); ok {
+						pool = preferRegion(pool, res.RegionPrefs[region])
+					}
+				}
+				for _, addr := range pool {
+					if weight, ok := weights[addr]; ok && weight <= 0 {
+						continue
+					}
+					addrs = append(addrs, addr)
+				}
+				if len(addrs) == 0 && len(pool) > 0 && res.Canary == "" {
+					// Weights never take a record down to nothing, only drained addresses do
+					log.WithFields(log.Fields{"qtype": "A", "client": clientIp, "fqdn": fqdn}).Warn("Every address has weight 0, ignoring weights")
+					addrs = pool
+					weights = nil
+				}
+
+				// Cap the answer, always keeping a slot for the canary
+				limit := res.Limit
+				if limit > 0 && res.Canary != "" {
+					limit--
+				}
+				if res.Limit > 0 && len(addrs) > limit && !client.allCandidates {
+					addrs = pickWeighted(addrs, weights, limit)
+				}
+
+				if res.Canary != "" && res.Canary != self && !isDrained(res.Canary) {
+					addrs = append(addrs, res.Canary)
+				}
+
+				for _, addr := range addrs {
 					hdr := dns.RR_Header{Name: answerFqdn, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}
-					ip := net.ParseIP(res.Answer[i])
-					record := &dns.A{Hdr: hdr, A: ip}
-					records = append(records, record)
+					records = append(records, &dns.A{Hdr: hdr, A: net.ParseIP(addr)})
 				}
 
 				shuffle(&records)
+			} else if !ok {
+				if p, addr, matched := client.matchPattern(name); matched {
+					ttl := uint32(*defaultTtl)
+					if p.Ttl != nil {
+						ttl = *p.Ttl
+					}
+					hdr := dns.RR_Header{Name: answerFqdn, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}
+					records = append(records, &dns.A{Hdr: hdr, A: net.ParseIP(addr)})
+				}
 			}
 
 		case dns.TypeCNAME:
@@ -232,9 +585,16 @@ func (answers *Answers) MatchingExact(qtype uint16, clientIp string, fqdn string
 			}
 
 			if ok {
-				hdr := dns.RR_Header{Name: answerFqdn, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl}
-				record := &dns.CNAME{Hdr: hdr, Target: res.Answer}
-				records = append(records, record)
+				targets := []string{res.Answer}
+				if len(res.Targets) > 0 && client.allCandidates {
+					targets = answers.cnameCandidates(clientIp, res)
+				} else if len(res.Targets) > 0 {
+					targets = []string{answers.pickCnameTarget(clientIp, res)}
+				}
+				for _, target := range targets {
+					hdr := dns.RR_Header{Name: answerFqdn, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl}
+					records = append(records, &dns.CNAME{Hdr: hdr, Target: target})
+				}
 			}
 
 		case dns.TypePTR:
@@ -251,6 +611,35 @@ func (answers *Answers) MatchingExact(qtype uint16, clientIp string, fqdn string
 				records = append(records, record)
 			}
 
+		case dns.TypeTLSA:
+			for _, res := range client.Tlsa[fqdn] {
+				ttl := uint32(*defaultTtl)
+				if res.Ttl != nil {
+					ttl = *res.Ttl
+				}
+
+				hdr := dns.RR_Header{Name: answerFqdn, Rrtype: dns.TypeTLSA, Class: dns.ClassINET, Ttl: ttl}
+				record := &dns.TLSA{Hdr: hdr, Usage: res.Usage, Selector: res.Selector, MatchingType: res.MatchingType, Certificate: strings.ToLower(res.Certificate)}
+				records = append(records, record)
+			}
+
+		case dns.TypeSRV:
+			for _, res := range client.Srv[fqdn] {
+				ttl := uint32(*defaultTtl)
+				if res.Ttl != nil {
+					ttl = *res.Ttl
+				}
+
+				hdr := dns.RR_Header{Name: answerFqdn, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl}
+				record := &dns.SRV{Hdr: hdr, Priority: res.Priority, Weight: res.Weight, Port: res.Port, Target: dns.Fqdn(res.Target)}
+				records = append(records, record)
+			}
+
+		case TypeHTTPS:
+			if recs, ok := client.Https[fqdn]; ok {
+				records = answers.httpsRecords(recs, name, answerFqdn, clientAddr)
+			}
+
 		case dns.TypeTXT:
 			//log.WithFields(log.Fields{"qtype": "TXT", "client": clientIp, "fqdn": fqdn}).Debug("Searching for TXT")
 			res, ok := client.Txt[fqdn]
@@ -272,6 +661,7 @@ func (answers *Answers) MatchingExact(qtype uint16, clientIp string, fqdn string
 				}
 			}
 		}
+
 	}
 
 	if len(records) > 0 {
@@ -281,11 +671,238 @@ func (answers *Answers) MatchingExact(qtype uint16, clientIp string, fqdn string
 	}
 }
 
+// Counts the local records sent to the client by the file they were loaded from, once per record set. Only what
+// is actually answered with counts, not every lookup made on the way to an answer.
+func (answers *Answers) countSources(clientIp string, records []dns.RR) {
+	seen := make(map[string]bool)
+	for _, rr := range records {
+		hdr := rr.Header()
+		key := sourceKey(hdr.Rrtype, hdr.Name)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		for _, section := range []string{answers.sectionFor(clientIp), DEFAULT_KEY} {
+			if file, ok := (*answers)[section].sourceOf(hdr.Rrtype, hdr.Name); ok {
+				answersBySource.Inc(file)
+				break
+			}
+		}
+	}
+}
+
+// The file the records of the type answered for the name came from: the name's own or its wildcard's, else
+// for A records the pattern or suffix default covering it, in the order MatchingExact tries them
+func (client ClientAnswers) sourceOf(qtype uint16, name string) (string, bool) {
+	if len(client.Sources) == 0 {
+		return "", false
+	}
+
+	owner := name
+	if wildcard, covered := client.wildcardName(name); covered {
+		owner = wildcard
+	}
+	if file, ok := client.Sources[sourceKey(qtype, owner)]; ok {
+		return file, true
+	}
+	if qtype != dns.TypeA {
+		return "", false
+	}
+	if p, _, matched := client.matchPattern(name); matched {
+		file, ok := client.Sources[sourceKey(dns.TypeA, p.Match)]
+		return file, ok
+	}
+	if owner, covered := client.suffixDefault(name); covered {
+		file, ok := client.Sources[sourceKey(dns.TypeA, owner)]
+		return file, ok
+	}
+	return "", false
+}
+
+// Picks one of a weighted CNAME's targets, preferring the healthy ones
+func (answers *Answers) pickCnameTarget(clientIp string, res RecordCname) string {
+	return pickWeighted(answers.cnameCandidates(clientIp, res), res.Targets, 1)[0]
+}
+
+// The targets of a weighted CNAME one is picked from, sorted: the healthy ones, or all of them if none are
+func (answers *Answers) cnameCandidates(clientIp string, res RecordCname) []string {
+	var all, healthy []string
+	for _, target := range sortedKeys(res.Targets) {
+		if res.Targets[target] <= 0 {
+			continue
+		}
+		all = append(all, target)
+		if answers.targetHealthy(clientIp, target, res.HealthPort) {
+			healthy = append(healthy, target)
+		}
+	}
+
+	if len(healthy) == 0 {
+		log.WithFields(log.Fields{"client": clientIp, "targets": all}).Warn("No healthy CNAME target, picking any")
+		healthy = all
+	}
+	return healthy
+}
+
+// A target is unhealthy when it has local addresses and none of them pass the health check.
+// Targets that are resolved recursively can't be checked and always count as healthy.
+func (answers *Answers) targetHealthy(clientIp string, target string, port int) bool {
+	if port == 0 {
+		return true
+	}
+
+	records, ok := answers.Matching(dns.TypeA, clientIp, target)
+	if !ok || len(records) == 0 {
+		return true
+	}
+
+	for _, record := range records {
+		if a, ok := record.(*dns.A); ok && health.Healthy(a.A.String(), port) {
+			return true
+		}
+	}
+	return false
+}
+
+// The addresses that pass the record's health check. When none do they are all returned anyway,
+// unless the record falls back to recursion instead.
+func healthyAddrs(addrs []string, res RecordA) []string {
+	var healthy []string
+	for _, addr := range addrs {
+		if health.Healthy(addr, res.HealthPort) {
+			healthy = append(healthy, addr)
+		}
+	}
+
+	if len(healthy) == 0 && !res.FallbackRecurse {
+		log.WithFields(log.Fields{"addrs": addrs}).Warn("No healthy address, answering with all of them")
+		return addrs
+	}
+	return healthy
+}
+
+// How many of the addresses pass the record's health check, all of them if it has none
+func countHealthy(addrs []string, res RecordA) int {
+	if res.HealthPort <= 0 {
+		return len(addrs)
+	}
+
+	count := 0
+	for _, addr := range addrs {
+		if health.Healthy(addr, res.HealthPort) {
+			count++
+		}
+	}
+	return count
+}
+
+// The TTL of the highest healthyttls step the count reaches, ttl if it reaches none
+func (res RecordA) healthyTtl(healthy int, ttl uint32) uint32 {
+	best := -1
+	for _, step := range res.HealthyTtls {
+		if step.Healthy <= healthy && step.Healthy > best {
+			best = step.Healthy
+			ttl = step.Ttl
+		}
+	}
+	return ttl
+}
+
+// Whether the name has an A record that wants to be recursed when it has no usable local address
+func (answers *Answers) fallsBackToRecursion(clientIp string, fqdn string) bool {
+	for _, key := range []string{answers.sectionFor(clientIp), DEFAULT_KEY} {
+		if client, ok := (*answers)[key]; ok {
+			if rec, ok := client.A[fqdn]; ok {
+				return rec.FallbackRecurse
+			}
+		}
+	}
+	return false
+}
+
+// Whether the name's A record has labels a failover selector matches
+func (answers *Answers) failedOver(clientIp string, fqdn string) bool {
+	for _, key := range []string{answers.sectionFor(clientIp), DEFAULT_KEY} {
+		if client, ok := (*answers)[key]; ok {
+			if rec, ok := client.A[fqdn]; ok {
+				return labelsFailedOver(rec.Labels)
+			}
+		}
+	}
+	return false
+}
+
+// The recursewhenup address of the name's A record, if it has one
+func (answers *Answers) gateOf(clientIp string, fqdn string) string {
+	for _, key := range []string{answers.sectionFor(clientIp), DEFAULT_KEY} {
+		if client, ok := (*answers)[key]; ok {
+			if rec, ok := client.A[fqdn]; ok {
+				return rec.RecurseWhenUp
+			}
+		}
+	}
+	return ""
+}
+
+// Whether the name's A record is gated on an address that passes its health check right now
+func (answers *Answers) gateOpen(clientIp string, fqdn string) bool {
+	gate := answers.gateOf(clientIp, fqdn)
+	if gate == "" {
+		return false
+	}
+
+	host, port, err := net.SplitHostPort(gate)
+	if err != nil {
+		return false
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	return health.Healthy(host, portNum)
+}
+
+// Randomly picks n of the addresses, each one's chance being proportional to its weight (1 if it has none)
+func pickWeighted(addrs []string, weights map[string]int, n int) []string {
+	pool := append([]string{}, addrs...)
+	var picked []string
+	for len(picked) < n && len(pool) > 0 {
+		total := 0
+		for _, addr := range pool {
+			total += weightOf(weights, addr)
+		}
+
+		r := rand.Intn(total)
+		for i, addr := range pool {
+			r -= weightOf(weights, addr)
+			if r < 0 {
+				picked = append(picked, addr)
+				pool = append(pool[:i], pool[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return picked
+}
+
+func weightOf(weights map[string]int, addr string) int {
+	if weight, ok := weights[addr]; ok {
+		return weight
+	}
+	return 1
+}
+
 // Shuffles the sub-section of the supplied slice starting from the first A or AAAA record and going
 // until the end. In other words, doesn't shuffle CNAME records at the start of the slice whose order
-// should be maintained.
+// should be maintained. With --stable-order the records are left in the order they are configured in.
 func shuffle(items *[]dns.RR) {
 	max := len(*items)
+	if max <= 1 || *stableOrder {
+		return
+	}
+
 	foundA := false
 
 	for i := 0; i < max; i++ {
@@ -298,3 +915,43 @@ func shuffle(items *[]dns.RR) {
 		(*items)[i], (*items)[j] = (*items)[j], (*items)[i]
 	}
 }
+
+// Reorders the A answers in next so addresses that were already in prev keep their relative order,
+// followed by the new ones in the order they are given
+func keepAnswerOrder(prev Answers, next Answers) {
+	for key, client := range next {
+		old, ok := prev[key]
+		if !ok {
+			continue
+		}
+
+		for name, rec := range client.A {
+			oldRec, ok := old.A[name]
+			if !ok {
+				continue
+			}
+
+			current := make(map[string]bool, len(rec.Answer))
+			for _, addr := range rec.Answer {
+				current[addr] = true
+			}
+
+			ordered := make([]string, 0, len(rec.Answer))
+			kept := make(map[string]bool, len(rec.Answer))
+			for _, addr := range oldRec.Answer {
+				if current[addr] && !kept[addr] {
+					ordered = append(ordered, addr)
+					kept[addr] = true
+				}
+			}
+			for _, addr := range rec.Answer {
+				if !kept[addr] {
+					ordered = append(ordered, addr)
+				}
+			}
+
+			rec.Answer = ordered
+			client.A[name] = rec
+		}
+	}
+}
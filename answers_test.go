@@ -1,7 +1,15 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"gopkg.in/check.v1"
@@ -31,6 +39,40 @@ func (t *Tests) TestOne(c *check.C) {
 	c.Check(records, check.DeepEquals, []dns.RR{arecord})
 }
 
+func (t *Tests) TestOneAfterCname(c *check.C) {
+	cname := &dns.RR_Header{
+		Name:   "cname1",
+		Rrtype: dns.TypeCNAME,
+		Class:  dns.ClassINET,
+		Ttl:    100,
+	}
+	arecord := &dns.RR_Header{
+		Name:   "arecord1",
+		Rrtype: dns.TypeA,
+		Class:  dns.ClassINET,
+		Ttl:    100,
+	}
+	for i := 0; i < 100; i++ {
+		records := []dns.RR{cname, arecord}
+		shuffle(&records)
+		c.Check(records, check.DeepEquals, []dns.RR{cname, arecord})
+	}
+
+	// A chain of CNAMEs followed by exactly one record stays as it is too
+	www := &dns.CNAME{Hdr: dns.RR_Header{Name: "www.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 100}, Target: "web."}
+	web := &dns.CNAME{Hdr: dns.RR_Header{Name: "web.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 100}, Target: "host."}
+	host := &dns.A{Hdr: dns.RR_Header{Name: "host.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 100}, A: net.ParseIP("10.0.0.1")}
+	for i := 0; i < 100; i++ {
+		records := []dns.RR{www, web, host}
+		shuffle(&records)
+		c.Check(records, check.DeepEquals, []dns.RR{www, web, host})
+
+		records = []dns.RR{web, host}
+		shuffle(&records)
+		c.Check(records, check.DeepEquals, []dns.RR{web, host})
+	}
+}
+
 func (t *Tests) TestNoARecords(c *check.C) {
 	cname1 := &dns.RR_Header{
 		Name:   "cname1",
@@ -124,3 +166,738 @@ func (t *Tests) testShuffle(aType uint16, c *check.C) {
 	c.Check(aRecord2First, check.Equals, true)
 	c.Check(aRecord3First, check.Equals, true)
 }
+
+func benchmarkShuffle(b *testing.B, count int) {
+	records := make([]dns.RR, count)
+	for i := range records {
+		records[i] = &dns.RR_Header{Name: "arecord", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 100}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		shuffle(&records)
+	}
+}
+
+func BenchmarkShuffleOne(b *testing.B)  { benchmarkShuffle(b, 1) }
+func BenchmarkShuffleFive(b *testing.B) { benchmarkShuffle(b, 5) }
+
+// Answers for clients 10.1.0.0 onwards with a few records each, plus default names
+// svc-N.rancher.internal. with five addresses and alias-N.rancher.internal. CNAMEs to them
+func syntheticAnswers(clients, names int) Answers {
+	answers := Answers{}
+	for i := 0; i < clients; i++ {
+		answers[fmt.Sprintf("10.1.%d.%d", i/256, i%256)] = ClientAnswers{
+			Search: []string{"stack.rancher.internal."},
+			A: map[string]RecordA{
+				fmt.Sprintf("own-%d.rancher.internal.", i): {Answer: []string{"10.2.0.1"}},
+			},
+		}
+	}
+
+	defaults := ClientAnswers{
+		Authoritative: []string{"rancher.internal"},
+		A:             make(map[string]RecordA),
+		Cname:         make(map[string]RecordCname),
+	}
+	for i := 0; i < names; i++ {
+		var addrs []string
+		for j := 0; j < 5; j++ {
+			addrs = append(addrs, fmt.Sprintf("10.3.%d.%d", i%256, j))
+		}
+		defaults.A[fmt.Sprintf("svc-%d.rancher.internal.", i)] = RecordA{Answer: addrs}
+		defaults.Cname[fmt.Sprintf("alias-%d.rancher.internal.", i)] = RecordCname{Answer: fmt.Sprintf("svc-%d.rancher.internal.", i)}
+	}
+	answers[DEFAULT_KEY] = defaults
+	prepareAnswers(answers)
+	return answers
+}
+
+func BenchmarkMatching(b *testing.B) {
+	answers := syntheticAnswers(1000, 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		answers.Matching(dns.TypeA, "10.1.0.7", fmt.Sprintf("svc-%d.rancher.internal.", i%10000))
+	}
+}
+
+func BenchmarkMatchingMiss(b *testing.B) {
+	answers := syntheticAnswers(1000, 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		answers.Matching(dns.TypeA, "10.1.0.7", "missing.rancher.internal.")
+	}
+}
+
+func BenchmarkAddressesCname(b *testing.B) {
+	answers := syntheticAnswers(1000, 10000)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		answers.Addresses(ctx, "10.1.0.7", fmt.Sprintf("alias-%d.rancher.internal.", i%10000), nil, 1)
+	}
+}
+
+// Starts a recursive server that answers every A query with 9.9.9.9 and counts the queries it gets
+func startUpstream(c *check.C) (addr string, queries *int32, stop func()) {
+	return startUpstreamAnswering(c, "9.9.9.9")
+}
+
+func startUpstreamAnswering(c *check.C, ip string) (addr string, queries *int32, stop func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+
+	queries = new(int32)
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		hdr := dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.ParseIP(ip)})
+		w.WriteMsg(m)
+	})
+
+	server := &dns.Server{PacketConn: pc, Handler: handler}
+	go server.ActivateAndServe()
+	return pc.LocalAddr().String(), queries, func() { server.Shutdown() }
+}
+
+func (t *Tests) TestNoRecursionInAuthoritativeZone(c *check.C) {
+	upstream, queries, stop := startUpstream(c)
+	defer stop()
+
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Recurse:       []string{upstream},
+			Authoritative: []string{"rancher.internal"},
+			Cname: map[string]RecordCname{
+				"external.":             {Answer: "example.com."},
+				"internal.":             {Answer: "missing.rancher.internal."},
+				"web.":                  {Answer: "web.rancher.internal."},
+				"web.rancher.internal.": {Answer: "nothing.rancher.internal."},
+			},
+		},
+	}
+
+	records, ok := answers.Addresses(context.Background(), "10.1.1.1", "internal.", nil, 1)
+	c.Check(ok, check.Equals, false)
+	c.Check(records, check.HasLen, 0)
+
+	records, ok = answers.Addresses(context.Background(), "10.1.1.1", "web.", nil, 1)
+	c.Check(ok, check.Equals, false)
+	c.Check(records, check.HasLen, 0)
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(0))
+
+	// Out of zone targets are still recursed
+	records, ok = answers.Addresses(context.Background(), "10.1.1.1", "external.", nil, 1)
+	c.Check(ok, check.Equals, true)
+	c.Check(records, check.HasLen, 2)
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(1))
+}
+
+func (t *Tests) TestCanary(c *check.C) {
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"pool.": {Answer: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.9"}, Canary: "10.0.0.9", Limit: 2},
+			},
+		},
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		records, ok := answers.Matching(dns.TypeA, "10.1.1.1", "pool.")
+		c.Assert(ok, check.Equals, true)
+		c.Assert(records, check.HasLen, 2)
+
+		canary := 0
+		for _, record := range records {
+			ip := record.(*dns.A).A.String()
+			seen[ip] = true
+			if ip == "10.0.0.9" {
+				canary++
+			}
+		}
+		c.Check(canary, check.Equals, 1)
+	}
+
+	// Every other address still gets its turn
+	c.Check(seen, check.HasLen, 5)
+}
+
+func (t *Tests) TestPerClientAlias(c *check.C) {
+	upstream, queries, stop := startUpstream(c)
+	defer stop()
+
+	ttl := uint32(30)
+	answers := Answers{
+		"10.1.1.2": ClientAnswers{
+			Alias: map[string]RecordAlias{
+				"example.com.": {Answer: "lb.external.net."},
+			},
+		},
+		DEFAULT_KEY: ClientAnswers{
+			Recurse: []string{upstream},
+			Alias: map[string]RecordAlias{
+				"example.com.": {Answer: "lb.example.com.", Ttl: &ttl},
+			},
+			A: map[string]RecordA{
+				"lb.example.com.": {Answer: []string{"10.0.0.1", "10.0.0.2"}},
+			},
+		},
+	}
+
+	records, ok := answers.Addresses(context.Background(), "10.1.1.1", "example.com.", nil, 1)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(records, check.HasLen, 2)
+	for _, record := range records {
+		c.Check(record.Header().Name, check.Equals, "example.com.")
+		c.Check(record.Header().Ttl, check.Equals, ttl)
+	}
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(0))
+
+	// This client's ALIAS points somewhere else, which is recursed
+	records, ok = answers.Addresses(context.Background(), "10.1.1.2", "example.com.", nil, 1)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(records, check.HasLen, 1)
+	c.Check(records[0].Header().Name, check.Equals, "example.com.")
+	c.Check(records[0].(*dns.A).A.String(), check.Equals, "9.9.9.9")
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(1))
+}
+
+func (t *Tests) TestWeightSchedule(c *check.C) {
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"batch.": {
+					Answer:   []string{"10.0.0.1", "10.0.0.2"},
+					Limit:    1,
+					Weights:  map[string]int{"10.0.0.2": 0},
+					Schedule: []WeightSchedule{{From: "22:00", To: "06:00", Weights: map[string]int{"10.0.0.1": 0}}},
+				},
+			},
+		},
+	}
+	defer func() { now = time.Now }()
+
+	pick := func(hour int) string {
+		now = func() time.Time { return time.Date(2016, 1, 1, hour, 30, 0, 0, time.Local) }
+		records, ok := answers.Matching(dns.TypeA, "10.1.1.1", "batch.")
+		c.Assert(ok, check.Equals, true)
+		c.Assert(records, check.HasLen, 1)
+		return records[0].(*dns.A).A.String()
+	}
+
+	for i := 0; i < 20; i++ {
+		c.Check(pick(12), check.Equals, "10.0.0.1")
+		c.Check(pick(23), check.Equals, "10.0.0.2")
+		c.Check(pick(3), check.Equals, "10.0.0.2")
+	}
+}
+
+func (t *Tests) TestAllWeightsZero(c *check.C) {
+	rec := RecordA{Answer: []string{"10.0.0.1", "10.0.0.2"}, Limit: 1, Weights: map[string]int{"10.0.0.1": 0, "10.0.0.2": 0}}
+	c.Check(validateWeights(rec), check.NotNil)
+	c.Check(validateWeights(RecordA{Answer: rec.Answer, Weights: rec.Weights, Canary: "10.0.0.3"}), check.IsNil)
+
+	window := []WeightSchedule{{From: "22:00", To: "06:00", Weights: rec.Weights}}
+	c.Check(validateWeights(RecordA{Answer: rec.Answer, Schedule: window}), check.NotNil)
+	c.Check(validateWeights(RecordA{Answer: rec.Answer, Weights: map[string]int{"10.0.0.1": 0}}), check.IsNil)
+
+	// Draining can still leave only addresses of weight 0, which are picked from as if they had none
+	answers := Answers{DEFAULT_KEY: ClientAnswers{A: map[string]RecordA{
+		"batch.": {Answer: rec.Answer, Limit: 1, Weights: map[string]int{"10.0.0.1": 0, "10.0.0.2": 0}},
+	}}}
+	for i := 0; i < 10; i++ {
+		records, ok := answers.Matching(dns.TypeA, "10.1.1.1", "batch.")
+		c.Assert(ok, check.Equals, true)
+		c.Check(records, check.HasLen, 1)
+	}
+}
+
+func (t *Tests) TestValidateSchedule(c *check.C) {
+	c.Check(validateSchedule([]WeightSchedule{{From: "08:00", To: "12:00"}, {From: "12:00", To: "18:00"}}), check.IsNil)
+	c.Check(validateSchedule([]WeightSchedule{{From: "22:00", To: "06:00"}, {From: "05:00", To: "08:00"}}), check.NotNil)
+	c.Check(validateSchedule([]WeightSchedule{{From: "8am", To: "12:00"}}), check.NotNil)
+	c.Check(validateSchedule([]WeightSchedule{{From: "08:00", To: "08:00"}}), check.NotNil)
+}
+
+func (t *Tests) TestWeightedCnameHealth(c *check.C) {
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer up.Close()
+	_, portStr, _ := net.SplitHostPort(up.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Cname: map[string]RecordCname{
+				"svc.": {Targets: map[string]int{"blue.": 1, "green.": 9}, HealthPort: port},
+			},
+			A: map[string]RecordA{
+				"blue.":  {Answer: []string{"127.0.0.1"}},
+				"green.": {Answer: []string{"127.0.0.2"}},
+			},
+		},
+	}
+
+	health = newHealthChecker()
+	defer func() { health = newHealthChecker() }()
+	health.check(net.JoinHostPort("127.0.0.1", portStr))
+	health.check(net.JoinHostPort("127.0.0.2", portStr))
+
+	target := func() string {
+		records, ok := answers.Matching(dns.TypeCNAME, "10.1.1.1", "svc.")
+		c.Assert(ok, check.Equals, true)
+		c.Assert(records, check.HasLen, 1)
+		return records[0].(*dns.CNAME).Target
+	}
+
+	// Green is far more likely, but only blue is up
+	for i := 0; i < 20; i++ {
+		c.Check(target(), check.Equals, "blue.")
+	}
+
+	// With nothing up any target will do
+	up.Close()
+	health.check(net.JoinHostPort("127.0.0.1", portStr))
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		seen[target()] = true
+	}
+	c.Check(seen, check.HasLen, 2)
+}
+
+func (t *Tests) TestTlsa(c *check.C) {
+	digest := strings.Repeat("ab", 32)
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Tlsa: map[string][]RecordTlsa{
+				"_443._tcp.web.": {
+					{Usage: 3, Selector: 1, MatchingType: 1, Certificate: strings.ToUpper(digest)},
+					{Usage: 2, Selector: 0, MatchingType: 1, Certificate: digest},
+				},
+			},
+		},
+	}
+
+	records, ok := answers.Matching(dns.TypeTLSA, "10.1.1.1", "_443._tcp.web.")
+	c.Assert(ok, check.Equals, true)
+	c.Assert(records, check.HasLen, 2)
+	tlsa := records[0].(*dns.TLSA)
+	c.Check(tlsa.Usage, check.Equals, uint8(3))
+	c.Check(tlsa.Selector, check.Equals, uint8(1))
+	c.Check(tlsa.MatchingType, check.Equals, uint8(1))
+	c.Check(tlsa.Certificate, check.Equals, digest)
+
+	c.Check(validateTlsa(RecordTlsa{Usage: 3, Selector: 1, MatchingType: 1, Certificate: digest}), check.IsNil)
+	c.Check(validateTlsa(RecordTlsa{Usage: 3, Selector: 1, MatchingType: 0, Certificate: "3082"}), check.IsNil)
+	c.Check(validateTlsa(RecordTlsa{Usage: 3, Selector: 1, MatchingType: 2, Certificate: digest}), check.NotNil)
+	c.Check(validateTlsa(RecordTlsa{Usage: 3, Selector: 1, MatchingType: 1, Certificate: "zz"}), check.NotNil)
+	c.Check(validateTlsa(RecordTlsa{Usage: 4, Selector: 1, MatchingType: 1, Certificate: digest}), check.NotNil)
+}
+
+func (t *Tests) TestKeepAnswerOrder(c *check.C) {
+	prev := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"web.": {Answer: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+			},
+		},
+	}
+	next := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"web.": {Answer: []string{"10.0.0.4", "10.0.0.3", "10.0.0.1"}},
+				"new.": {Answer: []string{"10.0.1.2", "10.0.1.1"}},
+			},
+		},
+	}
+
+	keepAnswerOrder(prev, next)
+	c.Check(next[DEFAULT_KEY].A["web."].Answer, check.DeepEquals, []string{"10.0.0.1", "10.0.0.3", "10.0.0.4"})
+	c.Check(next[DEFAULT_KEY].A["new."].Answer, check.DeepEquals, []string{"10.0.1.2", "10.0.1.1"})
+}
+
+func (t *Tests) TestExcludeSelf(c *check.C) {
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"peers.":  {Answer: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, ExcludeSelf: true},
+				"alone.":  {Answer: []string{"10.0.0.1"}, ExcludeSelf: true},
+				"others.": {Answer: []string{"10.0.0.1", "10.0.0.2"}},
+			},
+		},
+	}
+
+	addrs := func(fqdn string) []string {
+		var out []string
+		records, _ := answers.Matching(dns.TypeA, "10.0.0.1", fqdn)
+		for _, rr := range records {
+			out = append(out, rr.(*dns.A).A.String())
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	c.Check(addrs("peers."), check.DeepEquals, []string{"10.0.0.2", "10.0.0.3"})
+	c.Check(addrs("alone."), check.HasLen, 0)
+	c.Check(addrs("others."), check.DeepEquals, []string{"10.0.0.1", "10.0.0.2"})
+
+	*excludeSelf = true
+	defer func() { *excludeSelf = false }()
+	c.Check(addrs("others."), check.DeepEquals, []string{"10.0.0.2"})
+}
+
+func (t *Tests) TestAOverCnamePrecedence(c *check.C) {
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"both.":   {Answer: []string{"10.0.0.1"}},
+				"target.": {Answer: []string{"10.0.0.2"}},
+			},
+			Cname: map[string]RecordCname{
+				"both.":  {Answer: "target."},
+				"alias.": {Answer: "target."},
+			},
+		},
+	}
+
+	records, ok := answers.Addresses(context.Background(), "10.1.1.1", "both.", nil, 1)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(records, check.HasLen, 2)
+	c.Check(records[0].(*dns.CNAME).Target, check.Equals, "target.")
+
+	*precedence = PRECEDENCE_A_OVER_CNAME
+	defer func() { *precedence = PRECEDENCE_CNAME }()
+
+	records, ok = answers.Addresses(context.Background(), "10.1.1.1", "both.", nil, 1)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(records, check.HasLen, 1)
+	c.Check(records[0].(*dns.A).A.String(), check.Equals, "10.0.0.1")
+
+	// Without an A the CNAME is still followed
+	records, ok = answers.Addresses(context.Background(), "10.1.1.1", "alias.", nil, 1)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(records, check.HasLen, 2)
+	c.Check(records[1].(*dns.A).A.String(), check.Equals, "10.0.0.2")
+}
+
+func (t *Tests) TestPatterns(c *check.C) {
+	ttl := uint32(60)
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"ip-1-1.dyn.example.com.": {Answer: []string{"10.0.0.1"}},
+			},
+			Patterns: []RecordPattern{
+				{Match: "ip-*-*.dyn.example.com.", Answer: "10.42.$1.$2", Ttl: &ttl},
+				{Match: "*.node.example.com.", Lookup: map[string]string{"alpha": "10.43.0.1"}},
+			},
+		},
+	}
+
+	records, ok := answers.Matching(dns.TypeA, "10.1.1.1", "ip-3-7.dyn.example.com.")
+	c.Assert(ok, check.Equals, true)
+	c.Assert(records, check.HasLen, 1)
+	c.Check(records[0].(*dns.A).A.String(), check.Equals, "10.42.3.7")
+	c.Check(records[0].Header().Ttl, check.Equals, uint32(60))
+
+	// A record of its own wins
+	records, ok = answers.Matching(dns.TypeA, "10.1.1.1", "ip-1-1.dyn.example.com.")
+	c.Assert(ok, check.Equals, true)
+	c.Check(records[0].(*dns.A).A.String(), check.Equals, "10.0.0.1")
+
+	records, ok = answers.Matching(dns.TypeA, "10.1.1.1", "alpha.node.example.com.")
+	c.Assert(ok, check.Equals, true)
+	c.Check(records[0].(*dns.A).A.String(), check.Equals, "10.43.0.1")
+
+	// Wrong label count, not an address, and missing from the lookup table
+	for _, name := range []string{"x.ip-3-7.dyn.example.com.", "ip-3-777.dyn.example.com.", "gamma.node.example.com."} {
+		_, ok = answers.Matching(dns.TypeA, "10.1.1.1", name)
+		c.Check(ok, check.Equals, false, check.Commentf(name))
+	}
+
+	_, ok = answers.HasName("10.1.1.1", "alpha.node.example.com.")
+	c.Check(ok, check.Equals, true)
+
+	c.Check(validatePattern(RecordPattern{Match: "dyn.example.com.", Answer: "10.0.0.1"}), check.NotNil)
+	c.Check(validatePattern(RecordPattern{Match: "*.dyn.example.com"}), check.NotNil)
+	c.Check(validatePattern(RecordPattern{Match: "*.dyn.example.com."}), check.NotNil)
+	c.Check(validatePattern(RecordPattern{Match: "*.dyn.example.com.", Lookup: map[string]string{"a": "web."}}), check.NotNil)
+	c.Check(validatePattern(RecordPattern{Match: "*.dyn.example.com.", Answer: "10.0.0.$1"}), check.IsNil)
+}
+
+func (t *Tests) TestWildcards(c *check.C) {
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"*.example.com.":     {Answer: []string{"10.0.0.1"}},
+				"www.example.com.":   {Answer: []string{"10.0.0.2"}},
+				"sub.example.com.":   {Answer: []string{"10.0.0.3"}},
+				"*.app.example.com.": {Answer: []string{"10.0.0.4"}},
+			},
+			Txt: map[string]RecordTxt{
+				"txt.example.com.": {Answer: []string{"hello"}},
+			},
+		},
+	}
+
+	addr := func(fqdn string) string {
+		records, ok := answers.Matching(dns.TypeA, "10.1.1.1", fqdn)
+		if !ok {
+			return ""
+		}
+		c.Check(records[0].Header().Name, check.Equals, fqdn)
+		return records[0].(*dns.A).A.String()
+	}
+
+	c.Check(addr("foo.example.com."), check.Equals, "10.0.0.1")
+	c.Check(addr("a.b.example.com."), check.Equals, "10.0.0.1")
+	c.Check(addr("www.example.com."), check.Equals, "10.0.0.2")
+	c.Check(addr("x.app.example.com."), check.Equals, "10.0.0.4")
+
+	// Names that exist, or are under one that does, aren't covered
+	c.Check(addr("txt.example.com."), check.Equals, "")
+	c.Check(addr("x.sub.example.com."), check.Equals, "")
+	c.Check(addr("example.com."), check.Equals, "")
+
+	// The wildcard makes the name exist for every type
+	_, ok := answers.HasName("10.1.1.1", "foo.example.com.")
+	c.Check(ok, check.Equals, true)
+	_, ok = answers.HasName("10.1.1.1", "x.sub.example.com.")
+	c.Check(ok, check.Equals, false)
+
+	// Names with only others under them exist, but only in our zones
+	prepareAnswers(answers)
+	c.Check(addr("x.app.example.com."), check.Equals, "10.0.0.4")
+	c.Check(addr("app.example.com."), check.Equals, "")
+	_, ok = answers.HasName("10.1.1.1", "app.example.com.")
+	c.Check(ok, check.Equals, false)
+	def := answers[DEFAULT_KEY]
+	def.Authoritative = []string{"example.com"}
+	answers[DEFAULT_KEY] = def
+	_, ok = answers.HasName("10.1.1.1", "app.example.com.")
+	c.Check(ok, check.Equals, true)
+}
+
+func (t *Tests) TestReachable(c *check.C) {
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"web.":   {Answer: []string{"10.1.0.5", "10.2.0.5", "10.42.0.5"}},
+				"other.": {Answer: []string{"10.2.0.6"}},
+			},
+			Reachable: map[string][]string{
+				"10.1.0.0/16": {"10.1.0.0/16", "10.42.0.0/16"},
+				"10.1.1.1":    {"10.3.0.0/16"},
+			},
+		},
+	}
+	c.Assert(validateAnswers(answers), check.IsNil)
+	prepareNetworks(answers)
+
+	addrs := func(clientIp, fqdn string) []string {
+		var out []string
+		records, _ := answers.Matching(dns.TypeA, clientIp, fqdn)
+		for _, rr := range records {
+			out = append(out, rr.(*dns.A).A.String())
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	c.Check(addrs("10.1.2.2", "web."), check.DeepEquals, []string{"10.1.0.5", "10.42.0.5"})
+	c.Check(addrs("10.9.9.9", "web."), check.DeepEquals, []string{"10.1.0.5", "10.2.0.5", "10.42.0.5"})
+
+	// Nothing reachable, so everything
+	c.Check(addrs("10.1.2.2", "other."), check.DeepEquals, []string{"10.2.0.6"})
+
+	bad := Answers{DEFAULT_KEY: ClientAnswers{Reachable: map[string][]string{"10.1.0.0/16": {"nope"}}}}
+	c.Check(validateAnswers(bad), check.NotNil)
+}
+
+func (t *Tests) TestHealthyTtls(c *check.C) {
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer up.Close()
+	_, portStr, _ := net.SplitHostPort(up.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"pool.": {
+					Answer:      []string{"127.0.0.1", "127.0.0.2"},
+					HealthPort:  port,
+					HealthyTtls: []HealthyTtl{{Healthy: 0, Ttl: 5}, {Healthy: 2, Ttl: 300}},
+				},
+				"static.": {
+					Answer:      []string{"10.1.1.1", "10.1.1.2"},
+					HealthyTtls: []HealthyTtl{{Healthy: 1, Ttl: 30}, {Healthy: 3, Ttl: 300}},
+				},
+			},
+		},
+	}
+	c.Assert(validateAnswers(answers), check.IsNil)
+
+	health = newHealthChecker()
+	defer func() { health = newHealthChecker() }()
+
+	ttl := func(fqdn string) uint32 {
+		records, ok := answers.Matching(dns.TypeA, "10.1.1.1", fqdn)
+		c.Assert(ok, check.Equals, true)
+		c.Assert(len(records) > 0, check.Equals, true)
+		return records[0].Header().Ttl
+	}
+
+	// Unchecked addresses count as healthy
+	c.Check(ttl("pool."), check.Equals, uint32(300))
+
+	health.check(net.JoinHostPort("127.0.0.1", portStr))
+	health.check(net.JoinHostPort("127.0.0.2", portStr))
+	c.Check(ttl("pool."), check.Equals, uint32(5))
+
+	// Without a health check every address that isn't drained counts
+	c.Check(ttl("static."), check.Equals, uint32(30))
+
+	c.Check(validateHealthyTtls([]HealthyTtl{{Healthy: 1, Ttl: 5}, {Healthy: 1, Ttl: 60}}), check.NotNil)
+	c.Check(validateHealthyTtls([]HealthyTtl{{Healthy: -1, Ttl: 5}}), check.NotNil)
+}
+
+func (t *Tests) TestSuffixDefaults(c *check.C) {
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"web.internal.":     {Answer: []string{"10.0.0.2"}},
+				"*.app.internal.":   {Answer: []string{"10.0.0.3"}},
+				"db.corp.internal.": {Answer: []string{"10.0.0.4"}},
+			},
+			Txt: map[string]RecordTxt{
+				"txt.internal.": {Answer: []string{"hello"}},
+			},
+			Patterns: []RecordPattern{
+				{Match: "ip-*.internal.", Answer: "10.42.0.$1"},
+			},
+			SuffixDefaults: map[string]RecordA{
+				"*.internal.":      {Answer: []string{"10.0.0.1"}},
+				"*.corp.internal.": {Answer: []string{"10.0.0.5"}},
+			},
+		},
+	}
+	c.Assert(validateAnswers(answers), check.IsNil)
+
+	addr := func(fqdn string) string {
+		records, ok := answers.Matching(dns.TypeA, "10.1.1.1", fqdn)
+		if !ok || len(records) == 0 {
+			return ""
+		}
+		c.Check(records[0].Header().Name, check.Equals, fqdn)
+		return records[0].(*dns.A).A.String()
+	}
+
+	c.Check(addr("foo.internal."), check.Equals, "10.0.0.1")
+	c.Check(addr("a.b.c.internal."), check.Equals, "10.0.0.1")
+	c.Check(addr("foo.corp.internal."), check.Equals, "10.0.0.5")
+
+	// Specific records, wildcards and patterns win, even under names that exist the default applies
+	c.Check(addr("web.internal."), check.Equals, "10.0.0.2")
+	c.Check(addr("x.app.internal."), check.Equals, "10.0.0.3")
+	c.Check(addr("ip-7.internal."), check.Equals, "10.42.0.7")
+	c.Check(addr("x.web.internal."), check.Equals, "10.0.0.1")
+
+	// A name with records of another type isn't covered
+	c.Check(addr("txt.internal."), check.Equals, "")
+	c.Check(addr("internal."), check.Equals, "")
+	c.Check(addr("foo.external."), check.Equals, "")
+
+	_, ok := answers.HasName("10.1.1.1", "a.b.c.internal.")
+	c.Check(ok, check.Equals, true)
+
+	bad := Answers{DEFAULT_KEY: ClientAnswers{SuffixDefaults: map[string]RecordA{"internal.": {Answer: []string{"10.0.0.1"}}}}}
+	c.Check(validateAnswers(bad), check.NotNil)
+}
+
+func (t *Tests) TestRegionPrefs(c *check.C) {
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"api.": {
+					Answer:      []string{"10.1.0.5", "10.1.0.6", "10.2.0.5"},
+					RegionPrefs: map[string][]string{"us-east": {"10.1.0.5", "10.1.0.6"}, "eu-west": {"10.2.0.5"}, "lab": {"10.9.9.9"}},
+				},
+			},
+			Regions: map[string][]string{
+				"us-east": {"10.1.0.0/16"},
+				"eu-west": {"10.2.0.0/16"},
+				"lab":     {"10.1.9.0/24"},
+			},
+		},
+	}
+	c.Assert(validateAnswers(answers), check.IsNil)
+	prepareNetworks(answers)
+
+	addrs := func(clientIp string) []string {
+		var out []string
+		records, _ := answers.Matching(dns.TypeA, clientIp, "api.")
+		for _, rr := range records {
+			out = append(out, rr.(*dns.A).A.String())
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	c.Check(addrs("10.1.3.3"), check.DeepEquals, []string{"10.1.0.5", "10.1.0.6"})
+	c.Check(addrs("10.2.3.3"), check.DeepEquals, []string{"10.2.0.5"})
+	c.Check(addrs("10.7.3.3"), check.DeepEquals, []string{"10.1.0.5", "10.1.0.6", "10.2.0.5"})
+
+	// The most specific network wins, and preferring addresses that aren't in the record leaves all of them
+	c.Check(addrs("10.1.9.9"), check.DeepEquals, []string{"10.1.0.5", "10.1.0.6", "10.2.0.5"})
+
+	c.Check(validateRegionPrefs(map[string][]string{"mars": {"10.0.0.1"}}, answers[DEFAULT_KEY].Regions), check.NotNil)
+	c.Check(validateRegions(map[string][]string{"us-east": {"nope"}}), check.NotNil)
+}
+
+func (t *Tests) TestHttpsRecords(c *check.C) {
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"web.": {Answer: []string{"10.0.0.1"}},
+			},
+			Https: map[string][]RecordHttps{
+				"web.":   {{Priority: 1, Target: ".", Alpn: []string{"h2"}, Port: 8443}},
+				"alias.": {{Priority: 0, Target: "web."}},
+			},
+		},
+	}
+	c.Assert(validateAnswers(answers), check.IsNil)
+
+	rdata := func(fqdn string) string {
+		records, ok := answers.Matching(TypeHTTPS, "10.1.1.1", fqdn)
+		c.Assert(ok, check.Equals, true)
+		c.Assert(records, check.HasLen, 1)
+		c.Check(records[0].Header().Rrtype, check.Equals, TypeHTTPS)
+		return records[0].(*dns.RFC3597).Rdata
+	}
+
+	// Priority 1, root target, alpn=h2, port=8443
+	c.Check(rdata("web."), check.Equals, "0001"+"00"+"00010003026832"+"0003000220fb")
+	c.Check(rdata("alias."), check.Equals, "0000"+"03776562"+"00")
+
+	*autoSvcbHints = true
+	defer func() { *autoSvcbHints = false }()
+	c.Check(rdata("web."), check.Equals, "0001"+"00"+"00010003026832"+"0003000220fb"+"000400040a000001")
+
+	// The records survive being sent
+	records, _ := answers.Matching(TypeHTTPS, "10.1.1.1", "web.")
+	m := new(dns.Msg)
+	m.SetQuestion("web.", TypeHTTPS)
+	m.Answer = records
+	packed, err := m.Pack()
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Unpack(packed), check.IsNil)
+	c.Check(m.Answer, check.HasLen, 1)
+
+	c.Check(validateHttps(RecordHttps{Priority: 0, Target: "web.", Port: 443}), check.NotNil)
+	c.Check(validateHttps(RecordHttps{Priority: 1, Target: ".", Ipv4Hint: []string{"::1"}}), check.NotNil)
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"strings"
+	"time"
+
 	"github.com/miekg/dns"
 	"github.com/skynetservices/skydns/cache"
 )
@@ -27,8 +30,66 @@ func addClientCache(clientIp string) {
 	clientSpecificCachesMutex.Unlock()
 }
 
-func globalCacheHit(req *dns.Msg) *dns.Msg {
-	return globalCache.Hit(req.Question[0], false, false, req.MsgHdr.Id)
+// Which clients share recursive responses in the global cache
+const (
+	CACHE_SHARED = "shared"
+	CACHE_VIEW   = "view"
+	CACHE_CLIENT = "client"
+)
+
+// The global cache key for the query. Unless shared, clients only see responses from the recursive servers
+// they use themselves (view), or only their own (client).
+func globalCacheKey(answers Answers, clientIp string, req *dns.Msg) string {
+	key := cache.Key(req.Question[0], false, false)
+	switch *cacheScope {
+	case CACHE_VIEW:
+		return key + "/" + strings.Join(answers.Recursers(clientIp), ",")
+	case CACHE_CLIENT:
+		return key + "/" + clientIp
+	}
+	return key
+}
+
+func globalCacheHit(key string, req *dns.Msg) *dns.Msg {
+	msg, expiration, ok := globalCache.Search(key)
+	if !ok {
+		return nil
+	}
+	if time.Since(expiration) >= 0 {
+		globalCache.Remove(key)
+		return nil
+	}
+
+	msg.Id = req.MsgHdr.Id
+	msg.Compress = true
+	msg.Truncated = false
+	return msg
+}
+
+// Returns the cached message regardless of its expiration, without evicting it
+func globalCacheStaleHit(key string, req *dns.Msg) *dns.Msg {
+	msg, _, ok := globalCache.Search(key)
+	if !ok {
+		return nil
+	}
+
+	msg.Id = req.MsgHdr.Id
+	msg.Compress = true
+	msg.Truncated = false
+	return msg
+}
+
+// Like globalCacheHit, but an expired entry is returned too, and kept, saying it is stale
+func globalCacheHitOrStale(key string, req *dns.Msg) (msg *dns.Msg, stale bool) {
+	msg, expiration, ok := globalCache.Search(key)
+	if !ok {
+		return nil, false
+	}
+
+	msg.Id = req.MsgHdr.Id
+	msg.Compress = true
+	msg.Truncated = false
+	return msg, time.Since(expiration) >= 0
 }
 
 func clientSpecificCacheHit(clientIp string, req *dns.Msg) *dns.Msg {
@@ -37,8 +98,13 @@ func clientSpecificCacheHit(clientIp string, req *dns.Msg) *dns.Msg {
 	return clientCache.Hit(req.Question[0], false, false, req.MsgHdr.Id)
 }
 
-func addToGlobalCache(req, msg *dns.Msg) {
-	key := cache.Key(req.Question[0], false, false)
+func addToGlobalCache(key string, msg *dns.Msg) {
+	globalCache.InsertMessage(key, msg)
+}
+
+// Puts the message in the global cache, in place of what is there already. The cache itself only adds new keys.
+func replaceInGlobalCache(key string, msg *dns.Msg) {
+	globalCache.Remove(key)
 	globalCache.InsertMessage(key, msg)
 }
 
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Responses held back on purpose, for testing how clients cope with a slow DNS server. Only with --chaos-delay.
+type chaosDelay struct {
+	names   string
+	clients []*net.IPNet
+	delay   time.Duration
+}
+
+var chaosDelays []chaosDelay
+
+// Parses "name=slow.example.com,client=10.1.0.0/16,ms=500". Names cover everything under them too, and
+// there must be a name or a client so a typo can't slow down everything.
+func parseChaosDelay(spec string) (chaosDelay, error) {
+	var out chaosDelay
+	var clients []string
+	for _, term := range strings.Split(spec, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		parts := strings.SplitN(term, "=", 2)
+		if len(parts) != 2 {
+			return out, fmt.Errorf("Invalid chaos delay option %q, expected key=value", term)
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "name":
+			out.names = joinNonEmpty(out.names, value)
+		case "client":
+			clients = append(clients, value)
+		case "ms":
+			ms, err := strconv.Atoi(value)
+			if err != nil || ms <= 0 {
+				return out, fmt.Errorf("Invalid chaos delay ms=%s, must be a positive number", value)
+			}
+			out.delay = time.Duration(ms) * time.Millisecond
+		default:
+			return out, fmt.Errorf("Unknown chaos delay option %q", parts[0])
+		}
+	}
+
+	if out.delay == 0 {
+		return out, fmt.Errorf("Chaos delay %q needs ms=", spec)
+	}
+	if out.names == "" && len(clients) == 0 {
+		return out, fmt.Errorf("Chaos delay %q needs a name= or client=", spec)
+	}
+
+	var err error
+	out.clients, err = parseNetworks(strings.Join(clients, ","), "chaos delay client")
+	return out, err
+}
+
+func joinNonEmpty(list, value string) string {
+	if list == "" {
+		return value
+	}
+	return list + "," + value
+}
+
+func parseChaosDelays(specs []string) error {
+	chaosDelays = nil
+	for _, spec := range specs {
+		delay, err := parseChaosDelay(spec)
+		if err != nil {
+			return err
+		}
+		chaosDelays = append(chaosDelays, delay)
+	}
+	return nil
+}
+
+// The delay for the query, the longest of the matching ones
+func chaosDelayFor(clientIp, fqdn string) time.Duration {
+	var longest time.Duration
+	for _, d := range chaosDelays {
+		if d.names != "" && !inZones(fqdn, d.names) {
+			continue
+		}
+		if len(d.clients) > 0 && !inNetworks(d.clients, clientIp) {
+			continue
+		}
+		if d.delay > longest {
+			longest = d.delay
+		}
+	}
+	return longest
+}
+
+// Holds every response back for the delay. If the query is given up on meanwhile, nothing is sent. A query
+// without a deadline is given up on after --recurser-timeout, so a long delay can't hold a handler forever.
+type chaosResponseWriter struct {
+	dns.ResponseWriter
+	ctx   context.Context
+	delay time.Duration
+}
+
+func (w *chaosResponseWriter) WriteMsg(m *dns.Msg) error {
+	ctx := w.ctx
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(*recurserTimeout)*time.Second)
+		defer cancel()
+	}
+
+	timer := time.NewTimer(w.delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return w.ResponseWriter.WriteMsg(m)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
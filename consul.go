@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Serves the services in a Consul catalog the way Consul DNS does: web.service.consul. has the addresses of the
+// passing instances of "web" as A records, and SRV records with their ports pointing at the nodes.
+type consulSource struct {
+	addr   string
+	domain string
+	client *http.Client
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Node    string
+		Address string
+	}
+	Service struct {
+		Service string
+		Address string
+		Port    uint16
+	}
+}
+
+func newConsulSource(addr, domain string) *consulSource {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &consulSource{
+		addr:   strings.TrimRight(addr, "/"),
+		domain: strings.ToLower(dns.Fqdn(domain)),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *consulSource) Name() string {
+	return "consul " + s.addr
+}
+
+func (s *consulSource) Fetch() (ClientAnswers, error) {
+	var services map[string][]string
+	if err := s.get("/v1/catalog/services", &services); err != nil {
+		return ClientAnswers{}, err
+	}
+
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := ClientAnswers{
+		A:   make(map[string]RecordA),
+		Srv: make(map[string][]RecordSrv),
+	}
+	for _, name := range names {
+		fqdn := strings.ToLower(name) + ".service." + s.domain
+		if _, ok := dns.IsDomainName(fqdn); !ok {
+			continue
+		}
+
+		var entries []consulServiceEntry
+		if err := s.get("/v1/health/service/"+pathEscape(name)+"?passing", &entries); err != nil {
+			return ClientAnswers{}, err
+		}
+
+		for _, entry := range entries {
+			s.addInstance(&out, fqdn, entry)
+		}
+	}
+
+	return out, nil
+}
+
+// Escapes the name as one segment of a URL path. The Go the image is built with (1.7) has no url.PathEscape;
+// QueryEscape escapes everything it would and more, only a space has to be %20 rather than "+".
+func pathEscape(name string) string {
+	return strings.Replace(url.QueryEscape(name), "+", "%20", -1)
+}
+
+func (s *consulSource) addInstance(out *ClientAnswers, fqdn string, entry consulServiceEntry) {
+	addr := entry.Service.Address
+	if addr == "" {
+		addr = entry.Node.Address
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() == nil {
+		return
+	}
+	addr = ip.String()
+
+	// The node's name when the service is on the node's address, otherwise a name for the address itself
+	target := strings.ToLower(entry.Node.Node) + ".node." + s.domain
+	if _, ok := dns.IsDomainName(target); !ok || addr != entry.Node.Address {
+		target = hex.EncodeToString(ip.To4()) + ".addr." + s.domain
+	}
+	out.A[target] = RecordA{Answer: []string{addr}}
+
+	rec := out.A[fqdn]
+	if !contains(rec.Answer, addr) {
+		rec.Answer = append(rec.Answer, addr)
+	}
+	out.A[fqdn] = rec
+
+	out.Srv[fqdn] = append(out.Srv[fqdn], RecordSrv{Priority: 1, Weight: 1, Port: entry.Service.Port, Target: target})
+}
+
+func (s *consulSource) get(path string, into interface{}) error {
+	resp, err := s.client.Get(s.addr + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+
+	"gopkg.in/check.v1"
+)
+
+type ConsulTests struct{}
+
+var _ = check.Suite(&ConsulTests{})
+
+func (t *ConsulTests) TestFetch(c *check.C) {
+	var down int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(500)
+			return
+		}
+
+		switch req.URL.Path {
+		case "/v1/catalog/services":
+			json.NewEncoder(w).Encode(map[string][]string{"web": {}, "db": {"primary"}})
+		case "/v1/health/service/web":
+			c.Check(req.URL.RawQuery, check.Equals, "passing")
+			w.Write([]byte(`[
+				{"Node": {"Node": "n1", "Address": "10.0.0.1"}, "Service": {"Service": "web", "Port": 8080}},
+				{"Node": {"Node": "n2", "Address": "10.0.0.2"}, "Service": {"Service": "web", "Address": "10.0.1.2", "Port": 8081}}
+			]`))
+		case "/v1/health/service/db":
+			w.Write([]byte(`[{"Node": {"Node": "n1", "Address": "10.0.0.1"}, "Service": {"Service": "db", "Port": 5432}}]`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	source := newConsulSource(server.URL, "consul")
+	out, err := source.Fetch()
+	c.Assert(err, check.IsNil)
+
+	c.Check(out.A["web.service.consul."].Answer, check.DeepEquals, []string{"10.0.0.1", "10.0.1.2"})
+	c.Check(out.A["db.service.consul."].Answer, check.DeepEquals, []string{"10.0.0.1"})
+	c.Check(out.A["n1.node.consul."].Answer, check.DeepEquals, []string{"10.0.0.1"})
+	c.Check(out.A["0a000102.addr.consul."].Answer, check.DeepEquals, []string{"10.0.1.2"})
+	c.Check(out.Srv["web.service.consul."], check.DeepEquals, []RecordSrv{
+		{Priority: 1, Weight: 1, Port: 8080, Target: "n1.node.consul."},
+		{Priority: 1, Weight: 1, Port: 8081, Target: "0a000102.addr.consul."},
+	})
+
+	// Merged under the static answers, which win
+	answerSources = nil
+	defer func() { answerSources = nil }()
+	addAnswerSource(source)
+	c.Check(refreshSources(), check.Equals, true)
+	c.Check(refreshSources(), check.Equals, false)
+
+	static := Answers{DEFAULT_KEY: ClientAnswers{A: map[string]RecordA{"db.service.consul.": {Answer: []string{"10.9.9.9"}}}}}
+	mergeSources(static)
+	c.Check(static[DEFAULT_KEY].A["db.service.consul."].Answer, check.DeepEquals, []string{"10.9.9.9"})
+	c.Check(static[DEFAULT_KEY].Srv["web.service.consul."], check.HasLen, 2)
+
+	// Consul being down keeps what it returned last
+	atomic.StoreInt32(&down, 1)
+	c.Check(refreshSources(), check.Equals, false)
+	c.Check(answerSources[0].answers().A["web.service.consul."].Answer, check.HasLen, 2)
+}
+
+func (t *ConsulTests) TestPathEscape(c *check.C) {
+	c.Check(pathEscape("web"), check.Equals, "web")
+	c.Check(pathEscape("my web/v2?x"), check.Equals, "my%20web%2Fv2%3Fx")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// With --dns64, IPv6-only clients behind a NAT64 gateway get AAAA records made from the A records of names
+// that have none (RFC 6147), the IPv4 address embedded in --dns64-prefix the way RFC 6052 says
+var dns64Prefix *net.IPNet
+
+func parseDns64Prefix(prefix string) error {
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil || network.IP.To4() != nil {
+		return fmt.Errorf("Invalid --dns64-prefix %q, must be an IPv6 CIDR", prefix)
+	}
+
+	switch ones, _ := network.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return fmt.Errorf("Invalid --dns64-prefix %q, the length must be 32, 40, 48, 56, 64 or 96", prefix)
+	}
+	dns64Prefix = network
+	return nil
+}
+
+// The IPv4 address embedded in the prefix, skipping bits 64 to 71 which must be zero
+func embedIpv4(prefix *net.IPNet, ip net.IP) net.IP {
+	out := make(net.IP, net.IPv6len)
+	copy(out, prefix.IP.To16())
+
+	ones, _ := prefix.Mask.Size()
+	at := ones / 8
+	for _, b := range ip.To4() {
+		if at == 8 {
+			at++
+		}
+		out[at] = b
+		at++
+	}
+	return out
+}
+
+// The records with every A replaced by the AAAA synthesized from it, CNAMEs leading to them kept. Nothing if
+// there are no A records to synthesize from.
+func synthesizeAAAA(records []dns.RR) []dns.RR {
+	var out []dns.RR
+	synthesized := false
+	for _, rr := range records {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			out = append(out, rr)
+			continue
+		}
+
+		hdr := a.Hdr
+		hdr.Rrtype = dns.TypeAAAA
+		out = append(out, &dns.AAAA{Hdr: hdr, AAAA: embedIpv4(dns64Prefix, a.A)})
+		synthesized = true
+	}
+
+	if !synthesized {
+		return nil
+	}
+	return out
+}
+
+// Whether a recursive AAAA response has no AAAA records of its own, so one should be synthesized
+func needsDns64(msg *dns.Msg) bool {
+	if msg.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			return false
+		}
+	}
+	return true
+}
+
+// Asks the recursive servers for the name's A records and synthesizes the AAAA response from them,
+// or leaves the response as it is when there are none
+func recurseDns64(ctx context.Context, req *dns.Msg, msg *dns.Msg, recursers []string) {
+	r := new(dns.Msg)
+	r.SetQuestion(req.Question[0].Name, dns.TypeA)
+	resp, err := ResolveTryAll(ctx, r, recursers)
+	if err != nil || resp == nil || resp.Rcode != dns.RcodeSuccess {
+		return
+	}
+
+	if records := synthesizeAAAA(resp.Answer); records != nil {
+		traceHop(ctx, "AAAA %s synthesized from A", req.Question[0].Name)
+		msg.Answer = records
+		msg.Ns = nil
+	}
+}
+
+// The AAAA answer for a name we have, from the A records (and CNAMEs leading to them) it resolved to.
+// Local A records are synthesized from right away, they never have AAAA records next to them. Recursed ones,
+// for a target outside our zones or with fallbackrecurse or recursewhenup, may: upstream is asked for AAAA
+// first and only when it has none are they synthesized from. Nothing if there is no AAAA to answer with.
+func (answers *Answers) dns64Answer(ctx context.Context, clientIp string, found []dns.RR, recursed bool) []dns.RR {
+	if !recursed {
+		return synthesizeAAAA(found)
+	}
+
+	var chain []dns.RR
+	owner := ""
+	for _, rr := range found {
+		if _, ok := rr.(*dns.A); ok {
+			owner = rr.Header().Name
+			break
+		}
+		chain = append(chain, rr)
+	}
+	if owner == "" {
+		return nil
+	}
+
+	// A flattened ALIAS has the addresses of its target under its own name
+	asked := owner
+	alias, _, isAlias := answers.MatchingAlias(clientIp, owner)
+	if isAlias {
+		asked = dns.Fqdn(alias.Answer)
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion(asked, dns.TypeAAAA)
+	resp, err := ResolveTryAll(ctx, r, answers.Recursers(clientIp))
+	if err != nil || resp == nil {
+		return nil
+	}
+	if needsDns64(resp) {
+		return synthesizeAAAA(found)
+	}
+
+	var real []dns.RR
+	if isAlias {
+		real = flatten(owner, alias.Ttl, resp.Answer)
+	} else {
+		real = resp.Answer
+	}
+	for _, rr := range real {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			return append(chain, real...)
+		}
+	}
+	return nil
+}
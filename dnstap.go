@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// dnstap (http://dnstap.info) is a protobuf message sent over a Frame Streams connection. Both are
+// small enough to encode by hand rather than pull in a protobuf library.
+
+const (
+	dnstapContentType = "protobuf:dnstap.Dnstap"
+	dnstapQueueSize   = 1000
+
+	// Frame Streams control frames
+	fstrmAccept      = 0x01
+	fstrmStart       = 0x02
+	fstrmStop        = 0x03
+	fstrmReady       = 0x04
+	fstrmContentType = 0x01
+
+	// dnstap enum values
+	dnstapTypeMessage    = 1
+	dnstapClientQuery    = 5
+	dnstapClientResponse = 6
+	dnstapFamilyInet     = 1
+	dnstapFamilyInet6    = 2
+	dnstapProtocolUdp    = 1
+	dnstapProtocolTcp    = 2
+)
+
+var (
+	dnstap       *dnstapWriter
+	dnstapFrames = newCounterVec("rancher_dns_dnstap_frames_total", "dnstap frames, by whether they were sent or dropped", "result")
+)
+
+// Sends dnstap frames to a collector, reconnecting when the connection is lost. Frames are queued
+// so a slow collector never holds up a query, and dropped when the queue is full.
+type dnstapWriter struct {
+	network  string
+	addr     string
+	identity []byte
+	version  []byte
+	frames   chan []byte
+	done     chan struct{}
+	stopped  chan struct{}
+	closing  sync.Once
+}
+
+// The target is the path of a Unix socket, or tcp:host:port
+func newDnstapWriter(target string) *dnstapWriter {
+	network, addr := "unix", target
+	if strings.HasPrefix(target, "tcp:") {
+		network, addr = "tcp", strings.TrimPrefix(target, "tcp:")
+	}
+
+	hostname, _ := os.Hostname()
+	t := &dnstapWriter{
+		network:  network,
+		addr:     addr,
+		identity: []byte(hostname),
+		version:  []byte("rancher-dns " + VERSION),
+		frames:   make(chan []byte, dnstapQueueSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *dnstapWriter) run() {
+	defer close(t.stopped)
+
+	for {
+		conn, err := t.connect()
+		if err != nil {
+			log.WithFields(log.Fields{"dnstap": t.addr}).Warnf("Failed to connect to dnstap collector: %v", err)
+			select {
+			case <-t.done:
+				return
+			case <-time.After(time.Second):
+				continue
+			}
+		}
+
+		if err = t.send(conn); err == nil {
+			// Closed, let the collector know this is the end of the stream
+			writeControl(conn, fstrmStop)
+			conn.Close()
+			return
+		}
+
+		conn.Close()
+		log.WithFields(log.Fields{"dnstap": t.addr}).Warnf("Lost dnstap collector: %v", err)
+	}
+}
+
+// Writes frames until the connection fails, or the writer is closed and every queued frame is written
+func (t *dnstapWriter) send(conn net.Conn) error {
+	w := bufio.NewWriter(conn)
+	for {
+		var frame []byte
+		select {
+		case frame = <-t.frames:
+		case <-t.done:
+			select {
+			case frame = <-t.frames:
+			default:
+				return w.Flush()
+			}
+		}
+
+		err := writeFrame(w, frame)
+		if err == nil && len(t.frames) == 0 {
+			err = w.Flush()
+		}
+		if err != nil {
+			dnstapFrames.Inc("dropped")
+			return err
+		}
+		dnstapFrames.Inc("sent")
+	}
+}
+
+// Sends what is still queued and stops, giving up after a second
+func (t *dnstapWriter) Close() {
+	t.closing.Do(func() { close(t.done) })
+	select {
+	case <-t.stopped:
+	case <-time.After(time.Second):
+	}
+}
+
+// Connects and goes through the bidirectional Frame Streams handshake
+func (t *dnstapWriter) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout(t.network, t.addr, time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err = writeControl(conn, fstrmReady); err == nil {
+		var control uint32
+		if control, err = readControl(conn); err == nil && control != fstrmAccept {
+			err = fmt.Errorf("Expected ACCEPT, got control frame %d", control)
+		}
+	}
+	if err == nil {
+		err = writeControl(conn, fstrmStart)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Queues a query or response, without ever blocking
+func (t *dnstapWriter) Log(msgType uint64, w dns.ResponseWriter, msg *dns.Msg, queryTime time.Time) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return
+	}
+
+	frame := t.encode(msgType, w, packed, queryTime, time.Now())
+	select {
+	case t.frames <- frame:
+	default:
+		dnstapFrames.Inc("dropped")
+	}
+}
+
+func (t *dnstapWriter) encode(msgType uint64, w dns.ResponseWriter, packed []byte, queryTime, now time.Time) []byte {
+	var m []byte
+	m = pbVarint(m, 1, msgType)
+
+	clientIp, clientPort := addrParts(w.RemoteAddr())
+	serverIp, serverPort := addrParts(w.LocalAddr())
+	if clientIp.To4() != nil {
+		m = pbVarint(m, 2, dnstapFamilyInet)
+		clientIp, serverIp = clientIp.To4(), serverIp.To4()
+	} else {
+		m = pbVarint(m, 2, dnstapFamilyInet6)
+	}
+	if isTcp(w) {
+		m = pbVarint(m, 3, dnstapProtocolTcp)
+	} else {
+		m = pbVarint(m, 3, dnstapProtocolUdp)
+	}
+	m = pbBytes(m, 4, clientIp)
+	if serverIp != nil {
+		m = pbBytes(m, 5, serverIp)
+	}
+	m = pbVarint(m, 6, uint64(clientPort))
+	m = pbVarint(m, 7, uint64(serverPort))
+	m = pbVarint(m, 8, uint64(queryTime.Unix()))
+	m = pbFixed32(m, 9, uint32(queryTime.Nanosecond()))
+	if msgType == dnstapClientQuery {
+		m = pbBytes(m, 10, packed)
+	} else {
+		m = pbVarint(m, 12, uint64(now.Unix()))
+		m = pbFixed32(m, 13, uint32(now.Nanosecond()))
+		m = pbBytes(m, 14, packed)
+	}
+
+	var d []byte
+	d = pbBytes(d, 1, t.identity)
+	d = pbBytes(d, 2, t.version)
+	d = pbBytes(d, 14, m)
+	d = pbVarint(d, 15, dnstapTypeMessage)
+	return d
+}
+
+func addrParts(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+// Reports every query and its response, including the ones answered with an error
+type dnstapResponseWriter struct {
+	dns.ResponseWriter
+	queryTime time.Time
+}
+
+func (w *dnstapResponseWriter) WriteMsg(m *dns.Msg) error {
+	dnstap.Log(dnstapClientResponse, w.ResponseWriter, m, w.queryTime)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func writeFrame(w io.Writer, frame []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(frame)))
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+func writeControl(w io.Writer, control uint32) error {
+	frame := make([]byte, 12, 12+len(dnstapContentType))
+	binary.BigEndian.PutUint32(frame[0:], control)
+	binary.BigEndian.PutUint32(frame[4:], fstrmContentType)
+	binary.BigEndian.PutUint32(frame[8:], uint32(len(dnstapContentType)))
+	frame = append(frame, dnstapContentType...)
+
+	// A control frame is an empty data frame followed by the control frame's length and content
+	if err := writeFrame(w, nil); err != nil {
+		return err
+	}
+	return writeFrame(w, frame)
+}
+
+// Reads a control frame, returning its type
+func readControl(r io.Reader) (uint32, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	if escape := binary.BigEndian.Uint32(header[0:]); escape != 0 {
+		return 0, fmt.Errorf("Expected a control frame")
+	}
+
+	frame := make([]byte, binary.BigEndian.Uint32(header[4:]))
+	if len(frame) < 4 {
+		return 0, fmt.Errorf("Control frame too short")
+	}
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(frame), nil
+}
+
+// Protobuf encoding, just the wire types dnstap needs
+func pbKey(b []byte, field int, wireType int) []byte {
+	return pbUvarint(b, uint64(field<<3|wireType))
+}
+
+func pbUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func pbVarint(b []byte, field int, v uint64) []byte {
+	return pbUvarint(pbKey(b, field, 0), v)
+}
+
+func pbFixed32(b []byte, field int, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(pbKey(b, field, 5), buf[:]...)
+}
+
+func pbBytes(b []byte, field int, v []byte) []byte {
+	b = pbUvarint(pbKey(b, field, 2), uint64(len(v)))
+	return append(b, v...)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/cache"
+	"gopkg.in/check.v1"
+)
+
+type DnstapTests struct{}
+
+var _ = check.Suite(&DnstapTests{})
+
+func (t *DnstapTests) SetUpTest(c *check.C) {
+	globalCache = cache.New(int(*cacheCapacity), int(*defaultTtl))
+	clientSpecificCaches = make(map[string]*cache.Cache)
+}
+
+func readDataFrame(c *check.C, r io.Reader) []byte {
+	var length [4]byte
+	_, err := io.ReadFull(r, length[:])
+	c.Assert(err, check.IsNil)
+	frame := make([]byte, binary.BigEndian.Uint32(length[:]))
+	_, err = io.ReadFull(r, frame)
+	c.Assert(err, check.IsNil)
+	return frame
+}
+
+func (t *DnstapTests) TestQueryAndResponse(c *check.C) {
+	path := filepath.Join(c.MkDir(), "dnstap.sock")
+	l, err := net.Listen("unix", path)
+	c.Assert(err, check.IsNil)
+	defer l.Close()
+
+	setAnswers(Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{"web.": {Answer: []string{"10.1.2.3"}}},
+		},
+	})
+	writer := newDnstapWriter(path)
+	dnstap = writer
+	defer func() {
+		dnstap = nil
+		writer.Close()
+	}()
+
+	conn, err := l.Accept()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	control, err := readControl(conn)
+	c.Assert(err, check.IsNil)
+	c.Check(control, check.Equals, uint32(fstrmReady))
+	c.Assert(writeControl(conn, fstrmAccept), check.IsNil)
+	control, err = readControl(conn)
+	c.Assert(err, check.IsNil)
+	c.Check(control, check.Equals, uint32(fstrmStart))
+
+	req := new(dns.Msg)
+	req.SetQuestion("web.", dns.TypeA)
+	resp := send("10.1.1.1", req)
+	c.Assert(resp, check.NotNil)
+
+	packedReq, _ := req.Pack()
+	packedResp, _ := resp.Pack()
+	query := readDataFrame(c, conn)
+	c.Check(bytes.Contains(query, packedReq), check.Equals, true)
+	c.Check(bytes.Contains(query, []byte("rancher-dns")), check.Equals, true)
+	response := readDataFrame(c, conn)
+	c.Check(bytes.Contains(response, packedResp), check.Equals, true)
+
+	writer.Close()
+	control, err = readControl(conn)
+	c.Assert(err, check.IsNil)
+	c.Check(control, check.Equals, uint32(fstrmStop))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// Addresses taken out of every local A answer at runtime, without a reload, with what drained them: the address
+// itself (DRAIN_BY_IP) or label selectors. An address stays drained until every one of them is undone.
+var (
+	drained      = map[string]map[string]bool{}
+	drainedMutex sync.RWMutex
+)
+
+const DRAIN_BY_IP = "ip"
+
+// What a drain by label selector is recorded as, the same for selectors with the same terms in any order
+func drainBySelector(selector map[string]string) string {
+	return "selector " + selectorString(selector)
+}
+
+func isDrained(ip string) bool {
+	drainedMutex.RLock()
+	defer drainedMutex.RUnlock()
+	return len(drained[ip]) > 0
+}
+
+func drainedIps() []string {
+	drainedMutex.RLock()
+	defer drainedMutex.RUnlock()
+
+	ips := make([]string, 0, len(drained))
+	for ip := range drained {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// Drains or undrains the address, saving the list to --drain-file if set. Undraining an address undoes every
+// drain of it, including those by selector.
+func setDrained(ip string, drain bool) error {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return fmt.Errorf("Invalid IP address %q", ip)
+	}
+
+	drainedMutex.Lock()
+	if drain {
+		addDrain(addr.String(), DRAIN_BY_IP)
+	} else {
+		delete(drained, addr.String())
+	}
+	drainedMutex.Unlock()
+	return drainedChanged()
+}
+
+// Drains several addresses at once for the origin, changing none of them if one is invalid
+func drainIps(ips []string, origin string) error {
+	parsed := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return fmt.Errorf("Invalid IP address %q", ip)
+		}
+		parsed = append(parsed, addr.String())
+	}
+
+	drainedMutex.Lock()
+	for _, ip := range parsed {
+		addDrain(ip, origin)
+	}
+	drainedMutex.Unlock()
+	return drainedChanged()
+}
+
+// Undoes the drains made for the origin and nothing else, returning the addresses they were of. Those also
+// drained some other way stay drained.
+func undrainOrigin(origin string) ([]string, error) {
+	ips := []string{}
+	drainedMutex.Lock()
+	for ip, origins := range drained {
+		if !origins[origin] {
+			continue
+		}
+		ips = append(ips, ip)
+		delete(origins, origin)
+		if len(origins) == 0 {
+			delete(drained, ip)
+		}
+	}
+	drainedMutex.Unlock()
+
+	sort.Strings(ips)
+	return ips, drainedChanged()
+}
+
+// With drainedMutex held
+func addDrain(ip string, origin string) {
+	if drained[ip] == nil {
+		drained[ip] = map[string]bool{}
+	}
+	drained[ip][origin] = true
+}
+
+func drainedChanged() error {
+	// Cached answers may still have it
+	clearClientSpecificCaches()
+
+	if *drainFile == "" {
+		return nil
+	}
+	return saveDrained(*drainFile)
+}
+
+// Every drained address with what drained it
+func drainedOrigins() map[string][]string {
+	drainedMutex.RLock()
+	defer drainedMutex.RUnlock()
+
+	out := make(map[string][]string, len(drained))
+	for ip, origins := range drained {
+		for origin := range origins {
+			out[ip] = append(out[ip], origin)
+		}
+		sort.Strings(out[ip])
+	}
+	return out
+}
+
+func saveDrained(path string) error {
+	data, err := json.Marshal(drainedOrigins())
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Restores the list saved by a previous run, if there is one
+func loadDrained(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Files saved before drains had origins are a list of addresses, all drained by address
+	origins := map[string][]string{}
+	if err = json.Unmarshal(data, &origins); err != nil {
+		var ips []string
+		if json.Unmarshal(data, &ips) != nil {
+			return err
+		}
+		for _, ip := range ips {
+			origins[ip] = []string{DRAIN_BY_IP}
+		}
+	}
+
+	loaded := map[string]map[string]bool{}
+	for ip, list := range origins {
+		parsed := net.ParseIP(ip)
+		if parsed == nil || len(list) == 0 {
+			continue
+		}
+		loaded[parsed.String()] = map[string]bool{}
+		for _, origin := range list {
+			loaded[parsed.String()][origin] = true
+		}
+	}
+
+	drainedMutex.Lock()
+	drained = loaded
+	drainedMutex.Unlock()
+
+	if len(loaded) > 0 {
+		log.Infof("Restored %d drained IP address(es) from %s", len(loaded), path)
+	}
+	return nil
+}
+
+func httpGetDrained(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, drainedIps())
+}
+
+func httpSetDrained(drain bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ip := mux.Vars(req)["ip"]
+		log.Infof("Setting %s drained to %v", ip, drain)
+		if err := setDrained(ip, drain); err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+		io.WriteString(w, "OK")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// JSON allows an object to have the same key twice, and the last one silently wins. In an answers file that is
+// almost always a copy-paste mistake, so duplicates are warned about, or with --strict refuse to load.
+func checkDuplicateKeys(path string, data []byte) error {
+	dups, err := duplicateKeys(data)
+	if err != nil {
+		// Not JSON, YAML files are left to the YAML parser
+		return nil
+	}
+
+	for _, dup := range dups {
+		if *strict {
+			return fmt.Errorf("%s: duplicate key %s", path, dup)
+		}
+		log.WithFields(log.Fields{"path": path, "key": dup}).Warn("Duplicate key, only the last one is used")
+		validationWarning(path, "Duplicate key %s, only the last one is used", dup)
+	}
+	return nil
+}
+
+// The keys that appear more than once in the same object, as paths like "default > a > web."
+func duplicateKeys(data []byte) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var dups []string
+
+	var walk func(path []string) error
+	walk = func(path []string) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		switch tok {
+		case json.Delim('{'):
+			seen := map[string]bool{}
+			for dec.More() {
+				tok, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key := tok.(string)
+				keyPath := append(path[:len(path):len(path)], key)
+				if seen[key] {
+					dups = append(dups, strings.Join(keyPath, " > "))
+				}
+				seen[key] = true
+				if err := walk(keyPath); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+			return err
+
+		case json.Delim('['):
+			for dec.More() {
+				if err := walk(path); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+			return err
+		}
+		return nil
+	}
+
+	if err := walk(nil); err != nil {
+		return nil, err
+	}
+	return dups, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// Forwarders trusted to say, with EDNS client subnet, which network the client they ask for is in
+var ecsForwarders []*net.IPNet
+
+func parseEcsForwarders(list string) (err error) {
+	ecsForwarders, err = parseNetworks(list, "ECS forwarder")
+	return err
+}
+
+// The client subnet sent with the query, if it comes from a trusted forwarder
+func clientSubnet(clientIp string, req *dns.Msg) *net.IPNet {
+	if len(ecsForwarders) == 0 || !inNetworks(ecsForwarders, clientIp) {
+		return nil
+	}
+	return ecsSubnet(req)
+}
+
+// The client subnet sent with the query, whoever sent it
+func ecsSubnet(req *dns.Msg) *net.IPNet {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, option := range opt.Option {
+		subnet, ok := option.(*dns.EDNS0_SUBNET)
+		if !ok || subnet.Address == nil {
+			continue
+		}
+
+		bits := 32
+		if subnet.Family == 2 {
+			bits = 128
+		}
+		if int(subnet.SourceNetmask) > bits {
+			return nil
+		}
+		mask := net.CIDRMask(int(subnet.SourceNetmask), bits)
+		return &net.IPNet{IP: subnet.Address.Mask(mask), Mask: mask}
+	}
+	return nil
+}
+
+// Orders the A records nearest the subnet first, nearest being the most leading bits in common with it.
+// Records as near as each other, and any other records in the answer, keep their place.
+func orderByProximity(records []dns.RR, subnet *net.IPNet) {
+	var at []int
+	var addrs byProximity
+	for i, rr := range records {
+		if a, ok := rr.(*dns.A); ok {
+			at = append(at, i)
+			addrs = append(addrs, proximity{rr: a, bits: commonBits(a.A, subnet)})
+		}
+	}
+
+	sort.Stable(addrs)
+	for i, index := range at {
+		records[index] = addrs[i].rr
+	}
+}
+
+// Leading bits the address has in common with the subnet, at most its prefix length
+func commonBits(ip net.IP, subnet *net.IPNet) int {
+	ones, _ := subnet.Mask.Size()
+	a, b := ip.To4(), subnet.IP.To4()
+	if a == nil || b == nil {
+		return 0
+	}
+
+	bits := 0
+	for i := 0; i < len(a) && bits < ones; i++ {
+		diff := a[i] ^ b[i]
+		for bit := 7; bit >= 0 && bits < ones; bit-- {
+			if diff&(1<<uint(bit)) != 0 {
+				return bits
+			}
+			bits++
+		}
+	}
+	return bits
+}
+
+type proximity struct {
+	rr   dns.RR
+	bits int
+}
+
+type byProximity []proximity
+
+func (p byProximity) Len() int           { return len(p) }
+func (p byProximity) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byProximity) Less(i, j int) bool { return p[i].bits > p[j].bits }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const healthCheckTimeout = time.Second
+
+var health = newHealthChecker()
+
+// TCP health checks of CNAME target addresses. Checks run in the background so a query never waits
+// for one; until an address has been checked it counts as healthy.
+type healthChecker struct {
+	sync.Mutex
+	results map[string]*healthResult
+}
+
+type healthResult struct {
+	healthy bool
+	checked time.Time
+	pending bool
+}
+
+func newHealthChecker() *healthChecker {
+	return &healthChecker{results: make(map[string]*healthResult)}
+}
+
+// The last known health of the address, starting a new check if that is older than --health-interval
+func (h *healthChecker) Healthy(ip string, port int) bool {
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+
+	h.Lock()
+	defer h.Unlock()
+
+	result, ok := h.results[addr]
+	if !ok {
+		result = &healthResult{healthy: true}
+		h.results[addr] = result
+	}
+	if !result.pending && time.Since(result.checked) > *healthInterval {
+		result.pending = true
+		go h.check(addr)
+	}
+
+	return result.healthy
+}
+
+func (h *healthChecker) check(addr string) {
+	healthy := true
+	conn, err := net.DialTimeout("tcp", addr, healthCheckTimeout)
+	if err != nil {
+		healthy = false
+	} else {
+		conn.Close()
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	result, ok := h.results[addr]
+	if !ok {
+		result = &healthResult{}
+		h.results[addr] = result
+	}
+	if result.healthy != healthy && !result.checked.IsZero() {
+		log.WithFields(log.Fields{"addr": addr, "healthy": healthy}).Info("Health changed")
+	}
+	if result.healthy != healthy {
+		// Local answers cached for clients were picked with the address's old health
+		defer clearClientSpecificCaches()
+	}
+	result.healthy = healthy
+	result.checked = time.Now()
+	result.pending = false
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// HTTPS records (RFC 9460) tell clients how to connect to a service before they do: the ALPN protocols and port
+// it speaks, and the addresses to try. The dns package we use predates them, so they are sent as the generic
+// encoding of RFC 3597.
+const TypeHTTPS uint16 = 65
+
+// SvcParamKeys
+const (
+	svcAlpn     = 1
+	svcPort     = 3
+	svcIpv4Hint = 4
+	svcIpv6Hint = 6
+)
+
+// The HTTPS records for the name, with ipv4hint filled in from the target's A records when it has none and
+// --auto-svcb-hints is on
+func (answers *Answers) httpsRecords(recs []RecordHttps, owner string, answerFqdn string, clientAddr string) []dns.RR {
+	var out []dns.RR
+	for _, rec := range recs {
+		ttl := uint32(*defaultTtl)
+		if rec.Ttl != nil {
+			ttl = *rec.Ttl
+		}
+
+		if *autoSvcbHints && rec.Priority > 0 && len(rec.Ipv4Hint) == 0 {
+			target := dns.Fqdn(rec.Target)
+			if target == "." {
+				target = owner
+			}
+			addrs, _ := answers.Matching(dns.TypeA, clientAddr, target)
+			for _, rr := range addrs {
+				if a, ok := rr.(*dns.A); ok {
+					rec.Ipv4Hint = append(rec.Ipv4Hint, a.A.String())
+				}
+			}
+		}
+
+		rdata, err := rec.pack()
+		if err != nil {
+			continue
+		}
+		hdr := dns.RR_Header{Name: answerFqdn, Rrtype: TypeHTTPS, Class: dns.ClassINET, Ttl: ttl}
+		out = append(out, &dns.RFC3597{Hdr: hdr, Rdata: hex.EncodeToString(rdata)})
+	}
+	return out
+}
+
+// The RDATA: priority, uncompressed target and the SvcParams in increasing key order
+func (rec RecordHttps) pack() ([]byte, error) {
+	target := dns.Fqdn(rec.Target)
+	buf := make([]byte, 2+len(target)+1)
+	binary.BigEndian.PutUint16(buf, rec.Priority)
+	n, err := dns.PackDomainName(target, buf, 2, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	buf = buf[:n]
+
+	param := func(key uint16, value []byte) {
+		var head [4]byte
+		binary.BigEndian.PutUint16(head[:], key)
+		binary.BigEndian.PutUint16(head[2:], uint16(len(value)))
+		buf = append(append(buf, head[:]...), value...)
+	}
+
+	if rec.Priority == 0 {
+		// AliasMode has no parameters
+		return buf, nil
+	}
+
+	if len(rec.Alpn) > 0 {
+		var value []byte
+		for _, id := range rec.Alpn {
+			value = append(append(value, byte(len(id))), id...)
+		}
+		param(svcAlpn, value)
+	}
+	if rec.Port > 0 {
+		var value [2]byte
+		binary.BigEndian.PutUint16(value[:], rec.Port)
+		param(svcPort, value[:])
+	}
+	if len(rec.Ipv4Hint) > 0 {
+		var value []byte
+		for _, addr := range rec.Ipv4Hint {
+			value = append(value, net.ParseIP(addr).To4()...)
+		}
+		param(svcIpv4Hint, value)
+	}
+	if len(rec.Ipv6Hint) > 0 {
+		var value []byte
+		for _, addr := range rec.Ipv6Hint {
+			value = append(value, net.ParseIP(addr).To16()...)
+		}
+		param(svcIpv6Hint, value)
+	}
+	return buf, nil
+}
+
+func validateHttps(rec RecordHttps) error {
+	if _, ok := dns.IsDomainName(dns.Fqdn(rec.Target)); !ok {
+		return fmt.Errorf("Invalid target %q", rec.Target)
+	}
+	for _, id := range rec.Alpn {
+		if id == "" || len(id) > 255 {
+			return fmt.Errorf("Invalid ALPN protocol %q", id)
+		}
+	}
+	for _, addr := range rec.Ipv4Hint {
+		if ip := net.ParseIP(addr); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("Invalid ipv4hint %q", addr)
+		}
+	}
+	for _, addr := range rec.Ipv6Hint {
+		if ip := net.ParseIP(addr); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("Invalid ipv6hint %q", addr)
+		}
+	}
+	if rec.Priority == 0 && (len(rec.Alpn) > 0 || rec.Port > 0 || len(rec.Ipv4Hint) > 0 || len(rec.Ipv6Hint) > 0) {
+		return fmt.Errorf("Priority 0 (AliasMode) records can't have parameters")
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// A second resolver in the same process, for trying out an answers file on real clients pointed at another
+// port. It has its own listen addresses, answers and cached answers and is reloaded on its own. Everything
+// else, flags, health checks, drained addresses and metrics, is shared with the main one.
+type instance struct {
+	name        string
+	listen      string
+	answersFile string
+
+	mutex      sync.RWMutex
+	answers    Answers
+	listeners  *listenerSet
+	validation *validation
+}
+
+var instances []*instance
+
+// A flag that can be given more than once, collecting every value
+type repeated []string
+
+func (r *repeated) String() string {
+	return strings.Join(*r, " ")
+}
+
+func (r *repeated) Set(value string) error {
+	*r = append(*r, value)
+	return nil
+}
+
+func repeatedFlag(name, usage string) *repeated {
+	r := &repeated{}
+	flag.Var(r, name, usage)
+	return r
+}
+
+// Parses "listen=:5354,answers=green.json", optionally with name=green. The name defaults to the listen address.
+func parseInstance(spec string) (*instance, error) {
+	inst := &instance{validation: newValidation()}
+	for _, term := range splitTrim(spec, ",") {
+		if term == "" {
+			continue
+		}
+		parts := strings.SplitN(term, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid instance option %q, expected key=value", term)
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "name":
+			inst.name = value
+		case "listen":
+			inst.listen = value
+		case "answers":
+			inst.answersFile = value
+		default:
+			return nil, fmt.Errorf("Unknown instance option %q", parts[0])
+		}
+	}
+
+	if inst.listen == "" || inst.answersFile == "" {
+		return nil, fmt.Errorf("Instance %q needs both listen= and answers=", spec)
+	}
+	if inst.name == "" {
+		inst.name = inst.listen
+	}
+	return inst, nil
+}
+
+func parseInstances(specs []string) error {
+	seen := map[string]bool{}
+	for _, spec := range specs {
+		inst, err := parseInstance(spec)
+		if err != nil {
+			return err
+		}
+		if seen[inst.name] {
+			return fmt.Errorf("More than one instance named %s", inst.name)
+		}
+		seen[inst.name] = true
+		instances = append(instances, inst)
+	}
+	return nil
+}
+
+func findInstance(name string) *instance {
+	for _, inst := range instances {
+		if inst.name == name {
+			return inst
+		}
+	}
+	return nil
+}
+
+func (i *instance) getAnswers() Answers {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.answers
+}
+
+// Loads the answers like the main ones are, with a validation report of their own
+func (i *instance) load() error {
+	startValidation(i.validation)
+	temp, err := parseLoadedAnswers(i.answersFile)
+	if err == nil {
+		clearClientSpecificCaches()
+		i.mutex.Lock()
+		prepareLoaded(i.name, i.answers, temp)
+		i.answers = temp
+		i.mutex.Unlock()
+		resolveRecurserNames(withInstanceAnswers(getAnswers()))
+		log.WithFields(log.Fields{"instance": i.name}).Info("Loaded answers")
+	} else {
+		log.WithFields(log.Fields{"instance": i.name}).Errorf("Failed to load answers: %v", err)
+	}
+	finishValidation(i.validation, i.answersFile, err, i.getAnswers())
+	return err
+}
+
+func (i *instance) route(w dns.ResponseWriter, req *dns.Msg) {
+	serve(w, req, i.name, i.getAnswers())
+}
+
+// Loads every instance's answers and starts listening for it
+func startInstances() error {
+	for _, inst := range instances {
+		if err := inst.load(); err != nil {
+			return err
+		}
+
+		addrs, err := resolveListen(inst.listen)
+		if err != nil {
+			return err
+		}
+		inst.listeners = newListenerSet(*listenerGrace, dns.HandlerFunc(inst.route))
+		if err := inst.listeners.Apply(addrs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reloads every instance, one failing to load keeps its previous answers without affecting the others
+func reloadInstances() {
+	for _, inst := range instances {
+		inst.load()
+	}
+}
+
+func stopInstances() {
+	for _, inst := range instances {
+		if inst.listeners != nil {
+			inst.listeners.Stop()
+		}
+	}
+}
+
+// The main answers with every instance's clients added under "<instance>/<client>", for whatever needs to see
+// the recursive servers of all of them
+func withInstanceAnswers(main Answers) Answers {
+	if len(instances) == 0 {
+		return main
+	}
+
+	out := make(Answers, len(main))
+	for key, client := range main {
+		out[key] = client
+	}
+	for _, inst := range instances {
+		for key, client := range inst.getAnswers() {
+			out[inst.name+"/"+key] = client
+		}
+	}
+	return out
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Records can carry labels for operating on them as a group. They never change what is answered.
+
+type labeledRecord struct {
+	Client string            `json:"client"`
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+	Answer []string          `json:"answer"`
+}
+
+// Parses a selector like "env=prod,dc=us-east", which matches records having all of those labels
+func parseSelector(s string) (map[string]string, error) {
+	selector := map[string]string{}
+	for _, term := range splitTrim(s, ",") {
+		if term == "" {
+			continue
+		}
+		parts := strings.SplitN(term, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Invalid label selector term %q, expected key=value", term)
+		}
+		selector[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	if len(selector) == 0 {
+		return nil, fmt.Errorf("Empty label selector")
+	}
+	return selector, nil
+}
+
+// The selector's terms sorted, so selectors with the same terms in any order are the same string
+func selectorString(selector map[string]string) string {
+	terms := make([]string, 0, len(selector))
+	for key, value := range selector {
+		terms = append(terms, key+"="+value)
+	}
+	sort.Strings(terms)
+	return strings.Join(terms, ",")
+}
+
+func labelsMatch(labels, selector map[string]string) bool {
+	for key, value := range selector {
+		if have, ok := labels[key]; !ok || have != value {
+			return false
+		}
+	}
+	return true
+}
+
+// The A and CNAME records whose labels match the selector, in every section
+func (answers *Answers) Labeled(selector map[string]string) []labeledRecord {
+	out := []labeledRecord{}
+	for key, client := range *answers {
+		for name, rec := range client.A {
+			if len(rec.Labels) > 0 && labelsMatch(rec.Labels, selector) {
+				out = append(out, labeledRecord{Client: key, Name: name, Type: "A", Labels: rec.Labels, Answer: rec.Answer})
+			}
+		}
+		for name, rec := range client.Cname {
+			if len(rec.Labels) > 0 && labelsMatch(rec.Labels, selector) {
+				out = append(out, labeledRecord{Client: key, Name: name, Type: "CNAME", Labels: rec.Labels, Answer: []string{rec.Answer}})
+			}
+		}
+	}
+
+	sort.Sort(byLabeledRecord(out))
+	return out
+}
+
+// The distinct addresses of the matching A records, canaries included
+func (answers *Answers) LabeledAddresses(selector map[string]string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, client := range *answers {
+		for _, rec := range client.A {
+			if len(rec.Labels) == 0 || !labelsMatch(rec.Labels, selector) {
+				continue
+			}
+			addrs := rec.Answer
+			if rec.Canary != "" {
+				addrs = append(addrs[:len(addrs):len(addrs)], rec.Canary)
+			}
+			for _, addr := range addrs {
+				if !seen[addr] {
+					seen[addr] = true
+					out = append(out, addr)
+				}
+			}
+		}
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+type byLabeledRecord []labeledRecord
+
+func (r byLabeledRecord) Len() int      { return len(r) }
+func (r byLabeledRecord) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byLabeledRecord) Less(i, j int) bool {
+	if r[i].Client != r[j].Client {
+		return r[i].Client < r[j].Client
+	}
+	if r[i].Name != r[j].Name {
+		return r[i].Name < r[j].Name
+	}
+	return r[i].Type < r[j].Type
+}
+
+func httpLabeled(w http.ResponseWriter, req *http.Request) {
+	selector, err := parseSelector(req.URL.Query().Get("selector"))
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	answers := getAnswers()
+	writeJson(w, answers.Labeled(selector))
+}
+
+// Drains the addresses of every A record matching ?selector=, as they are right now. Undraining undoes only
+// what draining by the same selector did, whatever the records have now and however else they were drained.
+func httpSetDrainedLabel(drain bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		selector, err := parseSelector(req.URL.Query().Get("selector"))
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		origin := drainBySelector(selector)
+		var ips []string
+		if drain {
+			answers := getAnswers()
+			ips = answers.LabeledAddresses(selector)
+			err = drainIps(ips, origin)
+		} else {
+			ips, err = undrainOrigin(origin)
+		}
+		log.WithFields(log.Fields{"selector": req.URL.Query().Get("selector"), "addrs": ips}).Infof("Setting drained to %v", drain)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+		writeJson(w, ips)
+	}
+}
+
+// A records with labels matching one of these selectors are failed over: answered by the recursive servers instead
+// of with their own addresses, as if none of those were healthy and the records had fallbackrecurse. They stay
+// failed over across reloads until undone, but not across restarts.
+var (
+	failovers      = map[string]map[string]string{}
+	failoversMutex sync.RWMutex
+)
+
+func setFailover(selector map[string]string, enabled bool) {
+	failoversMutex.Lock()
+	if enabled {
+		failovers[selectorString(selector)] = selector
+	} else {
+		delete(failovers, selectorString(selector))
+	}
+	failoversMutex.Unlock()
+
+	// Cached answers may still have the local addresses, or not
+	clearClientSpecificCaches()
+}
+
+func failoverSelectors() []string {
+	failoversMutex.RLock()
+	defer failoversMutex.RUnlock()
+
+	out := make([]string, 0, len(failovers))
+	for selector := range failovers {
+		out = append(out, selector)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Whether a record with these labels is failed over by some selector
+func labelsFailedOver(labels map[string]string) bool {
+	if len(labels) == 0 {
+		return false
+	}
+
+	failoversMutex.RLock()
+	defer failoversMutex.RUnlock()
+	for _, selector := range failovers {
+		if labelsMatch(labels, selector) {
+			return true
+		}
+	}
+	return false
+}
+
+func httpGetFailovers(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, failoverSelectors())
+}
+
+// Fails over the A records matching ?selector=, including those a later reload adds. Undoing it takes the same
+// selector, its terms in any order.
+func httpSetFailoverLabel(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		selector, err := parseSelector(req.URL.Query().Get("selector"))
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		log.WithFields(log.Fields{"selector": selectorString(selector)}).Infof("Setting failed over to %v", enabled)
+		setFailover(selector, enabled)
+		answers := getAnswers()
+		writeJson(w, answers.Labeled(selector))
+	}
+}
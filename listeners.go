@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// The UDP and TCP servers for the addresses we listen on. When the addresses change, listeners for
+// new addresses are started before the ones for old addresses are stopped, after a grace period.
+type listenerSet struct {
+	sync.Mutex
+	grace    time.Duration
+	handler  dns.Handler
+	servers  map[string][]*dns.Server
+	stopping map[string]*stoppingListener
+}
+
+// The servers of an address no longer listened on, until the grace period is over
+type stoppingListener struct {
+	servers []*dns.Server
+	timer   *time.Timer
+}
+
+func newListenerSet(grace time.Duration, handler dns.Handler) *listenerSet {
+	return &listenerSet{
+		grace:    grace,
+		handler:  handler,
+		servers:  make(map[string][]*dns.Server),
+		stopping: make(map[string]*stoppingListener),
+	}
+}
+
+// Listen on exactly these addresses. An address that fails to start doesn't keep the others from being
+// applied, the first such error is returned.
+func (l *listenerSet) Apply(addrs []string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	var firstErr error
+	wanted := make(map[string]bool)
+	for _, addr := range addrs {
+		wanted[addr] = true
+		if _, ok := l.servers[addr]; ok {
+			continue
+		}
+
+		// Wanted again before its grace period was over, its servers are still listening
+		if stopping, ok := l.stopping[addr]; ok {
+			stopping.timer.Stop()
+			delete(l.stopping, addr)
+			l.servers[addr] = stopping.servers
+			log.Info("Listening on ", addr, " again")
+			continue
+		}
+
+		servers, err := l.start(addr)
+		if err != nil {
+			log.Errorf("Failed to listen on %s: %v", addr, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		log.Info("Listening on ", addr)
+		l.servers[addr] = servers
+	}
+
+	for addr, servers := range l.servers {
+		if wanted[addr] {
+			continue
+		}
+
+		delete(l.servers, addr)
+		log.Infof("No longer listening on %s, stopping in %v", addr, l.grace)
+		stopping := &stoppingListener{servers: servers}
+		l.stopping[addr] = stopping
+		addr := addr
+		stopping.timer = time.AfterFunc(l.grace, func() {
+			l.Lock()
+			if l.stopping[addr] != stopping {
+				// Brought back meanwhile
+				l.Unlock()
+				return
+			}
+			delete(l.stopping, addr)
+			l.Unlock()
+
+			shutdownAll(stopping.servers)
+			log.Info("Stopped listening on ", addr)
+		})
+	}
+
+	return firstErr
+}
+
+// Stop every listener now, waiting for the queries they are handling
+func (l *listenerSet) Stop() {
+	l.Lock()
+	defer l.Unlock()
+
+	for addr, servers := range l.servers {
+		shutdownAll(servers)
+		delete(l.servers, addr)
+	}
+	for addr, stopping := range l.stopping {
+		stopping.timer.Stop()
+		shutdownAll(stopping.servers)
+		delete(l.stopping, addr)
+	}
+}
+
+func shutdownAll(servers []*dns.Server) {
+	for _, server := range servers {
+		if err := server.Shutdown(); err != nil {
+			log.Warnf("Failed to stop listener: %v", err)
+		}
+	}
+}
+
+func (l *listenerSet) start(addr string) ([]*dns.Server, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	var started sync.WaitGroup
+	started.Add(2)
+	// Unsafe hands responses (QR bit set) to the handler too, so it can count them when it drops them
+	servers := []*dns.Server{
+		{PacketConn: pc, Handler: l.handler, NotifyStartedFunc: started.Done, Unsafe: true},
+		{Listener: ln, Handler: l.handler, NotifyStartedFunc: started.Done, Unsafe: true},
+	}
+
+	for _, server := range servers {
+		go func(server *dns.Server) {
+			if err := server.ActivateAndServe(); err != nil {
+				log.Errorf("Listener on %s failed: %v", addr, err)
+			}
+		}(server)
+	}
+
+	started.Wait()
+	return servers, nil
+}
+
+// Expands the comma-delimited listen addresses. The host part may be an interface name
+// instead of an IP address, which means every address that interface currently has.
+func resolveListen(spec string) ([]string, error) {
+	var addrs []string
+	for _, entry := range splitTrim(spec, ",") {
+		if entry == "" {
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		if host == "" || net.ParseIP(host) != nil || strings.Contains(host, ".") {
+			addrs = append(addrs, entry)
+			continue
+		}
+
+		iface, err := net.InterfaceByName(host)
+		if err != nil {
+			// Not an interface, leave it for the resolver
+			addrs = append(addrs, entry)
+			continue
+		}
+
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, a := range ifaceAddrs {
+			if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+				addrs = append(addrs, net.JoinHostPort(ipNet.IP.String(), port))
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Interface %s has no addresses", host)
+		}
+	}
+
+	return addrs, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/check.v1"
+)
+
+type ListenerTests struct{}
+
+var _ = check.Suite(&ListenerTests{})
+
+func freeAddr(c *check.C) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer pc.Close()
+	return pc.LocalAddr().String()
+}
+
+func answersOn(addr string) bool {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	client := &dns.Client{DialTimeout: 100 * time.Millisecond, ReadTimeout: 100 * time.Millisecond}
+	_, _, err := client.Exchange(req, addr)
+	return err == nil
+}
+
+func (t *ListenerTests) TestAddressChange(c *check.C) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+
+	set := newListenerSet(300*time.Millisecond, handler)
+	first := freeAddr(c)
+	c.Assert(set.Apply([]string{first}), check.IsNil)
+	c.Check(answersOn(first), check.Equals, true)
+
+	// Reload with a different address, both answer during the grace period
+	second := freeAddr(c)
+	c.Assert(set.Apply([]string{second}), check.IsNil)
+	c.Check(answersOn(second), check.Equals, true)
+	c.Check(answersOn(first), check.Equals, true)
+
+	time.Sleep(500 * time.Millisecond)
+	c.Check(answersOn(second), check.Equals, true)
+	c.Check(answersOn(first), check.Equals, false)
+
+	c.Assert(set.Apply(nil), check.IsNil)
+}
+
+func (t *ListenerTests) TestAddressBackWithinGrace(c *check.C) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+
+	set := newListenerSet(300*time.Millisecond, handler)
+	defer set.Stop()
+	first, second := freeAddr(c), freeAddr(c)
+	c.Assert(set.Apply([]string{first}), check.IsNil)
+
+	// Removed and back before its servers stopped, they keep listening
+	c.Assert(set.Apply([]string{second}), check.IsNil)
+	c.Assert(set.Apply([]string{first, second}), check.IsNil)
+	time.Sleep(500 * time.Millisecond)
+	c.Check(answersOn(first), check.Equals, true)
+	c.Check(answersOn(second), check.Equals, true)
+
+	// An address that can't be listened on doesn't stop the rest from being applied
+	c.Check(set.Apply([]string{"192.0.2.1:53", second}), check.NotNil)
+	time.Sleep(500 * time.Millisecond)
+	c.Check(answersOn(second), check.Equals, true)
+	c.Check(answersOn(first), check.Equals, false)
+}
+
+func (t *ListenerTests) TestResolveListen(c *check.C) {
+	addrs, err := resolveListen(":53, 127.0.0.1:5353")
+	c.Assert(err, check.IsNil)
+	c.Check(addrs, check.DeepEquals, []string{":53", "127.0.0.1:5353"})
+
+	addrs, err = resolveListen("lo:53")
+	c.Assert(err, check.IsNil)
+	c.Assert(len(addrs) > 0, check.Equals, true)
+	c.Check(addrs[0], check.Equals, "127.0.0.1:53")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -9,12 +10,14 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
 	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -27,9 +30,12 @@ import (
 var (
 	showVersion     = flag.Bool("version", false, "Show version")
 	debug           = flag.Bool("debug", false, "Debug")
-	listen          = flag.String("listen", ":53", "Address to listen to (TCP and UDP)")
+	listen          = flag.String("listen", ":53", "Address(es) to listen to (TCP and UDP), comma-delimited. The host may be an interface name")
+	listenerGrace   = flag.Duration("listener-grace", 5*time.Second, "How long listeners for addresses that went away keep serving after a reload")
 	listenReload    = flag.String("listenReload", "127.0.0.1:8113", "Address to listen to for reload requests (TCP)")
 	answersFile     = flag.String("answers", "./answers.yaml", "File containing the answers to respond with")
+	templateAnswers = flag.Bool("template", false, "Render the answers file as a Go text/template before parsing it")
+	answersDir      = flag.String("answers-dir", "", "Directory of per-zone files merged into the default answers")
 	defaultTtl      = flag.Uint("ttl", 600, "TTL for answers")
 	recurserTimeout = flag.Uint("recurser-timeout", 2, "timeout (in seconds) for recurser")
 	ndots           = flag.Uint("ndots", 0, "Queries with more than this number of dots will not use search paths")
@@ -39,30 +45,149 @@ var (
 	metadataServer  = flag.String("metadata-server", "", "Metadata server url")
 	metadataAnswer  = flag.String("rancher-metadata-answer", "169.254.169.250", "Metadata IP address(es), comma-delimited (adds static A records)")
 	neverRecurseTo  = flag.String("never-recurse-to", "169.254.169.250", "Never recurse to IP address(es), comma-delimited")
+	recurseSource   = flag.String("recurse-source", "", "Local IP address to send recursive queries from")
+	sessionOption   = flag.Uint("session-option", 0, "EDNS option code clients can send a session token in to always get the same address (0 to disable)")
+	sessionAllow    = flag.String("session-clients", "", "Client IP address(es) or CIDR(s) allowed to send a session token, comma-delimited")
+	aaRecurseZones  = flag.String("authoritative-recurse", "", "Zone(s) to mark recursive answers as authoritative for, comma-delimited")
+	reverseZones    = flag.String("local-reverse-zones", strings.Join(privateReverseZones(), ","), "Reverse zones answered only from local PTR records and never recursed, comma-delimited")
+	offline         = flag.Bool("offline", false, "Answer only from local answers and the cache (including expired entries), never recurse")
+	noRecurse       = flag.Bool("no-recurse", false, "Answer only from local answers and never recurse, not even for clients that set RD")
+	noRecurseReply  = flag.String("no-recurse-response", NO_RECURSE_REFUSED, "Response for names without local answers with --no-recurse: refused, nxdomain or nodata")
+	healthInterval  = flag.Duration("health-interval", 10*time.Second, "How often addresses with a health port (of A records and weighted CNAME targets) are health checked")
+	maxResponse     = flag.Uint("max-response-bytes", 0, "Largest UDP response to send whatever the client's EDNS buffer size, larger ones are truncated (0 for no limit)")
+	recurseRefresh  = flag.Duration("recurse-refresh", 5*time.Minute, "How often recursive servers given by hostname are looked up again (0 for only on reload)")
+	dnstapSocket    = flag.String("dnstap-socket", "", "Send every query and response as dnstap to this Unix socket, or tcp:host:port")
+	drainFile       = flag.String("drain-file", "", "File to keep the drained IP addresses in across restarts")
+	nameservers     = flag.String("nameservers", "", "Names of the servers for the authoritative zones, comma-delimited (default: the zone's own name)")
+	authorityNs     = flag.Bool("include-authority-ns", false, "Add the zone's NS records to the authority section of local answers in authoritative zones")
+	profiling       = flag.Bool("pprof", false, "Serve Go profiling data under /debug/pprof/ on the reload listener")
+	cacheScope      = flag.String("cache-scope", CACHE_SHARED, "Which clients share cached recursive responses: shared, view (clients recursing to the same servers) or client")
+	refuseTypes     = flag.String("refuse-types", "", "Query types to answer with REFUSED without any lookup, comma-delimited (e.g. AXFR,IXFR)")
+	stableOrder     = flag.Bool("stable-order", false, "Answer A addresses in the order they are configured instead of shuffling them, keeping the order of those still there after a reload and adding new ones at the end")
+	statusName      = flag.String("status-name", "", "Name answering TXT queries with a status summary, e.g. _rancher-dns-status. (default: disabled)")
+	whoamiName      = flag.String("whoami-name", "", "Name answering A, AAAA and TXT queries with the client's own address, e.g. whoami.rancher.internal. (default: disabled)")
+	whoamiSource    = flag.String("whoami-source", WHOAMI_TRANSPORT, "Address --whoami-name answers with: transport (where the query came from) or ecs (the EDNS client subnet it carries, if any)")
+	statusAllow     = flag.String("status-clients", "127.0.0.1,::1", "Client IP address(es) or CIDR(s) allowed to query --status-name, comma-delimited")
+	excludeSelf     = flag.Bool("exclude-self", false, "Leave the client's own address out of every A answer, as if each record had excludeself set")
+	precedence      = flag.String("precedence", PRECEDENCE_CNAME, "Which wins for A queries when a name has both a CNAME and an A record: cname or a-over-cname")
+	recurseUdpSize  = flag.Uint("recurse-udp-size", 1232, "EDNS UDP buffer size advertised to recursive servers (0 to not send EDNS)")
+	consulAddr      = flag.String("consul", "", "Address of a Consul agent (host:port) whose catalog is served under --consul-domain (default: disabled)")
+	consulDomain    = flag.String("consul-domain", "consul.", "Domain Consul services are served under, e.g. web.service.consul.")
+	consulInterval  = flag.Duration("consul-interval", 30*time.Second, "How often the Consul catalog is fetched again")
+	refuseNoRec     = flag.Bool("refuse-norec", false, "Refuse queries without the RD bit for names outside the authoritative zones instead of recursing for them")
+	shadowFile      = flag.String("shadow-answers", "", "Answers file every query is also answered from, logging the differences without ever serving them")
+	ecsAllow        = flag.String("ecs-forwarders", "", "Forwarder IP address(es) or CIDR(s) whose EDNS client subnet orders local answers nearest first, comma-delimited")
+	instanceSpecs   = repeatedFlag("instance", "Another resolver in this process with its own answers, e.g. listen=:5354,answers=green.json (repeatable)")
+	traceResolution = flag.Bool("trace-resolution", false, "Log every step taken to answer each query: CNAMEs followed, local or recursed, which recursive server answered")
+	traceNames      = flag.String("trace-names", "", "Only trace queries for these names and the names under them, comma-delimited")
+	strict          = flag.Bool("strict", false, "Refuse to load answers with duplicate JSON keys or undefined $use references, instead of warning")
+	chaosSpecs      = repeatedFlag("chaos-delay", "For testing only: hold back responses, e.g. name=slow.example.com,client=10.1.0.0/16,ms=500 (repeatable)")
+	autoSvcbHints   = flag.Bool("auto-svcb-hints", false, "Fill in the ipv4hint of HTTPS records that have none from their target's A records")
+	queryTimeout    = flag.Duration("query-timeout", 0, "How long a query gets to be answered, including recursion, before SERVFAIL; clients' \"timeout\" overrides it (0 for no limit)")
+	staleWorkers    = flag.Int("stale-refresh-workers", 0, "Serve expired cached recursive responses right away, refreshing them in the background with this many workers (0 to only serve them when offline)")
+	viewsFrom       = flag.String("views", "", "File or http(s) URL with a JSON object of client IPs or CIDRs to the answers section (view) they are answered from")
+	viewsInterval   = flag.Duration("views-interval", time.Minute, "How often --views is fetched again (0 for only at startup)")
+	dns64           = flag.Bool("dns64", false, "Answer AAAA queries for names without AAAA records with addresses made from their A records, for IPv6-only clients behind NAT64")
+	dns64PrefixFlag = flag.String("dns64-prefix", "64:ff9b::/96", "NAT64 prefix the IPv4 addresses are embedded in with --dns64")
+	slowQuery       = flag.Duration("slow-query-threshold", 0, "Log every query that takes longer than this to answer, including recursion (0 to disable)")
 
 	answers                   Answers
+	answersMutex              sync.RWMutex
+	answersLoaded             time.Time
 	globalCache               *cache.Cache
 	clientSpecificCaches      map[string]*cache.Cache
 	clientSpecificCachesMutex sync.RWMutex
 	VERSION                   string
 	reloadChan                = make(chan chan error)
-	serial                    = uint32(1)
 	configGenerator           *ConfigGenerator
+	offlineMode               int32
+	listeners                 *listenerSet
+
+	// Cancelled on shutdown, which aborts any in-flight recursive queries
+	rootCtx, shutdown = context.WithCancel(context.Background())
+
+	// Parsed from --refuse-types
+	refusedTypes = map[uint16]bool{}
+)
+
+// Responses to names without local answers when recursion is disabled
+const (
+	NO_RECURSE_REFUSED  = "refused"
+	NO_RECURSE_NXDOMAIN = "nxdomain"
+	NO_RECURSE_NODATA   = "nodata"
 )
 
 func metadataDriven() bool {
 	return *metadataServer != ""
 }
 
+func getAnswers() Answers {
+	answersMutex.RLock()
+	defer answersMutex.RUnlock()
+	return answers
+}
+
+// Works out what answering needs from the answers once per load, rather than on every query
+func prepareAnswers(answers Answers) {
+	prepareNetworks(answers)
+	indexNames(answers)
+}
+
+// What every load does to the answers before they are served in place of prev, for the main answers or an instance
+func prepareLoaded(instance string, prev Answers, next Answers) {
+	if *stableOrder {
+		keepAnswerOrder(prev, next)
+	}
+	prepareAnswers(next)
+	updateInstanceSerials(instance, next)
+}
+
+func setAnswers(newAnswers Answers) {
+	prepareLoaded("", getAnswers(), newAnswers)
+	resolveRecurserNames(withInstanceAnswers(newAnswers))
+	answersMutex.Lock()
+	answers = newAnswers
+	answersLoaded = time.Now()
+	answersMutex.Unlock()
+}
+
+func answersLoadedAt() time.Time {
+	answersMutex.RLock()
+	defer answersMutex.RUnlock()
+	return answersLoaded
+}
+
+func isOffline() bool {
+	return atomic.LoadInt32(&offlineMode) == 1
+}
+
+func setOffline(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&offlineMode, v)
+}
+
 func main() {
-	parseFlags()
+	args := os.Args[1:]
+	selftestMode := len(args) > 0 && args[0] == "selftest"
+	if selftestMode {
+		args = args[1:]
+	}
+	parseFlags(args)
 
 	log.Infof("Starting rancher-dns %s", VERSION)
+	refreshSources()
 	err := loadAnswers()
 	if err != nil {
 		log.Fatal("Cannot startup without a valid Answers file")
 	}
 
+	if selftestMode {
+		os.Exit(selftest())
+	}
+
 	if *showVersion {
 		fmt.Printf("%s\n", VERSION)
 		os.Exit(0)
@@ -76,35 +201,157 @@ func main() {
 		}
 	}
 
+	listeners = newListenerSet(*listenerGrace, dns.DefaultServeMux)
+
+	watchShutdown()
 	watchSignals()
 	watchHttp()
+	watchRecursers()
+	watchSources(*consulInterval)
+	watchViews(*viewsFrom, *viewsInterval)
 
 	seed := time.Now().UTC().UnixNano()
 	log.Debug("Set random seed to ", seed)
 	rand.Seed(seed)
 
-	udpServer := &dns.Server{Addr: *listen, Net: "udp"}
-	tcpServer := &dns.Server{Addr: *listen, Net: "tcp"}
-
 	globalCache = cache.New(int(*cacheCapacity), int(*defaultTtl))
 	clientSpecificCaches = make(map[string]*cache.Cache)
+	if *staleWorkers > 0 {
+		staleRefresh = newRefreshPool(*staleWorkers)
+	}
+	if *shadowFile != "" {
+		startShadowWorkers()
+	}
+
+	if *dnstapSocket != "" {
+		dnstap = newDnstapWriter(*dnstapSocket)
+	}
 
 	dns.HandleFunc(".", route)
 
-	go func() {
-		log.Fatal(udpServer.ListenAndServe())
-	}()
-	log.Info("Listening on ", *listen)
-	log.Fatal(tcpServer.ListenAndServe())
+	if err := reloadListeners(); err != nil {
+		log.Fatalf("Cannot startup: failed to listen: %v", err)
+	}
+	if err := startInstances(); err != nil {
+		log.Fatalf("Cannot startup instances: %v", err)
+	}
+
+	select {}
+}
+
+func reloadListeners() error {
+	addrs, err := resolveListen(*listen)
+	if err != nil {
+		return err
+	}
+	return listeners.Apply(addrs)
 }
 
-func parseFlags() {
-	flag.Parse()
+func parseFlags(args []string) {
+	flag.CommandLine.Parse(args)
 
 	if *debug {
 		log.SetLevel(log.DebugLevel)
 	}
 
+	setOffline(*offline)
+
+	if *maxResponse != 0 && (*maxResponse < 512 || *maxResponse >= dns.MaxMsgSize) {
+		log.Fatalf("Invalid --max-response-bytes %d, must be between 512 and %d", *maxResponse, dns.MaxMsgSize-1)
+	}
+
+	for _, name := range splitTrim(*refuseTypes, ",") {
+		if name == "" {
+			continue
+		}
+		qtype, ok := dns.StringToType[strings.ToUpper(name)]
+		if !ok {
+			log.Fatalf("Invalid --refuse-types, unknown type %q", name)
+		}
+		refusedTypes[qtype] = true
+	}
+
+	switch *cacheScope {
+	case CACHE_SHARED, CACHE_VIEW, CACHE_CLIENT:
+	default:
+		log.Fatalf("Invalid --cache-scope %q, must be %s, %s or %s", *cacheScope, CACHE_SHARED, CACHE_VIEW, CACHE_CLIENT)
+	}
+
+	if *recurseUdpSize != 0 && (*recurseUdpSize < dns.MinMsgSize || *recurseUdpSize > dns.MaxMsgSize) {
+		log.Fatalf("Invalid --recurse-udp-size %d, must be 0 or between %d and %d", *recurseUdpSize, dns.MinMsgSize, dns.MaxMsgSize)
+	}
+
+	switch *precedence {
+	case PRECEDENCE_CNAME, PRECEDENCE_A_OVER_CNAME:
+	default:
+		log.Fatalf("Invalid --precedence %q, must be %s or %s", *precedence, PRECEDENCE_CNAME, PRECEDENCE_A_OVER_CNAME)
+	}
+
+	switch *whoamiSource {
+	case WHOAMI_TRANSPORT, WHOAMI_ECS:
+	default:
+		log.Fatalf("Invalid --whoami-source %q, must be %s or %s", *whoamiSource, WHOAMI_TRANSPORT, WHOAMI_ECS)
+	}
+
+	switch *noRecurseReply {
+	case NO_RECURSE_REFUSED, NO_RECURSE_NXDOMAIN, NO_RECURSE_NODATA:
+	default:
+		log.Fatalf("Invalid --no-recurse-response %q, must be %s, %s or %s", *noRecurseReply, NO_RECURSE_REFUSED, NO_RECURSE_NXDOMAIN, NO_RECURSE_NODATA)
+	}
+
+	if err := parseSessionClients(*sessionAllow); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := parseStatusClients(*statusAllow); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := parseEcsForwarders(*ecsAllow); err != nil {
+		log.Fatal(err)
+	}
+
+	if *dns64 {
+		if err := parseDns64Prefix(*dns64PrefixFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *consulAddr != "" {
+		if metadataDriven() {
+			log.Fatal("--consul can't be used with --metadata-server")
+		}
+		addAnswerSource(newConsulSource(*consulAddr, *consulDomain))
+	}
+
+	if len(*instanceSpecs) > 0 {
+		if metadataDriven() {
+			log.Fatal("--instance can't be used with --metadata-server")
+		}
+		if err := parseInstances(*instanceSpecs); err != nil {
+			log.Fatalf("Invalid --instance: %v", err)
+		}
+	}
+
+	if len(*chaosSpecs) > 0 {
+		if err := parseChaosDelays(*chaosSpecs); err != nil {
+			log.Fatalf("Invalid --chaos-delay: %v", err)
+		}
+		log.Warnf("Chaos testing: %d --chaos-delay rule(s) hold back responses on purpose", len(chaosDelays))
+	}
+
+	if *drainFile != "" {
+		if err := loadDrained(*drainFile); err != nil {
+			log.Fatalf("Failed to load drained IP addresses from %s: %v", *drainFile, err)
+		}
+	}
+
+	if *recurseSource != "" {
+		if err := setRecurseSource(*recurseSource); err != nil {
+			log.Fatalf("Invalid recurse source %s: %v", *recurseSource, err)
+		}
+	}
+
 	if *logFile != "" {
 		if output, err := os.OpenFile(*logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666); err != nil {
 			log.Fatalf("Failed to log to file %s: %v", *logFile, err)
@@ -127,17 +374,18 @@ func loadAnswersFromMeta(name string) {
 		log.Errorf("Failed to generate answers: %v", err)
 	}
 	ConvertPtrIps(&newAnswers)
+	prepareAnswers(newAnswers)
 
-	if reflect.DeepEqual(newAnswers, answers) {
+	if reflect.DeepEqual(newAnswers, getAnswers()) {
 		log.Debug("No changes in dns data")
 		return
 	}
 
 	log.Infof("Reloading answers")
 	clearClientSpecificCaches()
-	answers = newAnswers
+	setAnswers(newAnswers)
 	// write to file (debugging purposes)
-	b, err := json.Marshal(answers)
+	b, err := json.Marshal(newAnswers)
 	if err != nil {
 		log.Errorf("Failed to marshall answers: %v", err)
 	}
@@ -150,18 +398,75 @@ func loadAnswersFromMeta(name string) {
 
 func loadAnswers() (err error) {
 	log.Debug("Loading answers")
-	temp, err := ParseAnswers(*answersFile)
+	startValidation(mainValidation)
+	temp, err := parseLoadedAnswers(*answersFile)
+	if *shadowFile != "" {
+		if serr := loadShadowAnswers(); serr != nil {
+			log.Errorf("Failed to load shadow answers: %v", serr)
+		}
+	}
 	if err == nil {
 		clearClientSpecificCaches()
-		answers = temp
+		setAnswers(temp)
 		log.Infof("Loaded answers")
 	} else {
 		log.Errorf("Failed to load answers: %v", err)
 	}
+	finishValidation(mainValidation, *answersFile, err, getAnswers())
 
 	return err
 }
 
+// The answers file with the zone directory and the other sources merged in, for the main answers or an instance
+func parseLoadedAnswers(path string) (Answers, error) {
+	temp, err := ParseAnswers(path)
+	if err == nil && *answersDir != "" {
+		err = loadAnswersDir(temp)
+	}
+	if err == nil {
+		mergeSources(temp)
+	}
+	return temp, err
+}
+
+// Merges the zone directory into the default answers, anything in the answers file takes precedence
+func loadAnswersDir(into Answers) error {
+	zones, err := ParseAnswersDir(*answersDir)
+	if err != nil {
+		return err
+	}
+
+	if err := ExpandRanges(&Answers{DEFAULT_KEY: zones}); err != nil {
+		return err
+	}
+	if err := validateAnswers(Answers{DEFAULT_KEY: zones}); err != nil {
+		return err
+	}
+
+	ConvertPtrIps(&Answers{DEFAULT_KEY: zones})
+	defaults := into[DEFAULT_KEY]
+	mergeAnswers(&defaults, zones, *answersDir)
+	into[DEFAULT_KEY] = defaults
+	return nil
+}
+
+func watchShutdown() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-c
+		log.Infof("Received %v signal, shutting down", sig)
+		shutdown()
+		listeners.Stop()
+		stopInstances()
+		if dnstap != nil {
+			dnstap.Close()
+		}
+		os.Exit(0)
+	}()
+}
+
 func watchSignals() {
 	if metadataDriven() {
 		go configGenerator.metaFetcher.OnChange(5, loadAnswersFromMeta)
@@ -173,12 +478,19 @@ func watchSignals() {
 			for _ = range c {
 				log.Info("Received HUP signal")
 				reloadChan <- nil
+				reloadInstances()
 			}
 		}()
 
 		go func() {
 			for resp := range reloadChan {
 				err := loadAnswers()
+				if lerr := reloadListeners(); lerr != nil {
+					log.Errorf("Failed to reload listeners: %v", lerr)
+					if err == nil {
+						err = lerr
+					}
+				}
 				if resp != nil {
 					resp <- err
 				}
@@ -191,15 +503,50 @@ func watchSignals() {
 func watchHttp() {
 	reloadRouter := mux.NewRouter()
 	reloadRouter.HandleFunc("/v1/reload", httpReload).Methods("POST")
+	reloadRouter.HandleFunc("/metrics", httpMetrics).Methods("GET")
+	reloadRouter.HandleFunc("/v1/clients", httpClients).Methods("GET")
+	reloadRouter.HandleFunc("/v1/zones", httpZones).Methods("GET")
+	reloadRouter.HandleFunc("/v1/records", httpLabeled).Methods("GET")
+	reloadRouter.HandleFunc("/v1/validation", httpValidation).Methods("GET")
+	reloadRouter.HandleFunc("/v1/offline", httpGetOffline).Methods("GET")
+	reloadRouter.HandleFunc("/v1/offline", httpSetOffline(true)).Methods("POST")
+	reloadRouter.HandleFunc("/v1/offline", httpSetOffline(false)).Methods("DELETE")
+	reloadRouter.HandleFunc("/v1/drain-ip", httpGetDrained).Methods("GET")
+	reloadRouter.HandleFunc("/v1/drain-ip/{ip}", httpSetDrained(true)).Methods("POST")
+	reloadRouter.HandleFunc("/v1/drain-ip/{ip}", httpSetDrained(false)).Methods("DELETE")
+	reloadRouter.HandleFunc("/v1/drain-label", httpSetDrainedLabel(true)).Methods("POST")
+	reloadRouter.HandleFunc("/v1/drain-label", httpSetDrainedLabel(false)).Methods("DELETE")
+	reloadRouter.HandleFunc("/v1/failover-label", httpGetFailovers).Methods("GET")
+	reloadRouter.HandleFunc("/v1/failover-label", httpSetFailoverLabel(true)).Methods("POST")
+	reloadRouter.HandleFunc("/v1/failover-label", httpSetFailoverLabel(false)).Methods("DELETE")
+	if *profiling {
+		reloadRouter.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		reloadRouter.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		reloadRouter.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		reloadRouter.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		reloadRouter.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+	}
 	log.Info("Listening for Reload on ", *listenReload)
 	go http.ListenAndServe(*listenReload, reloadRouter)
 }
 
+// Reloads the main answers, or with ?instance= only that instance's
 func httpReload(w http.ResponseWriter, req *http.Request) {
 	log.Debugf("Received HTTP reload request")
-	respChan := make(chan error)
-	reloadChan <- respChan
-	err := <-respChan
+	var err error
+	if name := req.URL.Query().Get("instance"); name != "" {
+		inst := findInstance(name)
+		if inst == nil {
+			w.WriteHeader(404)
+			io.WriteString(w, "No instance named "+name)
+			return
+		}
+		err = inst.load()
+	} else {
+		respChan := make(chan error)
+		reloadChan <- respChan
+		err = <-respChan
+	}
 
 	if err == nil {
 		io.WriteString(w, "OK")
@@ -209,15 +556,60 @@ func httpReload(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func httpGetOffline(w http.ResponseWriter, req *http.Request) {
+	io.WriteString(w, strconv.FormatBool(isOffline()))
+}
+
+func httpSetOffline(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		log.Infof("Setting offline mode to %v", enabled)
+		setOffline(enabled)
+		io.WriteString(w, "OK")
+	}
+}
+
 func route(w dns.ResponseWriter, req *dns.Msg) {
+	// The same answers for the whole query, even if they are reloaded meanwhile
+	serve(w, req, "", getAnswers())
+}
+
+// Answers a query from these answers. A named instance's cached answers are kept apart from everyone else's.
+func serve(w dns.ResponseWriter, req *dns.Msg, instanceName string, answers Answers) {
+	// Responses sent to us are spoofed or misrouted, answering them could start a reflection loop
+	if req.Response {
+		droppedByReason.Inc("response")
+		log.WithFields(log.Fields{"client": w.RemoteAddr().String()}).Debug("Dropped packet with QR bit set")
+		return
+	}
+
+	if dnstap != nil {
+		queryTime := time.Now()
+		dnstap.Log(dnstapClientQuery, w, req, queryTime)
+		w = &dnstapResponseWriter{ResponseWriter: w, queryTime: queryTime}
+	}
+
 	// Setup reply
 	m := new(dns.Msg)
 	m.SetReply(req)
 	m.Authoritative = true
-	m.RecursionAvailable = true
+	m.RecursionAvailable = !*noRecurse
 	m.Compress = true
 
 	clientIp, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	cacheClient := clientIp
+	if instanceName != "" {
+		cacheClient = instanceName + "/" + clientIp
+	}
+
+	// A slow client's queries can be given up on sooner, an important one's get longer
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout := answers.QueryTimeout(clientIp); timeout > 0 {
+		ctx, cancel = context.WithTimeout(rootCtx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(rootCtx)
+	}
+	defer cancel()
 
 	// One question at a time please
 	if len(req.Question) != 1 {
@@ -232,6 +624,29 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 	// We are assuming the config has all names as lower case
 	fqdn := strings.ToLower(question.Name)
 
+	if *slowQuery > 0 {
+		var recursions *int32
+		ctx, recursions = countRecursions(ctx)
+		defer logSlowQuery(time.Now(), recursions, log.Fields{"question": fqdn, "type": rrString, "client": clientIp})
+	}
+
+	if delay := chaosDelayFor(clientIp, fqdn); delay > 0 {
+		w = &chaosResponseWriter{ResponseWriter: w, ctx: ctx, delay: delay}
+	}
+
+	if traceEnabled(fqdn) {
+		ctx, w = startTrace(ctx, w, clientIp, question)
+	}
+
+	if refusedTypes[question.Qtype] {
+		m.Authoritative = false
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		refusedByType.Inc(rrString)
+		log.WithFields(log.Fields{"question": fqdn, "type": rrString, "client": clientIp}).Debug("Refused query type")
+		return
+	}
+
 	// Internets only
 	if question.Qclass != dns.ClassINET {
 		m.Authoritative = false
@@ -254,6 +669,27 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 
+	if *shadowFile != "" && instanceName == "" {
+		queueShadow(answers, clientIp, question)
+	}
+
+	if isStatusName(fqdn) {
+		if !inNetworks(statusClients, clientIp) {
+			m.Rcode = dns.RcodeRefused
+			log.WithFields(log.Fields{"question": fqdn, "type": rrString, "client": clientIp}).Warn("Refused status query")
+		} else if question.Qtype == dns.TypeTXT {
+			m.Answer = statusRecords(answers, question.Name)
+		}
+		w.WriteMsg(m)
+		return
+	}
+
+	if isWhoamiName(fqdn) {
+		m.Answer = whoamiRecords(clientIp, req)
+		w.WriteMsg(m)
+		return
+	}
+
 	proto := "UDP"
 	if isTcp(w) {
 		proto = "TCP"
@@ -261,41 +697,144 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 
 	log.WithFields(log.Fields{"question": fqdn, "type": rrString, "client": clientIp, "proto": proto}).Debug("Request")
 
-	if msg := clientSpecificCacheHit(clientIp, req); msg != nil {
+	token := sessionToken(clientIp, req)
+
+	// Answers ordered for the forwarder's client are cached for that client's subnet only
+	subnet := clientSubnet(clientIp, req)
+	if subnet != nil {
+		cacheClient += "/" + subnet.String()
+	}
+
+	// Delegated space is never answered here, whatever records we have for it
+	if suffix, servers, ok := answers.DelegationFor(clientIp, fqdn); ok {
+		log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn}).Debugf("Referral for delegated %s", suffix)
+		traceHop(ctx, "referral to %s", strings.Join(servers, ","))
+		m.Authoritative = false
+		m.Ns, m.Extra = referral(answers, clientIp, suffix, servers)
+		Respond(w, req, m)
+		return
+	}
+
+	// The apex of one of our zones, which monitoring asks for its SOA and NS
+	if suffix, ok := answers.ApexOf(fqdn); ok && (question.Qtype == dns.TypeSOA || question.Qtype == dns.TypeNS) {
+		traceHop(ctx, "%s %s apex", rrString, fqdn)
+		if question.Qtype == dns.TypeSOA {
+			m.Answer = []dns.RR{soaRecord(instanceName, suffix)}
+			addAuthorityNs(answers, m, suffix)
+		} else {
+			m.Answer = nsRecords(suffix)
+		}
+		Respond(w, req, m)
+		log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn}).Debug("Answered for zone apex")
+		return
+	}
+
+	if msg := clientSpecificCacheHit(cacheClient, req); msg != nil {
+		traceHop(ctx, "client-specific cache")
 		if len(msg.Answer) > 1 {
 			shuffle(&msg.Answer)
 		}
+		if token != "" {
+			stickyOrder(&msg.Answer, token)
+		}
+		if subnet != nil {
+			orderByProximity(msg.Answer, subnet)
+		}
+		responsesBySection.Inc(SECTION_CACHE)
 		Respond(w, req, msg)
 		log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn}).Debug("Sent client-specific cached response")
 		return
 	}
 
-	if msg := globalCacheHit(req); msg != nil {
+	// A query without RD only asks for what we have ourselves, so it never gets a recursive answer
+	outOfZone := !req.RecursionDesired && *refuseNoRec && answers.OutOfZone(fqdn)
+
+	// When offline, expired entries are still good enough and must not be evicted
+	cacheKey := globalCacheKey(answers, clientIp, req)
+	if instanceName != "" {
+		cacheKey = instanceName + "/" + cacheKey
+	}
+	var cached *dns.Msg
+	if outOfZone {
+		// Not from the cache either
+	} else if isOffline() {
+		cached = globalCacheStaleHit(cacheKey, req)
+	} else if staleRefresh != nil {
+		// Expired entries are served too while a worker asks upstream again
+		var stale bool
+		if cached, stale = globalCacheHitOrStale(cacheKey, req); stale {
+			traceHop(ctx, "stale, refreshing")
+			staleRefresh.Refresh(cacheKey, req, answers.Recursers(clientIp))
+		}
+	} else {
+		cached = globalCacheHit(cacheKey, req)
+	}
+	if msg := cached; msg != nil {
+		traceHop(ctx, "global cache")
+		msg.Answer = answers.applyTtlFloor(clientIp, msg.Answer)
 		if len(msg.Answer) > 1 {
 			shuffle(&msg.Answer)
 		}
+		if token != "" {
+			stickyOrder(&msg.Answer, token)
+		}
+		responsesBySection.Inc(SECTION_CACHE)
 		Respond(w, req, msg)
 		log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn}).Debug("Sent globally cached response")
 		return
 	}
 
+	// Set when the name is ours but what it points at could not be resolved
+	var unresolved *int32
+
 	// A records may return CNAME answer(s) plus A answer(s)
 	if question.Qtype == dns.TypeA {
-		found, ok := answers.Addresses(clientIp, fqdn, nil, 1)
+		var lookupCtx context.Context
+		lookupCtx, unresolved = countUnresolved(ctx)
+		found, section, ok := answers.AddressesSection(lookupCtx, clientIp, fqdn, nil, 1)
 		if ok && len(found) > 0 {
-			log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn, "answers": len(found)}).Debug("Answered locally")
+			log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn, "answers": len(found), "section": section}).Debug("Answered locally")
+			responsesBySection.Inc(section)
+			answers.countSources(clientIp, found)
 			m.Answer = found
-			addToClientSpecificCache(clientIp, req, m)
+			if token != "" {
+				stickyOrder(&m.Answer, token)
+			}
+			if subnet != nil {
+				orderByProximity(m.Answer, subnet)
+			}
+			addAuthorityNs(answers, m, fqdn)
+			addToClientSpecificCache(cacheClient, req, m)
 			Respond(w, req, m)
 			return
 		}
 	} else if question.Qtype == dns.TypeAAAA {
-		_, ok := answers.Addresses(clientIp, fqdn, nil, 1)
+		lookupCtx, recursions := countRecursions(ctx)
+		lookupCtx, unresolved = countUnresolved(lookupCtx)
+		found, section, ok := answers.AddressesSection(lookupCtx, clientIp, fqdn, nil, 1)
+		if ok && dns64Prefix != nil {
+			if synthesized := answers.dns64Answer(ctx, clientIp, found, atomic.LoadInt32(recursions) > 0); synthesized != nil {
+				log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn, "answers": len(synthesized), "section": section}).Debug("Answered locally with DNS64")
+				traceHop(ctx, "AAAA %s synthesized from A", fqdn)
+				responsesBySection.Inc(section)
+				answers.countSources(clientIp, found)
+				m.Answer = synthesized
+				addAuthorityNs(answers, m, fqdn)
+				addToClientSpecificCache(cacheClient, req, m)
+				Respond(w, req, m)
+				return
+			}
+		}
 		if ok {
-			log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn}).Debug("Answered locally, no error and empty answer")
+			log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn, "section": section}).Debug("Answered locally, no error and empty answer")
+			responsesBySection.Inc(section)
 			m.Authoritative = true
 			m.Rcode = dns.RcodeSuccess
-			addToClientSpecificCache(clientIp, req, m)
+			// The name exists, so this is NODATA and the zone's SOA tells the client how long to cache that
+			if suffix, ok := answers.AuthoritativeFor(fqdn); ok {
+				m.Ns = append(m.Ns, soaRecord(instanceName, suffix))
+			}
+			addToClientSpecificCache(cacheClient, req, m)
 			Respond(w, req, m)
 			return
 		}
@@ -304,11 +843,15 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 		keys := []string{clientIp, DEFAULT_KEY}
 		for _, key := range keys {
 			// Client-specific answers
-			found, ok := answers.Matching(question.Qtype, key, fqdn)
+			found, section, ok := answers.MatchingSection(question.Qtype, key, fqdn)
 			if ok {
-				log.WithFields(log.Fields{"client": key, "type": rrString, "question": fqdn, "answers": len(found)}).Debug("Answered from config for ", key)
+				traceHop(ctx, "%s %s local (%s)", rrString, fqdn, section)
+				log.WithFields(log.Fields{"client": key, "type": rrString, "question": fqdn, "answers": len(found), "section": section}).Debug("Answered from config for ", key)
+				responsesBySection.Inc(section)
+				answers.countSources(key, found)
 				m.Answer = found
-				addToClientSpecificCache(clientIp, req, m)
+				addAuthorityNs(answers, m, fqdn)
+				addToClientSpecificCache(cacheClient, req, m)
 				Respond(w, req, m)
 				return
 			}
@@ -317,50 +860,220 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 		log.Debug("No match found in config")
 	}
 
+	// The name is ours, but its CNAME or ALIAS target could not be resolved: that is a failure, not NODATA
+	if unresolved != nil && atomic.LoadInt32(unresolved) > 0 {
+		traceHop(ctx, "could not resolve the target of %s", fqdn)
+		log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn}).Info("Could not resolve the target")
+		dns.HandleFailed(w, req)
+		return
+	}
+
+	// The name is ours, just not with this type of record: NODATA, with the SOA saying how long to cache that
+	if section, ok := answers.HasName(clientIp, fqdn); ok {
+		traceHop(ctx, "no %s for %s (%s)", rrString, fqdn, section)
+		log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn, "section": section}).Debug("Name exists locally without this type, no data")
+		responsesBySection.Inc(section)
+		m.Authoritative = true
+		m.Rcode = dns.RcodeSuccess
+		if suffix, ok := answers.AuthoritativeFor(fqdn); ok {
+			m.Ns = append(m.Ns, soaRecord(instanceName, suffix))
+		}
+		addToClientSpecificCache(cacheClient, req, m)
+		Respond(w, req, m)
+		return
+	}
+
+	// Nor is the apex of one of our zones ever recursed, it exists even without records of its own
+	if suffix, ok := answers.ApexOf(fqdn); ok {
+		traceHop(ctx, "no %s for apex %s", rrString, fqdn)
+		log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn}).Debug("Zone apex without this type, no data")
+		m.Authoritative = true
+		m.Rcode = dns.RcodeSuccess
+		m.Ns = append(m.Ns, soaRecord(instanceName, suffix))
+		Respond(w, req, m)
+		return
+	}
+
 	// If we are authoritative for a suffix the label has, there's no point trying the recursive DNS
-	authoritativeFor := answers.AuthoritativeSuffixes()
-	for _, suffix := range authoritativeFor {
-		if strings.HasSuffix(fqdn, suffix) {
-			log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn}).Debugf("Not answered locally, but I am authoritative for %s", suffix)
-			m.Authoritative = true
-			m.RecursionAvailable = false
+	if suffix, ok := answers.AuthoritativeFor(fqdn); ok {
+		log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn}).Debugf("Not answered locally, but I am authoritative for %s", suffix)
+		traceHop(ctx, "no %s, authoritative for %s", fqdn, suffix)
+		m.Authoritative = true
+		m.RecursionAvailable = false
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(m.Ns, soaRecord(instanceName, suffix))
+		Respond(w, req, m)
+		return
+	}
+
+	if *noRecurse {
+		m.Authoritative = false
+		m.RecursionAvailable = false
+		switch *noRecurseReply {
+		case NO_RECURSE_NXDOMAIN:
 			m.Rcode = dns.RcodeNameError
-			me := strings.TrimLeft(suffix, ".")
-			hdr := dns.RR_Header{Name: me, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(*defaultTtl)}
-			serial++
-			record := &dns.SOA{Hdr: hdr, Ns: me, Mbox: me, Serial: serial, Refresh: 60, Retry: 10, Expire: 86400, Minttl: 1}
-			m.Ns = append(m.Ns, record)
-			Respond(w, req, m)
-			return
+		case NO_RECURSE_NODATA:
+			m.Rcode = dns.RcodeSuccess
+		default:
+			m.Rcode = dns.RcodeRefused
 		}
+		Respond(w, req, m)
+		log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn, "rd": req.RecursionDesired}).Debugf("Recursion disabled, answered %s", dns.RcodeToString[m.Rcode])
+		return
 	}
 
-	// Phone a friend - Forward original query
-	msg, err := ResolveTryAll(req, answers.Recursers(clientIp))
-	if err == nil && msg != nil {
-		msg.Compress = true
-		msg.Id = req.Id
+	if outOfZone {
+		m.Authoritative = false
+		m.RecursionAvailable = false
+		m.Rcode = dns.RcodeRefused
+		Respond(w, req, m)
+		log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn}).Debug("Outside our zones and recursion not desired, refused")
+		return
+	}
 
-		// We don't support AAAA, but an NXDOMAIN from the recursive resolver
-		// doesn't necessarily mean there are never any records for that domain,
-		// so rewrite the response code to NOERROR.
-		if (question.Qtype == dns.TypeAAAA) && (msg.Rcode == dns.RcodeNameError) {
-			log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn}).Debug("Rewrote AAAA NXDOMAIN to NOERROR")
-			msg.Rcode = dns.RcodeSuccess
-		}
+	if isOffline() {
+		log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn}).Info("Offline, not recursing")
+		dns.HandleFailed(w, req)
+		return
+	}
 
-		addToGlobalCache(req, msg)
+	// Phone a friend - Forward original query
+	msg, err := ResolveTryAll(ctx, req, answers.Recursers(clientIp))
+	if err == nil && msg != nil {
+		prepareRecursive(ctx, req, msg, answers.Recursers(clientIp))
+		addToGlobalCache(cacheKey, msg)
 
+		msg.Answer = answers.applyTtlFloor(clientIp, msg.Answer)
 		Respond(w, req, msg)
+		responsesBySection.Inc(SECTION_RECURSION)
 		log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn}).Debug("Sent recursive response")
 		return
 	}
 
 	// I give up
+	if ctx.Err() == context.DeadlineExceeded {
+		log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn}).Info("Query timed out")
+		dns.HandleFailed(w, req)
+		return
+	}
 	log.WithFields(log.Fields{"client": clientIp, "type": rrString, "question": fqdn}).Info("No answer found")
 	dns.HandleFailed(w, req)
 }
 
+// Makes a recursive response the one we send and cache, both when answering and when refreshing the cache
+func prepareRecursive(ctx context.Context, req *dns.Msg, msg *dns.Msg, recursers []string) {
+	msg.Compress = true
+	msg.Id = req.Id
+
+	question := req.Question[0]
+	fqdn := strings.ToLower(question.Name)
+
+	// With --dns64, an AAAA response without any is made from the A records. Upstream's NXDOMAIN is not
+	// synthesized for, so this has to be decided before that is rewritten below.
+	if question.Qtype == dns.TypeAAAA && dns64Prefix != nil && needsDns64(msg) {
+		recurseDns64(ctx, req, msg, recursers)
+	}
+
+	// We don't support AAAA, but an NXDOMAIN from the recursive resolver
+	// doesn't necessarily mean there are never any records for that domain,
+	// so rewrite the response code to NOERROR.
+	if (question.Qtype == dns.TypeAAAA) && (msg.Rcode == dns.RcodeNameError) {
+		log.WithFields(log.Fields{"type": "AAAA", "question": fqdn}).Debug("Rewrote AAAA NXDOMAIN to NOERROR")
+		msg.Rcode = dns.RcodeSuccess
+	}
+
+	// Opt-in: present upstream data for these zones as if it were our own
+	if inZones(fqdn, *aaRecurseZones) {
+		msg.Authoritative = true
+	}
+}
+
+// Logs the query if it took longer than the slow query threshold
+func logSlowQuery(start time.Time, recursions *int32, fields log.Fields) {
+	elapsed := time.Since(start)
+	if elapsed < *slowQuery {
+		return
+	}
+
+	fields["duration"] = elapsed.String()
+	fields["recursions"] = atomic.LoadInt32(recursions)
+	log.WithFields(fields).Warn("Slow query")
+}
+
+// NS records for a delegated suffix, with glue for the name servers we have addresses for
+func referral(answers Answers, clientIp string, suffix string, servers []string) (ns []dns.RR, extra []dns.RR) {
+	ttl := uint32(*defaultTtl)
+	for _, server := range servers {
+		server = dns.Fqdn(strings.ToLower(server))
+		hdr := dns.RR_Header{Name: suffix, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl}
+		ns = append(ns, &dns.NS{Hdr: hdr, Ns: server})
+
+		if glue, ok := answers.Matching(dns.TypeA, clientIp, server); ok {
+			extra = append(extra, glue...)
+		}
+	}
+
+	return
+}
+
+// Whether the name is in (or is) one of the comma-delimited zones
+func inZones(fqdn string, zones string) bool {
+	for _, zone := range splitTrim(zones, ",") {
+		zone = strings.ToLower(strings.Trim(zone, "."))
+		if zone == "" {
+			continue
+		}
+		if fqdn == zone+"." || strings.HasSuffix(fqdn, "."+zone+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SOA for an authoritative suffix
+func soaRecord(instance string, suffix string) dns.RR {
+	me := strings.TrimLeft(suffix, ".")
+	hdr := dns.RR_Header{Name: me, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(*defaultTtl)}
+	serial := instanceZoneSerial(instance, me)
+	return &dns.SOA{Hdr: hdr, Ns: zoneNameservers(me)[0], Mbox: me, Serial: serial, Refresh: 60, Retry: 10, Expire: 86400, Minttl: 1}
+}
+
+// With --include-authority-ns, positive answers for names in our zones carry the zone's NS RRset
+func addAuthorityNs(answers Answers, m *dns.Msg, fqdn string) {
+	if !*authorityNs {
+		return
+	}
+	if suffix, ok := answers.AuthoritativeFor(fqdn); ok {
+		m.Ns = append(m.Ns, nsRecords(suffix)...)
+	}
+}
+
+// The NS RRset of one of our zones
+func nsRecords(suffix string) []dns.RR {
+	me := strings.TrimLeft(suffix, ".")
+	var records []dns.RR
+	for _, ns := range zoneNameservers(me) {
+		hdr := dns.RR_Header{Name: me, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: uint32(*defaultTtl)}
+		records = append(records, &dns.NS{Hdr: hdr, Ns: ns})
+	}
+	return records
+}
+
+// The names of the servers for our zones, the zone itself unless --nameservers is given
+func zoneNameservers(zone string) []string {
+	var servers []string
+	for _, server := range splitTrim(*nameservers, ",") {
+		if server != "" {
+			servers = append(servers, dns.Fqdn(strings.ToLower(server)))
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{zone}
+	}
+	return servers
+}
+
 func isTcp(w dns.ResponseWriter) bool {
 	_, ok := w.RemoteAddr().(*net.TCPAddr)
 	return ok
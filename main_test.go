@@ -0,0 +1,1520 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/cache"
+	"gopkg.in/check.v1"
+)
+
+type RouteTests struct{}
+
+var _ = check.Suite(&RouteTests{})
+
+func (t *RouteTests) SetUpTest(c *check.C) {
+	globalCache = cache.New(int(*cacheCapacity), int(*defaultTtl))
+	clientSpecificCaches = make(map[string]*cache.Cache)
+	answers = Answers{
+		"10.1.1.2": ClientAnswers{
+			A: map[string]RecordA{
+				"web.rancher.internal.": {Answer: []string{"10.9.2.3"}},
+			},
+		},
+		DEFAULT_KEY: ClientAnswers{
+			Authoritative: []string{"rancher.internal"},
+			Delegate: map[string][]string{
+				"sub.rancher.internal": {"ns1.sub.rancher.internal.", "ns.example.com."},
+			},
+			A: map[string]RecordA{
+				"ns1.sub.rancher.internal.": {Answer: []string{"10.1.4.1"}},
+				"www.sub.rancher.internal.": {Answer: []string{"10.1.4.2"}},
+				"web.rancher.internal.":     {Answer: []string{"10.1.2.3"}},
+				"pool.rancher.internal.":    {Answer: []string{"10.1.3.1", "10.1.3.2", "10.1.3.3", "10.1.3.4"}},
+			},
+		},
+	}
+}
+
+// Captures the response instead of sending it anywhere
+type testWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func newTestWriter(clientIp string) *testWriter {
+	return &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(clientIp), Port: 12345}}
+}
+
+func (w *testWriter) LocalAddr() net.Addr         { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *testWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *testWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *testWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testWriter) Close() error                { return nil }
+func (w *testWriter) TsigStatus() error           { return nil }
+func (w *testWriter) TsigTimersOnly(bool)         {}
+func (w *testWriter) Hijack()                     {}
+
+func query(clientIp, name string, qtype uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	return send(clientIp, req)
+}
+
+func send(clientIp string, req *dns.Msg) *dns.Msg {
+	w := newTestWriter(clientIp)
+	route(w, req)
+	return w.msg
+}
+
+func (t *RouteTests) TestAAAANoData(c *check.C) {
+	msg := query("10.1.1.1", "web.rancher.internal.", dns.TypeAAAA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeSuccess)
+	c.Check(msg.Authoritative, check.Equals, true)
+	c.Check(msg.Answer, check.HasLen, 0)
+	c.Assert(msg.Ns, check.HasLen, 1)
+	soa, ok := msg.Ns[0].(*dns.SOA)
+	c.Assert(ok, check.Equals, true)
+	c.Check(soa.Hdr.Name, check.Equals, "rancher.internal.")
+
+	// Same answer again from the cache
+	msg = query("10.1.1.1", "web.rancher.internal.", dns.TypeAAAA)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeSuccess)
+	c.Check(msg.Answer, check.HasLen, 0)
+	c.Check(msg.Ns, check.HasLen, 1)
+}
+
+func (t *RouteTests) TestAAAANameError(c *check.C) {
+	msg := query("10.1.1.1", "nothing.rancher.internal.", dns.TypeAAAA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeNameError)
+	c.Check(msg.Answer, check.HasLen, 0)
+	c.Check(msg.Ns, check.HasLen, 1)
+}
+
+func (t *RouteTests) TestCnameTargetUnresolved(c *check.C) {
+	// Reads queries and never answers them
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer pc.Close()
+
+	def := answers[DEFAULT_KEY]
+	def.Recurse = []string{pc.LocalAddr().String()}
+	def.Cname = map[string]RecordCname{"ext.rancher.internal.": {Answer: "example.com."}}
+	answers[DEFAULT_KEY] = def
+	answers["10.1.1.3"] = ClientAnswers{Timeout: 100}
+	prepareAnswers(answers)
+
+	// The name exists, but without its target there is no answer to give, not even an empty one
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg := query("10.1.1.3", "ext.rancher.internal.", qtype)
+		c.Assert(msg, check.NotNil)
+		c.Check(msg.Rcode, check.Equals, dns.RcodeServerFailure)
+	}
+
+	// Nor when offline
+	setOffline(true)
+	defer setOffline(false)
+	msg := query("10.1.1.1", "ext.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeServerFailure)
+
+	// The other types still have no data
+	msg = query("10.1.1.1", "ext.rancher.internal.", dns.TypeTXT)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeSuccess)
+	c.Check(msg.Ns, check.HasLen, 1)
+}
+
+func sessionQuery(clientIp, name, token string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	req.SetEdns0(4096, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: 65001, Data: []byte(token)})
+	return send(clientIp, req)
+}
+
+func (t *RouteTests) TestSessionToken(c *check.C) {
+	*sessionOption = 65001
+	defer func() { *sessionOption = 0 }()
+	c.Assert(parseSessionClients("10.1.1.0/24"), check.IsNil)
+	defer parseSessionClients("")
+
+	first := sessionQuery("10.1.1.1", "pool.rancher.internal.", "abc").Answer[0].(*dns.A).A.String()
+	for i := 0; i < 20; i++ {
+		msg := sessionQuery("10.1.1.1", "pool.rancher.internal.", "abc")
+		c.Assert(msg.Answer, check.HasLen, 4)
+		c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, first)
+	}
+
+	// Tokens from clients outside the allow list are ignored, so answers are shuffled as usual
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		msg := sessionQuery("10.1.2.1", "pool.rancher.internal.", "abc")
+		seen[msg.Answer[0].(*dns.A).A.String()] = true
+	}
+	c.Check(len(seen) > 1, check.Equals, true)
+}
+
+func (t *RouteTests) TestResponsesBySection(c *check.C) {
+	client := responsesBySection.Get(SECTION_CLIENT)
+	def := responsesBySection.Get(SECTION_DEFAULT)
+
+	msg := query("10.1.1.2", "web.rancher.internal.", dns.TypeA)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "10.9.2.3")
+	c.Check(responsesBySection.Get(SECTION_CLIENT), check.Equals, client+1)
+
+	msg = query("10.1.1.3", "web.rancher.internal.", dns.TypeA)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "10.1.2.3")
+	c.Check(responsesBySection.Get(SECTION_DEFAULT), check.Equals, def+1)
+
+	// Asked again, it comes from the client-specific cache
+	cache := responsesBySection.Get(SECTION_CACHE)
+	msg = query("10.1.1.3", "web.rancher.internal.", dns.TypeA)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "10.1.2.3")
+	c.Check(responsesBySection.Get(SECTION_DEFAULT), check.Equals, def+1)
+	c.Check(responsesBySection.Get(SECTION_CACHE), check.Equals, cache+1)
+
+	// And recursive answers from the global one
+	upstream, _, stop := startUpstream(c)
+	defer stop()
+	defaults := answers[DEFAULT_KEY]
+	defaults.Recurse = []string{upstream}
+	answers[DEFAULT_KEY] = defaults
+	recursion := responsesBySection.Get(SECTION_RECURSION)
+	query("10.1.1.3", "example.com.", dns.TypeA)
+	query("10.1.1.3", "example.com.", dns.TypeA)
+	c.Check(responsesBySection.Get(SECTION_RECURSION), check.Equals, recursion+1)
+	c.Check(responsesBySection.Get(SECTION_CACHE), check.Equals, cache+2)
+}
+
+func (t *RouteTests) TestDelegation(c *check.C) {
+	for _, name := range []string{"www.sub.rancher.internal.", "nothing.sub.rancher.internal.", "sub.rancher.internal."} {
+		msg := query("10.1.1.1", name, dns.TypeA)
+		c.Assert(msg, check.NotNil)
+		c.Check(msg.Rcode, check.Equals, dns.RcodeSuccess)
+		c.Check(msg.Authoritative, check.Equals, false)
+		c.Check(msg.Answer, check.HasLen, 0)
+		c.Assert(msg.Ns, check.HasLen, 2)
+		c.Check(msg.Ns[0].(*dns.NS).Hdr.Name, check.Equals, "sub.rancher.internal.")
+		c.Check(msg.Ns[0].(*dns.NS).Ns, check.Equals, "ns1.sub.rancher.internal.")
+		c.Assert(msg.Extra, check.HasLen, 1)
+		c.Check(msg.Extra[0].(*dns.A).A.String(), check.Equals, "10.1.4.1")
+	}
+
+	msg := query("10.1.1.1", "web.rancher.internal.", dns.TypeA)
+	c.Check(msg.Answer, check.HasLen, 1)
+}
+
+func (t *RouteTests) TestLocalReverseZones(c *check.C) {
+	answers = Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Recurse: []string{"127.0.0.1:1"},
+			Ptr: map[string]RecordPtr{
+				"5.0.0.10.in-addr.arpa.": {Answer: "web.rancher.internal."},
+			},
+		},
+	}
+
+	msg := query("10.1.1.1", "5.0.0.10.in-addr.arpa.", dns.TypePTR)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.PTR).Ptr, check.Equals, "web.rancher.internal.")
+
+	msg = query("10.1.1.1", "6.0.0.10.in-addr.arpa.", dns.TypePTR)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeNameError)
+	c.Check(msg.Authoritative, check.Equals, true)
+	c.Assert(msg.Ns, check.HasLen, 1)
+	c.Check(msg.Ns[0].Header().Name, check.Equals, "10.in-addr.arpa.")
+
+	msg = query("10.1.1.1", "1.1.20.172.in-addr.arpa.", dns.TypePTR)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeNameError)
+}
+
+func (t *RouteTests) TestRecursePublicPtr(c *check.C) {
+	upstream, queries, stop := startUpstream(c)
+	defer stop()
+
+	answers = Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Recurse: []string{upstream},
+			Ptr: map[string]RecordPtr{
+				"5.0.0.10.in-addr.arpa.": {Answer: "web.rancher.internal."},
+			},
+		},
+	}
+
+	// Public addresses without a local PTR are recursed like any other name
+	msg := query("10.1.1.1", "8.8.8.8.in-addr.arpa.", dns.TypePTR)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeSuccess)
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(1))
+
+	// Private ones never leave
+	for _, name := range []string{"6.0.0.10.in-addr.arpa.", "1.1.168.192.in-addr.arpa.", "1.0.0.127.in-addr.arpa."} {
+		msg = query("10.1.1.1", name, dns.TypePTR)
+		c.Assert(msg, check.NotNil)
+		c.Check(msg.Rcode, check.Equals, dns.RcodeNameError, check.Commentf(name))
+	}
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(1))
+
+	// Unless they're no longer listed as local
+	*reverseZones = ""
+	defer func() { *reverseZones = strings.Join(privateReverseZones(), ",") }()
+	msg = query("10.1.1.1", "1.1.168.192.in-addr.arpa.", dns.TypePTR)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeSuccess)
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(2))
+}
+
+func (t *RouteTests) TestDropResponses(c *check.C) {
+	dropped := droppedByReason.Get("response")
+
+	req := new(dns.Msg)
+	req.SetQuestion("web.rancher.internal.", dns.TypeA)
+	req.Response = true
+	c.Check(send("10.1.1.1", req), check.IsNil)
+	c.Check(droppedByReason.Get("response"), check.Equals, dropped+1)
+}
+
+func (t *RouteTests) TestNoRecurse(c *check.C) {
+	*noRecurse = true
+	defer func() {
+		*noRecurse = false
+		*noRecurseReply = NO_RECURSE_REFUSED
+	}()
+
+	// Still answered locally, but without advertising recursion
+	msg := query("10.1.1.1", "web.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeSuccess)
+	c.Check(msg.Answer, check.HasLen, 1)
+	c.Check(msg.RecursionAvailable, check.Equals, false)
+
+	for reply, rcode := range map[string]int{
+		NO_RECURSE_REFUSED:  dns.RcodeRefused,
+		NO_RECURSE_NXDOMAIN: dns.RcodeNameError,
+		NO_RECURSE_NODATA:   dns.RcodeSuccess,
+	} {
+		*noRecurseReply = reply
+		msg = query("10.1.1.1", "www.example.com.", dns.TypeA)
+		c.Assert(msg, check.NotNil)
+		c.Check(msg.Rcode, check.Equals, rcode, check.Commentf(reply))
+		c.Check(msg.Answer, check.HasLen, 0)
+		c.Check(msg.RecursionAvailable, check.Equals, false)
+		c.Check(msg.Authoritative, check.Equals, false)
+	}
+}
+
+func (t *RouteTests) TestNameWithoutType(c *check.C) {
+	defaults := answers[DEFAULT_KEY]
+	defaults.Cname = map[string]RecordCname{"alias.rancher.internal.": {Answer: "web.rancher.internal."}}
+	defaults.Txt = map[string]RecordTxt{"info.rancher.internal.": {Answer: []string{"hello"}}}
+	defaults.A["web.example.com."] = RecordA{Answer: []string{"10.1.5.1"}}
+	answers[DEFAULT_KEY] = defaults
+
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+		zone  string
+	}{
+		{"web.rancher.internal.", dns.TypeMX, "rancher.internal."},
+		{"alias.rancher.internal.", dns.TypeTXT, "rancher.internal."},
+		{"info.rancher.internal.", dns.TypeA, "rancher.internal."},
+		{"info.rancher.internal.", dns.TypeSRV, "rancher.internal."},
+		// Not a zone we are authoritative for, so there is no SOA to send
+		{"web.example.com.", dns.TypeMX, ""},
+	} {
+		comment := check.Commentf("%s %s", q.name, dns.TypeToString[q.qtype])
+		msg := query("10.1.1.1", q.name, q.qtype)
+		c.Assert(msg, check.NotNil, comment)
+		c.Check(msg.Rcode, check.Equals, dns.RcodeSuccess, comment)
+		c.Check(msg.Answer, check.HasLen, 0, comment)
+		if q.zone == "" {
+			c.Check(msg.Ns, check.HasLen, 0, comment)
+			continue
+		}
+		c.Assert(msg.Ns, check.HasLen, 1, comment)
+		c.Check(msg.Ns[0].Header().Name, check.Equals, q.zone, comment)
+	}
+
+	// Names we have nothing at all for are still NXDOMAIN
+	msg := query("10.1.1.1", "nothing.rancher.internal.", dns.TypeMX)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeNameError)
+}
+
+func (t *RouteTests) TestMaxResponseBytes(c *check.C) {
+	req := new(dns.Msg)
+	req.SetQuestion("big.rancher.internal.", dns.TypeA)
+	req.SetEdns0(4096, false)
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	for i := 0; i < 40; i++ {
+		hdr := dns.RR_Header{Name: "big.rancher.internal.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.IPv4(10, 1, 6, byte(i))})
+	}
+	c.Assert(m.Len() > 512, check.Equals, true)
+
+	w := newTestWriter("10.1.1.1")
+	Respond(w, req, m.Copy())
+	c.Check(w.msg.Truncated, check.Equals, false)
+	c.Check(w.msg.Answer, check.HasLen, 40)
+
+	*maxResponse = 512
+	defer func() { *maxResponse = 0 }()
+	w = newTestWriter("10.1.1.1")
+	Respond(w, req, m.Copy())
+	c.Check(w.msg.Truncated, check.Equals, true)
+	c.Check(w.msg.Len() <= 512, check.Equals, true)
+}
+
+func (t *RouteTests) TestDrainIp(c *check.C) {
+	*drainFile = filepath.Join(c.MkDir(), "drained.json")
+	defer func() {
+		*drainFile = ""
+		drained = map[string]map[string]bool{}
+	}()
+
+	c.Assert(setDrained("10.1.3.1", true), check.IsNil)
+	c.Assert(setDrained("10.1.2.3", true), check.IsNil)
+	c.Check(setDrained("not-an-ip", true), check.NotNil)
+
+	for i := 0; i < 20; i++ {
+		clearClientSpecificCaches()
+		msg := query("10.1.1.1", "pool.rancher.internal.", dns.TypeA)
+		c.Assert(msg, check.NotNil)
+		c.Assert(msg.Answer, check.HasLen, 3)
+		for _, rr := range msg.Answer {
+			c.Check(rr.(*dns.A).A.String(), check.Not(check.Equals), "10.1.3.1")
+		}
+	}
+
+	// With its only address drained the name has no data
+	msg := query("10.1.1.1", "web.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeSuccess)
+	c.Check(msg.Answer, check.HasLen, 0)
+
+	// The list survives a restart
+	drained = map[string]map[string]bool{}
+	c.Assert(loadDrained(*drainFile), check.IsNil)
+	c.Check(drainedIps(), check.DeepEquals, []string{"10.1.2.3", "10.1.3.1"})
+
+	c.Assert(setDrained("10.1.2.3", false), check.IsNil)
+	msg = query("10.1.1.1", "web.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Answer, check.HasLen, 1)
+
+	// Files from before drains had origins are lists of addresses
+	c.Assert(ioutil.WriteFile(*drainFile, []byte(`["10.1.3.2"]`), 0644), check.IsNil)
+	c.Assert(loadDrained(*drainFile), check.IsNil)
+	c.Check(drainedOrigins(), check.DeepEquals, map[string][]string{"10.1.3.2": {DRAIN_BY_IP}})
+}
+
+func (t *RouteTests) TestWildcardNoData(c *check.C) {
+	def := answers[DEFAULT_KEY]
+	def.A["*.apps.rancher.internal."] = RecordA{Answer: []string{"10.1.5.1"}}
+
+	msg := query("10.1.1.1", "foo.apps.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].Header().Name, check.Equals, "foo.apps.rancher.internal.")
+
+	// The wildcard covers the name for TXT too, so there is no data rather than no such name
+	msg = query("10.1.1.1", "foo.apps.rancher.internal.", dns.TypeTXT)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeSuccess)
+	c.Check(msg.Answer, check.HasLen, 0)
+	c.Assert(msg.Ns, check.HasLen, 1)
+	soa, ok := msg.Ns[0].(*dns.SOA)
+	c.Assert(ok, check.Equals, true)
+	c.Check(soa.Hdr.Name, check.Equals, "rancher.internal.")
+
+	msg = query("10.1.1.1", "foo.other.rancher.internal.", dns.TypeTXT)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeNameError)
+
+	// A name with only names under it exists too, so the wildcard covers neither it nor the names below it
+	def.A["a.b.apps.rancher.internal."] = RecordA{Answer: []string{"10.1.5.2"}}
+	prepareAnswers(answers)
+	msg = query("10.1.1.1", "x.b.apps.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeNameError)
+	c.Check(msg.Answer, check.HasLen, 0)
+
+	msg = query("10.1.1.1", "b.apps.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeSuccess)
+	c.Check(msg.Answer, check.HasLen, 0)
+	c.Check(msg.Ns, check.HasLen, 1)
+}
+
+func (t *RouteTests) TestOutOfZoneWithoutRd(c *check.C) {
+	upstream, queries, stop := startUpstream(c)
+	defer stop()
+	def := answers[DEFAULT_KEY]
+	def.Recurse = []string{upstream}
+	answers[DEFAULT_KEY] = def
+
+	*refuseNoRec = true
+	defer func() { *refuseNoRec = false }()
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.RecursionDesired = false
+	msg := send("10.1.1.1", req)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeRefused)
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(0))
+
+	// In our zone it is still answered
+	req.SetQuestion("web.rancher.internal.", dns.TypeA)
+	req.RecursionDesired = false
+	msg = send("10.1.1.1", req)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Answer, check.HasLen, 1)
+
+	// Once cached, the answer for a query with RD isn't served without it
+	msg = query("10.1.1.1", "example.com.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Answer, check.HasLen, 1)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.RecursionDesired = false
+	msg = send("10.1.1.1", req)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeRefused)
+
+	// Only with --refuse-norec
+	*refuseNoRec = false
+	req.SetQuestion("example.org.", dns.TypeA)
+	req.RecursionDesired = false
+	msg = send("10.1.1.1", req)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeSuccess)
+	c.Check(msg.Answer, check.HasLen, 1)
+}
+
+func (t *RouteTests) TestShadowAnswers(c *check.C) {
+	shadowAnswers = Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"web.rancher.internal.":  {Answer: []string{"10.1.2.4"}},
+				"pool.rancher.internal.": {Answer: []string{"10.1.3.4", "10.1.3.3", "10.1.3.2", "10.1.3.1"}},
+			},
+		},
+	}
+	defer func() { shadowAnswers = nil }()
+
+	same := shadowResults.Get("same")
+	different := shadowResults.Get("different")
+
+	compareShadow(answers, "10.1.1.1", dns.Question{Name: "pool.rancher.internal.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	c.Check(shadowResults.Get("same"), check.Equals, same+1)
+
+	compareShadow(answers, "10.1.1.1", dns.Question{Name: "web.rancher.internal.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	c.Check(shadowResults.Get("different"), check.Equals, different+1)
+
+	// Limits and weighted CNAME targets are random picks, what is compared is everything they pick from
+	live := answers[DEFAULT_KEY]
+	live.A["limited.rancher.internal."] = RecordA{Answer: []string{"10.1.4.1", "10.1.4.2", "10.1.4.3"}, Limit: 1}
+	live.Cname = map[string]RecordCname{"split.rancher.internal.": {Targets: map[string]int{"a.example.com.": 1, "b.example.com.": 1}}}
+	answers[DEFAULT_KEY] = live
+	shadowAnswers[DEFAULT_KEY].A["limited.rancher.internal."] = RecordA{Answer: []string{"10.1.4.3", "10.1.4.2", "10.1.4.1"}, Limit: 1}
+	shadow := shadowAnswers[DEFAULT_KEY]
+	shadow.Cname = map[string]RecordCname{"split.rancher.internal.": {Targets: map[string]int{"b.example.com.": 3, "a.example.com.": 1}}}
+	shadowAnswers[DEFAULT_KEY] = shadow
+	for i := 0; i < 20; i++ {
+		compareShadow(answers, "10.1.1.1", dns.Question{Name: "limited.rancher.internal.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		compareShadow(answers, "10.1.1.1", dns.Question{Name: "split.rancher.internal.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET})
+	}
+	c.Check(shadowResults.Get("same"), check.Equals, same+41)
+	c.Check(shadowResults.Get("different"), check.Equals, different+1)
+
+	shadowAnswers[DEFAULT_KEY].A["limited.rancher.internal."] = RecordA{Answer: []string{"10.1.4.1", "10.1.4.2"}, Limit: 1}
+	compareShadow(answers, "10.1.1.1", dns.Question{Name: "limited.rancher.internal.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	c.Check(shadowResults.Get("different"), check.Equals, different+2)
+
+	// Without a worker taking them, comparisons past the queue's size are dropped
+	shadowQueue = make(chan shadowJob, 1)
+	defer func() { shadowQueue = nil }()
+	dropped := shadowResults.Get("dropped")
+	queueShadow(answers, "10.1.1.1", dns.Question{Name: "web.rancher.internal.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	queueShadow(answers, "10.1.1.1", dns.Question{Name: "web.rancher.internal.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	c.Check(len(shadowQueue), check.Equals, 1)
+	c.Check(shadowResults.Get("dropped"), check.Equals, dropped+1)
+
+	// The live answer is what the client gets
+	msg := query("10.1.1.1", "web.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "10.1.2.3")
+}
+
+func (t *RouteTests) TestTtlFloor(c *check.C) {
+	upstream, _, stop := startUpstream(c)
+	defer stop()
+	def := answers[DEFAULT_KEY]
+	def.Recurse = []string{upstream}
+	def.Cname = map[string]RecordCname{"ext.rancher.internal.": {Answer: "example.com."}}
+	answers[DEFAULT_KEY] = def
+	answers["10.1.1.3"] = ClientAnswers{TtlFloor: 300}
+
+	// Upstream answers with a TTL of 60
+	msg := query("10.1.1.1", "example.com.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].Header().Ttl, check.Equals, uint32(60))
+
+	// From the cache, for the client with a floor only
+	msg = query("10.1.1.3", "example.com.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].Header().Ttl, check.Equals, uint32(300))
+
+	msg = query("10.1.1.1", "example.com.", dns.TypeA)
+	c.Check(msg.Answer[0].Header().Ttl, check.Equals, uint32(60))
+
+	// Recursion for a CNAME target too, local records keep their TTL
+	msg = query("10.1.1.3", "ext.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 2)
+	c.Check(msg.Answer[0].Header().Ttl, check.Equals, uint32(*defaultTtl))
+	c.Check(msg.Answer[1].Header().Ttl, check.Equals, uint32(300))
+}
+
+func (t *RouteTests) TestIncludeAuthorityNs(c *check.C) {
+	msg := query("10.1.1.1", "web.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Ns, check.HasLen, 0)
+
+	*authorityNs = true
+	*nameservers = "ns1.rancher.internal,ns2.rancher.internal."
+	defer func() {
+		*authorityNs = false
+		*nameservers = ""
+	}()
+	clearClientSpecificCaches()
+
+	msg = query("10.1.1.1", "web.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Answer, check.HasLen, 1)
+	c.Assert(msg.Ns, check.HasLen, 2)
+	for i, server := range []string{"ns1.rancher.internal.", "ns2.rancher.internal."} {
+		ns := msg.Ns[i].(*dns.NS)
+		c.Check(ns.Hdr.Name, check.Equals, "rancher.internal.")
+		c.Check(ns.Ns, check.Equals, server)
+	}
+
+	// Only for our own zones
+	defaults := answers[DEFAULT_KEY]
+	defaults.A["web.example.com."] = RecordA{Answer: []string{"10.1.5.1"}}
+	msg = query("10.1.1.1", "web.example.com.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Ns, check.HasLen, 0)
+}
+
+func (t *RouteTests) TestCacheScope(c *check.C) {
+	inside, _, stopInside := startUpstreamAnswering(c, "10.8.0.1")
+	defer stopInside()
+	outside, _, stopOutside := startUpstreamAnswering(c, "8.8.0.1")
+	defer stopOutside()
+
+	answers["10.1.1.2"] = ClientAnswers{Recurse: []string{inside}}
+	answers["10.1.1.3"] = ClientAnswers{Recurse: []string{inside}}
+	answers["10.1.1.4"] = ClientAnswers{Recurse: []string{outside}}
+
+	resolved := func(clientIp string) string {
+		msg := query(clientIp, "split.example.com.", dns.TypeA)
+		c.Assert(msg, check.NotNil)
+		c.Assert(msg.Answer, check.HasLen, 1)
+		return msg.Answer[0].(*dns.A).A.String()
+	}
+
+	// Shared, the first client's view leaks to everyone
+	c.Check(resolved("10.1.1.2"), check.Equals, "10.8.0.1")
+	c.Check(resolved("10.1.1.4"), check.Equals, "10.8.0.1")
+
+	defer func() { *cacheScope = CACHE_SHARED }()
+	for _, scope := range []string{CACHE_VIEW, CACHE_CLIENT} {
+		*cacheScope = scope
+		globalCache = cache.New(int(*cacheCapacity), int(*defaultTtl))
+		c.Check(resolved("10.1.1.2"), check.Equals, "10.8.0.1")
+		c.Check(resolved("10.1.1.4"), check.Equals, "8.8.0.1")
+		c.Check(resolved("10.1.1.3"), check.Equals, "10.8.0.1")
+	}
+
+	// With view scope, clients that recurse the same way share the response
+	req := new(dns.Msg)
+	req.SetQuestion("split.example.com.", dns.TypeA)
+	*cacheScope = CACHE_VIEW
+	c.Check(globalCacheKey(answers, "10.1.1.2", req), check.Equals, globalCacheKey(answers, "10.1.1.3", req))
+	c.Check(globalCacheKey(answers, "10.1.1.2", req), check.Not(check.Equals), globalCacheKey(answers, "10.1.1.4", req))
+}
+
+func (t *RouteTests) TestRefuseTypes(c *check.C) {
+	refusedTypes = map[uint16]bool{dns.TypeAXFR: true, dns.TypeMX: true}
+	defer func() { refusedTypes = map[uint16]bool{} }()
+
+	before := refusedByType.Get("MX")
+	msg := query("10.1.1.1", "web.rancher.internal.", dns.TypeMX)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeRefused)
+	c.Check(refusedByType.Get("MX"), check.Equals, before+1)
+
+	msg = query("10.1.1.1", "web.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeSuccess)
+}
+
+func (t *RouteTests) TestStatusName(c *check.C) {
+	msg := query("127.0.0.1", "_rancher-dns-status.", dns.TypeTXT)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Not(check.Equals), dns.RcodeSuccess)
+
+	*statusName = "_rancher-dns-status"
+	defer func() {
+		*statusName = ""
+		parseStatusClients(*statusAllow)
+	}()
+	c.Assert(parseStatusClients("127.0.0.1,10.1.2.0/24"), check.IsNil)
+
+	msg = query("10.1.2.7", "_rancher-dns-status.", dns.TypeTXT)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeSuccess)
+	lines := map[string]bool{}
+	for _, rr := range msg.Answer {
+		lines[strings.SplitN(rr.(*dns.TXT).Txt[0], "=", 2)[0]] = true
+	}
+	for _, key := range []string{"version", "uptime", "last-reload", "clients", "records", "offline"} {
+		c.Check(lines[key], check.Equals, true, check.Commentf(key))
+	}
+
+	msg = query("10.1.1.1", "_rancher-dns-status.", dns.TypeTXT)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeRefused)
+	c.Check(msg.Answer, check.HasLen, 0)
+}
+
+func (t *RouteTests) TestFallbackRecurse(c *check.C) {
+	upstream, queries, stop := startUpstream(c)
+	defer stop()
+
+	// Nothing listens on this port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	healthPort, _ := strconv.Atoi(port)
+
+	health = newHealthChecker()
+	defer func() { health = newHealthChecker() }()
+	health.check(net.JoinHostPort("127.0.0.1", port))
+
+	defaults := answers[DEFAULT_KEY]
+	defaults.Recurse = []string{upstream}
+	defaults.A["hybrid.rancher.internal."] = RecordA{Answer: []string{"127.0.0.1"}, HealthPort: healthPort, FallbackRecurse: true}
+	defaults.A["local.rancher.internal."] = RecordA{Answer: []string{"127.0.0.1"}, HealthPort: healthPort}
+	answers[DEFAULT_KEY] = defaults
+
+	msg := query("10.1.1.1", "hybrid.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "9.9.9.9")
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(1))
+
+	// Without the fallback, dead addresses are better than none
+	msg = query("10.1.1.1", "local.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "127.0.0.1")
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(1))
+}
+
+func (t *RouteTests) TestFailoverLabel(c *check.C) {
+	upstream, queries, stop := startUpstream(c)
+	defer stop()
+
+	defaults := answers[DEFAULT_KEY]
+	defaults.Recurse = []string{upstream}
+	defaults.A["db.rancher.internal."] = RecordA{Answer: []string{"10.1.5.1"}, Labels: map[string]string{"env": "prod", "dc": "us-east"}}
+	defaults.A["dev.rancher.internal."] = RecordA{Answer: []string{"10.1.5.2"}, Labels: map[string]string{"env": "dev"}}
+	answers[DEFAULT_KEY] = defaults
+	defer func() { failovers = map[string]map[string]string{} }()
+
+	msg := query("10.1.1.1", "db.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "10.1.5.1")
+
+	w := httptest.NewRecorder()
+	httpSetFailoverLabel(true)(w, httptest.NewRequest("POST", "/v1/failover-label?selector=env=prod", nil))
+	c.Check(w.Code, check.Equals, 200)
+	c.Check(failoverSelectors(), check.DeepEquals, []string{"env=prod"})
+
+	// Only the matching record is answered by the recursive servers now
+	msg = query("10.1.1.1", "db.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "9.9.9.9")
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(1))
+	msg = query("10.1.1.1", "dev.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "10.1.5.2")
+
+	w = httptest.NewRecorder()
+	httpSetFailoverLabel(false)(w, httptest.NewRequest("DELETE", "/v1/failover-label?selector=env=prod", nil))
+	c.Check(failoverSelectors(), check.HasLen, 0)
+	msg = query("10.1.1.1", "db.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "10.1.5.1")
+
+	w = httptest.NewRecorder()
+	httpSetFailoverLabel(true)(w, httptest.NewRequest("POST", "/v1/failover-label?selector=env", nil))
+	c.Check(w.Code, check.Equals, 400)
+}
+
+func (t *RouteTests) TestInstance(c *check.C) {
+	dir := c.MkDir()
+	file := filepath.Join(dir, "green.json")
+	writeFile(c, dir, "green.json", `{"default": {"a": {"web.rancher.internal.": {"answer": ["10.5.5.5"]}}}}`)
+
+	inst, err := parseInstance("listen=127.0.0.1:0, answers=" + file + ", name=green")
+	c.Assert(err, check.IsNil)
+	mainReport := lastValidation()
+	c.Assert(inst.load(), check.IsNil)
+
+	greenFor := func(name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		w := newTestWriter("10.1.1.1")
+		inst.route(w, req)
+		return w.msg
+	}
+	green := func() *dns.Msg {
+		return greenFor("web.rancher.internal.")
+	}
+
+	// The main answers and the instance's, each cached separately for the same client
+	for i := 0; i < 2; i++ {
+		msg := query("10.1.1.1", "web.rancher.internal.", dns.TypeA)
+		c.Assert(msg.Answer, check.HasLen, 1)
+		c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "10.1.2.3")
+
+		msg = green()
+		c.Assert(msg.Answer, check.HasLen, 1)
+		c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "10.5.5.5")
+	}
+
+	// Reloading the instance leaves the main answers alone
+	writeFile(c, dir, "green.json", `{"default": {"a": {"web.rancher.internal.": {"answer": ["10.6.6.6"]}}}}`)
+	c.Assert(inst.load(), check.IsNil)
+	c.Check(green().Answer[0].(*dns.A).A.String(), check.Equals, "10.6.6.6")
+	c.Check(query("10.1.1.1", "web.rancher.internal.", dns.TypeA).Answer[0].(*dns.A).A.String(), check.Equals, "10.1.2.3")
+
+	// A file that doesn't load keeps the previous answers
+	writeFile(c, dir, "green.json", `{"default": {"patterns": [{"match": "web.", "answer": "10.7.7.7"}]}}`)
+	c.Check(inst.load(), check.NotNil)
+	c.Check(green().Answer[0].(*dns.A).A.String(), check.Equals, "10.6.6.6")
+
+	// The instance has a validation report of its own
+	report := inst.validation.report()
+	c.Check(report.Errors, check.Equals, 1)
+	c.Assert(report.Issues, check.HasLen, 1)
+	c.Check(report.Issues[0].Path, check.Equals, file)
+	c.Check(lastValidation(), check.DeepEquals, mainReport)
+
+	// The zone directory is merged in like it is into the main answers
+	zones := c.MkDir()
+	writeFile(c, zones, "example.org.json", `{"a": {"www": {"answer": ["10.8.8.8"]}}}`)
+	*answersDir = zones
+	defer func() { *answersDir = "" }()
+	writeFile(c, dir, "green.json", `{"default": {"a": {"web.rancher.internal.": {"answer": ["10.6.6.6"]}}}}`)
+	c.Assert(inst.load(), check.IsNil)
+	c.Check(inst.validation.report().Errors, check.Equals, 0)
+	msg := greenFor("www.example.org.")
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "10.8.8.8")
+
+	_, err = parseInstance("listen=:5354")
+	c.Check(err, check.NotNil)
+	_, err = parseInstance("listen=:5354,answers=x.json,color=green")
+	c.Check(err, check.NotNil)
+	c.Check(parseInstances([]string{"listen=:5354,answers=a.json", "listen=:5354,answers=b.json"}), check.NotNil)
+	instances = nil
+}
+
+func (t *RouteTests) TestEcsProximity(c *check.C) {
+	c.Assert(parseEcsForwarders("10.1.1.1"), check.IsNil)
+	defer parseEcsForwarders("")
+
+	withSubnet := func(clientIp, subnet string, mask uint8) []string {
+		req := new(dns.Msg)
+		req.SetQuestion("pool.rancher.internal.", dns.TypeA)
+		req.SetEdns0(4096, false)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: mask, Address: net.ParseIP(subnet)})
+		msg := send(clientIp, req)
+		c.Assert(msg.Answer, check.HasLen, 4)
+		var out []string
+		for _, rr := range msg.Answer {
+			out = append(out, rr.(*dns.A).A.String())
+		}
+		return out
+	}
+
+	// Twice, the second answer coming from the cache
+	for i := 0; i < 2; i++ {
+		c.Check(withSubnet("10.1.1.1", "10.1.3.3", 32)[0], check.Equals, "10.1.3.3")
+		c.Check(withSubnet("10.1.1.1", "10.1.3.2", 32)[0], check.Equals, "10.1.3.2")
+	}
+
+	// Only the leading bits of the subnet count, so the addresses closest to .4 are all as near as each other
+	c.Check(withSubnet("10.1.1.1", "10.1.3.4", 30)[0], check.Equals, "10.1.3.4")
+	first := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		first[withSubnet("10.1.1.1", "10.1.3.0", 24)[0]] = true
+	}
+	c.Check(len(first) > 1, check.Equals, true)
+
+	// Untrusted clients can't choose
+	seen := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		seen[withSubnet("10.1.1.9", "10.1.3.3", 32)[0]] = true
+	}
+	c.Check(len(seen) > 1, check.Equals, true)
+}
+
+func (t *RouteTests) TestTraceResolution(c *check.C) {
+	upstream, _, stop := startUpstream(c)
+	defer stop()
+
+	def := answers[DEFAULT_KEY]
+	def.Recurse = []string{upstream}
+	def.Cname = map[string]RecordCname{"app.rancher.internal.": {Answer: "example.com."}}
+	answers[DEFAULT_KEY] = def
+
+	*traceResolution = true
+	*traceNames = "rancher.internal"
+	defer func() {
+		*traceResolution = false
+		*traceNames = ""
+	}()
+	c.Check(traceEnabled("app.rancher.internal."), check.Equals, true)
+	c.Check(traceEnabled("example.com."), check.Equals, false)
+
+	w := newTestWriter("10.1.1.1")
+	question := dns.Question{Name: "app.rancher.internal.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	ctx, _ := startTrace(context.Background(), w, "10.1.1.1", question)
+	records, ok := answers.Addresses(ctx, "10.1.1.1", "app.rancher.internal.", nil, 1)
+	c.Assert(ok, check.Equals, true)
+	c.Check(records, check.HasLen, 2)
+
+	trace := ctx.Value(traceKey{}).(*resolutionTrace)
+	c.Check(trace.hops, check.DeepEquals, []string{
+		"CNAME app.rancher.internal. to example.com. local (default)",
+		"A example.com. recursed to " + upstream + ": NOERROR, 1 records",
+	})
+
+	// The whole query, logged once it is answered
+	msg := query("10.1.1.1", "app.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Answer, check.HasLen, 2)
+}
+
+func (t *RouteTests) TestChaosDelay(c *check.C) {
+	c.Assert(parseChaosDelays([]string{"name=web.rancher.internal,ms=50", "client=10.1.1.9,ms=100"}), check.IsNil)
+	defer parseChaosDelays(nil)
+
+	c.Check(chaosDelayFor("10.1.1.1", "web.rancher.internal."), check.Equals, 50*time.Millisecond)
+	c.Check(chaosDelayFor("10.1.1.9", "web.rancher.internal."), check.Equals, 100*time.Millisecond)
+	c.Check(chaosDelayFor("10.1.1.1", "pool.rancher.internal."), check.Equals, time.Duration(0))
+
+	start := time.Now()
+	msg := query("10.1.1.1", "web.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Answer, check.HasLen, 1)
+	c.Check(time.Since(start) >= 50*time.Millisecond, check.Equals, true)
+
+	// Given up on, nothing is sent
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := newTestWriter("10.1.1.1")
+	err := (&chaosResponseWriter{ResponseWriter: w, ctx: ctx, delay: time.Hour}).WriteMsg(new(dns.Msg))
+	c.Check(err, check.NotNil)
+	c.Check(w.msg, check.IsNil)
+
+	// Nor when the deadline passes first
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	err = (&chaosResponseWriter{ResponseWriter: w, ctx: ctx, delay: time.Hour}).WriteMsg(new(dns.Msg))
+	c.Check(err, check.Equals, context.DeadlineExceeded)
+	c.Check(w.msg, check.IsNil)
+	c.Check(time.Since(start) < time.Second, check.Equals, true)
+
+	// Without one, --recurser-timeout is the deadline
+	*recurserTimeout = 1
+	defer func() { *recurserTimeout = 2 }()
+	start = time.Now()
+	err = (&chaosResponseWriter{ResponseWriter: w, ctx: context.Background(), delay: time.Hour}).WriteMsg(new(dns.Msg))
+	c.Check(err, check.Equals, context.DeadlineExceeded)
+	c.Check(w.msg, check.IsNil)
+	c.Check(time.Since(start) < 2*time.Second, check.Equals, true)
+
+	for _, spec := range []string{"ms=50", "name=x.,ms=0", "name=x.", "name=x.,ms=5,color=red", "client=nope,ms=5"} {
+		c.Check(parseChaosDelays([]string{spec}), check.NotNil, check.Commentf(spec))
+	}
+}
+
+func (t *RouteTests) TestWhoami(c *check.C) {
+	*whoamiName = "whoami.rancher.internal"
+	defer func() {
+		*whoamiName = ""
+		*whoamiSource = WHOAMI_TRANSPORT
+	}()
+
+	msg := query("10.1.2.7", "whoami.rancher.internal.", dns.TypeA)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "10.1.2.7")
+	c.Check(msg.Answer[0].Header().Ttl, check.Equals, uint32(0))
+
+	msg = query("10.1.2.7", "whoami.rancher.internal.", dns.TypeTXT)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.TXT).Txt, check.DeepEquals, []string{"10.1.2.7"})
+
+	// An IPv4 client has no AAAA
+	msg = query("10.1.2.7", "whoami.rancher.internal.", dns.TypeAAAA)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeSuccess)
+	c.Check(msg.Answer, check.HasLen, 0)
+
+	msg = query("fd00::7", "whoami.rancher.internal.", dns.TypeAAAA)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.AAAA).AAAA.String(), check.Equals, "fd00::7")
+
+	*whoamiSource = WHOAMI_ECS
+	req := new(dns.Msg)
+	req.SetQuestion("whoami.rancher.internal.", dns.TypeTXT)
+	req.SetEdns0(4096, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.77")})
+	msg = send("10.1.2.7", req)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.TXT).Txt, check.DeepEquals, []string{"192.0.2.0/24"})
+
+	// Without a subnet, where it came from
+	msg = query("10.1.2.7", "whoami.rancher.internal.", dns.TypeA)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "10.1.2.7")
+}
+
+func (t *RouteTests) TestQueryTimeout(c *check.C) {
+	// Reads queries and never answers them
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer pc.Close()
+
+	def := answers[DEFAULT_KEY]
+	def.Recurse = []string{pc.LocalAddr().String()}
+	answers[DEFAULT_KEY] = def
+	answers["10.1.1.3"] = ClientAnswers{Timeout: 100}
+
+	start := time.Now()
+	msg := query("10.1.1.3", "example.com.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeServerFailure)
+	c.Check(time.Since(start) < time.Second, check.Equals, true)
+
+	// Local answers are well within the time
+	msg = query("10.1.1.3", "web.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Answer, check.HasLen, 1)
+
+	c.Check(answers.QueryTimeout("10.1.1.3"), check.Equals, 100*time.Millisecond)
+	c.Check(answers.QueryTimeout("10.1.1.1"), check.Equals, *queryTimeout)
+	def.Timeout = 2000
+	answers[DEFAULT_KEY] = def
+	c.Check(answers.QueryTimeout("10.1.1.1"), check.Equals, 2*time.Second)
+}
+
+func (t *RouteTests) TestRecurseWhenUp(c *check.C) {
+	upstream, queries, stop := startUpstream(c)
+	defer stop()
+
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer up.Close()
+
+	// Nothing listens on this one
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	down := l.Addr().String()
+	l.Close()
+
+	health = newHealthChecker()
+	defer func() { health = newHealthChecker() }()
+	health.check(up.Addr().String())
+	health.check(down)
+
+	defaults := answers[DEFAULT_KEY]
+	defaults.Recurse = []string{upstream}
+	defaults.A["shop.rancher.internal."] = RecordA{Answer: []string{"10.5.5.5"}, RecurseWhenUp: up.Addr().String()}
+	defaults.A["closed.rancher.internal."] = RecordA{Answer: []string{"10.5.5.5"}, RecurseWhenUp: down}
+	answers[DEFAULT_KEY] = defaults
+
+	msg := query("10.1.1.1", "shop.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "9.9.9.9")
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(1))
+
+	// The maintenance address while the service is down
+	msg = query("10.1.1.1", "closed.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "10.5.5.5")
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(1))
+
+	c.Check(validateGate("10.9.0.1"), check.NotNil)
+	c.Check(validateGate("10.9.0.1:0"), check.NotNil)
+	c.Check(validateGate("10.9.0.1:443"), check.IsNil)
+}
+
+func (t *RouteTests) TestZoneApex(c *check.C) {
+	upstream, queries, stop := startUpstream(c)
+	defer stop()
+	def := answers[DEFAULT_KEY]
+	def.Recurse = []string{upstream}
+	answers[DEFAULT_KEY] = def
+
+	msg := query("10.1.1.1", "rancher.internal.", dns.TypeSOA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeSuccess)
+	c.Check(msg.Authoritative, check.Equals, true)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	soa := msg.Answer[0].(*dns.SOA)
+	c.Check(soa.Hdr.Name, check.Equals, "rancher.internal.")
+	c.Check(soa.Ns, check.Equals, "rancher.internal.")
+
+	msg = query("10.1.1.1", "Rancher.Internal.", dns.TypeNS)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Authoritative, check.Equals, true)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.NS).Ns, check.Equals, "rancher.internal.")
+
+	// No A record at the apex: NODATA, never recursed
+	msg = query("10.1.1.1", "rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeSuccess)
+	c.Check(msg.Authoritative, check.Equals, true)
+	c.Check(msg.Answer, check.HasLen, 0)
+	c.Assert(msg.Ns, check.HasLen, 1)
+	c.Check(msg.Ns[0].Header().Rrtype, check.Equals, dns.TypeSOA)
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(0))
+
+	// With one, it is answered like any other name
+	def.A["rancher.internal."] = RecordA{Answer: []string{"10.1.0.1"}}
+	clearClientSpecificCaches()
+	msg = query("10.1.1.1", "rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "10.1.0.1")
+}
+
+func (t *RouteTests) TestStaleRefresh(c *check.C) {
+	upstream, queries, stop := startUpstream(c)
+	defer stop()
+	def := answers[DEFAULT_KEY]
+	def.Recurse = []string{upstream}
+	answers[DEFAULT_KEY] = def
+
+	// Every entry is expired as soon as it is cached
+	globalCache = cache.New(int(*cacheCapacity), 0)
+	staleRefresh = newRefreshPool(1)
+	defer func() { staleRefresh = nil }()
+
+	msg := query("10.1.1.1", "example.com.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(1))
+
+	// Upstream's answer changes
+	changed, changedQueries, stopChanged := startUpstreamAnswering(c, "8.8.8.8")
+	defer stopChanged()
+	def.Recurse = []string{changed}
+	answers[DEFAULT_KEY] = def
+
+	// The stale answer is served right away, with upstream asked again in the background
+	refreshed := staleRefreshes.Get("refreshed")
+	msg = query("10.1.1.1", "example.com.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "9.9.9.9")
+	for i := 0; i < 100 && staleRefreshes.Get("refreshed") == refreshed; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(staleRefreshes.Get("refreshed"), check.Equals, refreshed+1)
+	c.Check(atomic.LoadInt32(changedQueries), check.Equals, int32(1))
+
+	// And then the refreshed one
+	msg = query("10.1.1.1", "example.com.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "8.8.8.8")
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(1))
+}
+
+func (t *RouteTests) TestStaleRefreshDns64(c *check.C) {
+	upstream, _, stop := startUpstream(c)
+	defer stop()
+	def := answers[DEFAULT_KEY]
+	def.Recurse = []string{upstream}
+	answers[DEFAULT_KEY] = def
+
+	c.Assert(parseDns64Prefix("64:ff9b::/96"), check.IsNil)
+	defer func() { dns64Prefix = nil }()
+	globalCache = cache.New(int(*cacheCapacity), 0)
+	staleRefresh = newRefreshPool(1)
+	defer func() { staleRefresh = nil }()
+
+	msg := query("10.1.1.1", "example.com.", dns.TypeAAAA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.AAAA).AAAA.String(), check.Equals, "64:ff9b::909:909")
+
+	changed, _, stopChanged := startUpstreamAnswering(c, "8.8.8.8")
+	defer stopChanged()
+	def.Recurse = []string{changed}
+	answers[DEFAULT_KEY] = def
+
+	refreshed := staleRefreshes.Get("refreshed")
+	msg = query("10.1.1.1", "example.com.", dns.TypeAAAA)
+	c.Assert(msg, check.NotNil)
+	for i := 0; i < 100 && staleRefreshes.Get("refreshed") == refreshed; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(staleRefreshes.Get("refreshed"), check.Equals, refreshed+1)
+
+	// The refreshed entry is synthesized too
+	msg = query("10.1.1.1", "example.com.", dns.TypeAAAA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.AAAA).AAAA.String(), check.Equals, "64:ff9b::808:808")
+}
+
+func (t *RouteTests) TestRefreshPoolBounded(c *check.C) {
+	// No workers, so whatever is queued stays there
+	pool := &refreshPool{jobs: make(chan refreshJob, 2), pending: make(map[string]bool)}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	pool.Refresh("a", req, nil)
+	pool.Refresh("a", req, nil)
+	c.Check(pool.jobs, check.HasLen, 1)
+
+	dropped := staleRefreshes.Get("dropped")
+	pool.Refresh("b", req, nil)
+	pool.Refresh("c", req, nil)
+	c.Check(pool.jobs, check.HasLen, 2)
+	c.Check(staleRefreshes.Get("dropped"), check.Equals, dropped+1)
+}
+
+func (t *RouteTests) TestViews(c *check.C) {
+	defer func() { views, viewsSource = viewMap{}, nil }()
+	answers["blue"] = ClientAnswers{A: map[string]RecordA{"web.rancher.internal.": {Answer: []string{"10.7.7.7"}}}}
+
+	dir := c.MkDir()
+	file := filepath.Join(dir, "views.json")
+	writeFile(c, dir, "views.json", `{"10.1.1.5": "blue", "10.1.1.2": "blue", "10.2.0.0/16": "blue", "10.2.3.0/24": "missing"}`)
+	c.Assert(loadViews(file), check.IsNil)
+
+	answer := func(clientIp string) string {
+		msg := query(clientIp, "web.rancher.internal.", dns.TypeA)
+		c.Assert(msg, check.NotNil)
+		c.Assert(msg.Answer, check.HasLen, 1)
+		return msg.Answer[0].(*dns.A).A.String()
+	}
+	c.Check(answer("10.1.1.5"), check.Equals, "10.7.7.7")
+	c.Check(answer("10.2.9.9"), check.Equals, "10.7.7.7")
+	// Its own section wins, a view the answers don't have is the default
+	c.Check(answer("10.1.1.2"), check.Equals, "10.9.2.3")
+	c.Check(answer("10.2.3.4"), check.Equals, "10.1.2.3")
+	c.Check(answer("10.1.1.1"), check.Equals, "10.1.2.3")
+
+	// A mapping that can't be loaded keeps the previous one
+	writeFile(c, dir, "views.json", `{"10.1.1.5": `)
+	c.Check(loadViews(file), check.NotNil)
+	c.Check(answer("10.1.1.5"), check.Equals, "10.7.7.7")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"10.1.1.6": "blue"}`))
+	}))
+	defer server.Close()
+	c.Assert(loadViews(server.URL), check.IsNil)
+	c.Check(answer("10.1.1.6"), check.Equals, "10.7.7.7")
+	c.Check(answer("10.1.1.5"), check.Equals, "10.1.2.3")
+}
+
+func (t *RouteTests) TestDns64(c *check.C) {
+	upstream, queries, stop := startUpstream(c)
+	defer stop()
+	def := answers[DEFAULT_KEY]
+	def.Recurse = []string{upstream}
+	def.Cname = map[string]RecordCname{"www.rancher.internal.": {Answer: "web.rancher.internal."}}
+	answers[DEFAULT_KEY] = def
+
+	c.Assert(parseDns64Prefix("64:ff9b::/96"), check.IsNil)
+	defer func() { dns64Prefix = nil }()
+
+	msg := query("10.1.1.1", "www.rancher.internal.", dns.TypeAAAA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 2)
+	c.Check(msg.Answer[0].(*dns.CNAME).Target, check.Equals, "web.rancher.internal.")
+	c.Check(msg.Answer[1].(*dns.AAAA).AAAA.String(), check.Equals, "64:ff9b::a01:203")
+	c.Check(msg.Answer[1].Header().Name, check.Equals, "web.rancher.internal.")
+
+	// Upstream has no AAAA, so its A records are asked for too
+	msg = query("10.1.1.1", "example.com.", dns.TypeAAAA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.AAAA).AAAA.String(), check.Equals, "64:ff9b::909:909")
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(2))
+
+	// RFC 6052 examples
+	for prefix, expected := range map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::c000:221",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+	} {
+		_, network, _ := net.ParseCIDR(prefix)
+		c.Check(embedIpv4(network, net.ParseIP("192.0.2.33")).String(), check.Equals, expected, check.Commentf(prefix))
+	}
+	c.Check(parseDns64Prefix("64:ff9b::/100"), check.NotNil)
+	c.Check(parseDns64Prefix("10.0.0.0/8"), check.NotNil)
+}
+
+func (t *RouteTests) TestDns64RecursedTarget(c *check.C) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+		switch {
+		case q.Qtype == dns.TypeAAAA && q.Name == "gone.example.com.":
+			m.Rcode = dns.RcodeNameError
+		case q.Qtype == dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.ParseIP("9.9.9.9")})
+		case q.Qtype == dns.TypeAAAA && q.Name == "v6.example.com.":
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")})
+		}
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	def := answers[DEFAULT_KEY]
+	def.Recurse = []string{pc.LocalAddr().String()}
+	def.Cname = map[string]RecordCname{
+		"dual.rancher.internal.":  {Answer: "v6.example.com."},
+		"only4.rancher.internal.": {Answer: "v4.example.com."},
+	}
+	answers[DEFAULT_KEY] = def
+
+	c.Assert(parseDns64Prefix("64:ff9b::/96"), check.IsNil)
+	defer func() { dns64Prefix = nil }()
+
+	// The target has a real AAAA, nothing is synthesized
+	msg := query("10.1.1.1", "dual.rancher.internal.", dns.TypeAAAA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 2)
+	c.Check(msg.Answer[0].(*dns.CNAME).Target, check.Equals, "v6.example.com.")
+	c.Check(msg.Answer[1].(*dns.AAAA).AAAA.String(), check.Equals, "2001:db8::1")
+
+	// It has none, so its A records are synthesized from
+	msg = query("10.1.1.1", "only4.rancher.internal.", dns.TypeAAAA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 2)
+	c.Check(msg.Answer[0].(*dns.CNAME).Target, check.Equals, "v4.example.com.")
+	c.Check(msg.Answer[1].(*dns.AAAA).AAAA.String(), check.Equals, "64:ff9b::909:909")
+
+	// A name upstream says doesn't exist gets nothing synthesized, even though it is rewritten to NOERROR
+	msg = query("10.1.1.1", "gone.example.com.", dns.TypeAAAA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeSuccess)
+	c.Check(msg.Answer, check.HasLen, 0)
+}
+
+func (t *RouteTests) TestStableOrder(c *check.C) {
+	*stableOrder = true
+	defer func() { *stableOrder = false }()
+
+	// The first answer comes from the answers, the rest from the client-specific cache
+	for i := 0; i < 10; i++ {
+		msg := query("10.1.1.1", "pool.rancher.internal.", dns.TypeA)
+		c.Assert(msg, check.NotNil)
+		var addrs []string
+		for _, rr := range msg.Answer {
+			addrs = append(addrs, rr.(*dns.A).A.String())
+		}
+		c.Check(addrs, check.DeepEquals, []string{"10.1.3.1", "10.1.3.2", "10.1.3.3", "10.1.3.4"})
+	}
+}
+
+func (t *RouteTests) TestHealthChangeClearsCache(c *check.C) {
+	upstream, _, stop := startUpstream(c)
+	defer stop()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	addr := l.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+	healthPort, _ := strconv.Atoi(port)
+
+	health = newHealthChecker()
+	defer func() { health = newHealthChecker() }()
+	health.check(addr)
+
+	defaults := answers[DEFAULT_KEY]
+	defaults.Recurse = []string{upstream}
+	defaults.A["hybrid.rancher.internal."] = RecordA{Answer: []string{"127.0.0.1"}, HealthPort: healthPort, FallbackRecurse: true}
+	answers[DEFAULT_KEY] = defaults
+
+	msg := query("10.1.1.1", "hybrid.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "127.0.0.1")
+
+	// The cached answer goes as soon as the address is found down
+	l.Close()
+	health.check(addr)
+	msg = query("10.1.1.1", "hybrid.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "9.9.9.9")
+}
+
+func (t *RouteTests) TestOffline(c *check.C) {
+	upstream, queries, stop := startUpstream(c)
+	defer stop()
+	def := answers[DEFAULT_KEY]
+	def.Recurse = []string{upstream}
+	answers[DEFAULT_KEY] = def
+	defer setOffline(false)
+
+	msg := query("10.1.1.1", "example.com.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+
+	// An entry that has expired already, only good enough when offline
+	req := new(dns.Msg)
+	req.SetQuestion("stale.example.com.", dns.TypeA)
+	stale := new(dns.Msg)
+	stale.SetReply(req)
+	stale.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "stale.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0}, A: net.ParseIP("10.8.8.8")}}
+	addToGlobalCache(globalCacheKey(answers, "10.1.1.1", req), stale)
+
+	w := httptest.NewRecorder()
+	httpSetOffline(true)(w, httptest.NewRequest("POST", "/v1/offline", nil))
+	c.Check(isOffline(), check.Equals, true)
+	w = httptest.NewRecorder()
+	httpGetOffline(w, httptest.NewRequest("GET", "/v1/offline", nil))
+	c.Check(w.Body.String(), check.Equals, "true")
+
+	// Local and cached answers still work, expired ones included, and nothing is recursed
+	msg = query("10.1.1.1", "web.rancher.internal.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Answer, check.HasLen, 1)
+	msg = query("10.1.1.1", "example.com.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Answer, check.HasLen, 1)
+	msg = query("10.1.1.1", "stale.example.com.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Assert(msg.Answer, check.HasLen, 1)
+	c.Check(msg.Answer[0].(*dns.A).A.String(), check.Equals, "10.8.8.8")
+	msg = query("10.1.1.1", "other.example.com.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Rcode, check.Equals, dns.RcodeServerFailure)
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(1))
+
+	httpSetOffline(false)(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/v1/offline", nil))
+	c.Check(isOffline(), check.Equals, false)
+	msg = query("10.1.1.1", "other.example.com.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Answer, check.HasLen, 1)
+	c.Check(atomic.LoadInt32(queries), check.Equals, int32(2))
+}
+
+func (t *RouteTests) TestRecurseSource(c *check.C) {
+	c.Check(setRecurseSource("not-an-ip"), check.NotNil)
+	c.Check(setRecurseSource("192.0.2.55"), check.ErrorMatches, ".*not bound to a local interface")
+	c.Assert(setRecurseSource("127.0.0.1"), check.IsNil)
+	defer func() { recurseSourceIp = nil }()
+
+	// Upstream sees the queries come from the address
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	from := make(chan string, 1)
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		from <- host
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	def := answers[DEFAULT_KEY]
+	def.Recurse = []string{pc.LocalAddr().String()}
+	answers[DEFAULT_KEY] = def
+
+	msg := query("10.1.1.1", "example.com.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(<-from, check.Equals, "127.0.0.1")
+}
+
+func (t *RouteTests) TestAuthoritativeRecurse(c *check.C) {
+	upstream, _, stop := startUpstream(c)
+	defer stop()
+	def := answers[DEFAULT_KEY]
+	def.Recurse = []string{upstream}
+	answers[DEFAULT_KEY] = def
+
+	*aaRecurseZones = "example.com,corp.internal."
+	defer func() { *aaRecurseZones = "" }()
+
+	// Only recursive answers in the zones are marked authoritative
+	for name, aa := range map[string]bool{
+		"example.com.":       true,
+		"www.example.com.":   true,
+		"www.corp.internal.": true,
+		"example.org.":       false,
+		"notexample.com.":    false,
+	} {
+		msg := query("10.1.1.1", name, dns.TypeA)
+		c.Assert(msg, check.NotNil, check.Commentf(name))
+		c.Check(msg.Answer, check.HasLen, 1, check.Commentf(name))
+		c.Check(msg.Authoritative, check.Equals, aa, check.Commentf(name))
+	}
+
+	// Including when they come from the cache
+	msg := query("10.1.1.1", "www.example.com.", dns.TypeA)
+	c.Assert(msg, check.NotNil)
+	c.Check(msg.Authoritative, check.Equals, true)
+}
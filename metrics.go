@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// A counter partitioned by the value of a single label, exposed in the Prometheus text format
+type counterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	label  string
+	values map[string]uint64
+}
+
+// A gauge partitioned the same way, for values that are set rather than counted
+type gaugeVec struct {
+	counterVec
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	metricsMutex sync.Mutex
+	allMetrics   []metric
+
+	responsesBySection = newCounterVec("rancher_dns_responses_total", "Responses sent, by where the answer came from", "section")
+	droppedByReason    = newCounterVec("rancher_dns_dropped_total", "Packets dropped without a response, by reason", "reason")
+	refusedByType      = newCounterVec("rancher_dns_refused_total", "Queries refused because of --refuse-types, by query type", "type")
+	answersBySource    = newCounterVec("rancher_dns_answers_by_source_total", "Local records answered with, by the file they were loaded from", "source")
+	validationIssues   = newGaugeVec("rancher_dns_validation_issues", "Problems found in the answers on the last load, by severity", "severity")
+)
+
+func newCounterVec(name, help, label string) *counterVec {
+	c := &counterVec{name: name, help: help, label: label, values: make(map[string]uint64)}
+	metricsMutex.Lock()
+	allMetrics = append(allMetrics, c)
+	metricsMutex.Unlock()
+	return c
+}
+
+func newGaugeVec(name, help, label string) *gaugeVec {
+	g := &gaugeVec{counterVec{name: name, help: help, label: label, values: make(map[string]uint64)}}
+	metricsMutex.Lock()
+	allMetrics = append(allMetrics, g)
+	metricsMutex.Unlock()
+	return g
+}
+
+func (g *gaugeVec) Set(value string, n int) {
+	g.Lock()
+	g.values[value] = uint64(n)
+	g.Unlock()
+}
+
+func (g *gaugeVec) write(w io.Writer) {
+	g.writeAs(w, "gauge")
+}
+
+func (c *counterVec) Inc(value string) {
+	c.Lock()
+	c.values[value]++
+	c.Unlock()
+}
+
+func (c *counterVec) Get(value string) uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.values[value]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.writeAs(w, "counter")
+}
+
+func (c *counterVec) writeAs(w io.Writer, kind string) {
+	c.Lock()
+	defer c.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", c.name, kind)
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, k, c.values[k])
+	}
+}
+
+func httpMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	for _, c := range allMetrics {
+		c.write(w)
+	}
+}
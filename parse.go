@@ -1,11 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -20,14 +28,496 @@ func ParseAnswers(path string) (out Answers, err error) {
 		return nil, err
 	}
 
-	if yaml.Unmarshal(data, &out); err != nil {
+	if *templateAnswers {
+		data, err = renderTemplate(path, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = checkDuplicateKeys(path, data); err != nil {
+		return nil, err
+	}
+
+	if data, err = expandReferences(path, data); err != nil {
+		return nil, err
+	}
+
+	if err = yaml.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+
+	if err := ExpandRanges(&out); err != nil {
+		return nil, err
+	}
+
+	if err := validateAnswers(out); err != nil {
 		return nil, err
 	}
 
 	ConvertPtrIps(&out)
+	for key, client := range out {
+		tagSources(&client, path)
+		out[key] = client
+	}
+	return out, nil
+}
+
+var templateFuncs = template.FuncMap{
+	// Value of an environment variable
+	"env": os.Getenv,
+	// Integers from start to end, inclusive
+	"seq": func(start, end int) []int {
+		var out []int
+		for i := start; i <= end; i++ {
+			out = append(out, i)
+		}
+		return out
+	},
+	"add":  func(a, b int) int { return a + b },
+	"join": strings.Join,
+}
+
+// Renders the answers file as a text/template before it is parsed
+func renderTemplate(path string, data []byte) ([]byte, error) {
+	tmpl, err := template.New(filepath.Base(path)).Funcs(templateFuncs).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, nil); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// Reads every zone file in a directory into one set of records. Each file is named after the zone it holds:
+// "example.com.json" (or .yaml) uses the answers file format for a single client, "example.com.zone" is a
+// standard zone file. Names that are not fully-qualified are relative to the zone. Files are read in lexical
+// order and the first one to define a name wins.
+func ParseAnswersDir(dir string) (out ClientAnswers, err error) {
+	out = ClientAnswers{
+		A:     make(map[string]RecordA),
+		Cname: make(map[string]RecordCname),
+		Ptr:   make(map[string]RecordPtr),
+		Txt:   make(map[string]RecordTxt),
+		Tlsa:  make(map[string][]RecordTlsa),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return out, err
+	}
+
+	names := []string{}
+	for _, file := range files {
+		if !file.IsDir() {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		ext := filepath.Ext(name)
+		origin := dns.Fqdn(strings.ToLower(strings.TrimSuffix(name, ext)))
+
+		var zone ClientAnswers
+		switch ext {
+		case ".json", ".yaml", ".yml":
+			zone, err = parseZoneAnswers(path, origin)
+		case ".zone":
+			zone, err = parseZoneFile(path, origin)
+		default:
+			log.Debug("Skipping non-zone file: ", path)
+			continue
+		}
+		if err != nil {
+			return out, fmt.Errorf("%s: %v", path, err)
+		}
+
+		log.Debugf("Loaded zone %s from %s", origin, path)
+		mergeAnswers(&out, zone, path)
+	}
+
 	return out, nil
 }
 
+func parseZoneAnswers(path string, origin string) (out ClientAnswers, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return out, err
+	}
+
+	if err = checkDuplicateKeys(path, data); err != nil {
+		return out, err
+	}
+
+	if data, err = expandReferences(path, data); err != nil {
+		return out, err
+	}
+
+	// Only records belong in a zone, anything else would be silently left out
+	var keys map[string]interface{}
+	if err = yaml.Unmarshal(data, &keys); err != nil {
+		return out, err
+	}
+	for key := range keys {
+		if !zoneKeys[key] {
+			return out, fmt.Errorf("%q is not a kind of record a zone file can have", key)
+		}
+	}
+
+	if err = yaml.Unmarshal(data, &out); err != nil {
+		return out, err
+	}
+
+	a := make(map[string]RecordA)
+	for name, val := range out.A {
+		a[qualify(name, origin)] = val
+	}
+	cname := make(map[string]RecordCname)
+	for name, val := range out.Cname {
+		val.Answer = qualify(val.Answer, origin)
+		cname[qualify(name, origin)] = val
+	}
+	ptr := make(map[string]RecordPtr)
+	for name, val := range out.Ptr {
+		val.Answer = qualify(val.Answer, origin)
+		// IP address keys are converted to in-addr.arpa names later
+		if net.ParseIP(name) == nil {
+			name = qualify(name, origin)
+		}
+		ptr[name] = val
+	}
+	txt := make(map[string]RecordTxt)
+	for name, val := range out.Txt {
+		txt[qualify(name, origin)] = val
+	}
+	alias := make(map[string]RecordAlias)
+	for name, val := range out.Alias {
+		val.Answer = qualify(val.Answer, origin)
+		alias[qualify(name, origin)] = val
+	}
+	tlsa := make(map[string][]RecordTlsa)
+	for name, val := range out.Tlsa {
+		tlsa[qualify(name, origin)] = val
+	}
+	srv := make(map[string][]RecordSrv)
+	for name, val := range out.Srv {
+		for i := range val {
+			val[i].Target = qualify(val[i].Target, origin)
+		}
+		srv[qualify(name, origin)] = val
+	}
+	// A target of "." is the record's own name, which qualify leaves alone
+	https := make(map[string][]RecordHttps)
+	for name, val := range out.Https {
+		for i := range val {
+			val[i].Target = qualify(val[i].Target, origin)
+		}
+		https[qualify(name, origin)] = val
+	}
+	var patterns []RecordPattern
+	for _, p := range out.Patterns {
+		p.Match = qualify(p.Match, origin)
+		patterns = append(patterns, p)
+	}
+	suffixDefaults := make(map[string]RecordA)
+	for name, val := range out.SuffixDefaults {
+		suffixDefaults[qualify(name, origin)] = val
+	}
+	delegate := make(map[string][]string)
+	for name, val := range out.Delegate {
+		delegate[qualify(name, origin)] = val
+	}
+
+	return ClientAnswers{
+		A:              a,
+		Cname:          cname,
+		Ptr:            ptr,
+		Txt:            txt,
+		Alias:          alias,
+		Tlsa:           tlsa,
+		Srv:            srv,
+		Https:          https,
+		Patterns:       patterns,
+		SuffixDefaults: suffixDefaults,
+		Delegate:       delegate,
+	}, nil
+}
+
+// The keys a zone's .json or .yaml file may have
+var zoneKeys = map[string]bool{
+	"a":              true,
+	"cname":          true,
+	"ptr":            true,
+	"txt":            true,
+	"alias":          true,
+	"tlsa":           true,
+	"srv":            true,
+	"https":          true,
+	"patterns":       true,
+	"suffixdefaults": true,
+	"delegate":       true,
+}
+
+func parseZoneFile(path string, origin string) (out ClientAnswers, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return out, err
+	}
+	defer file.Close()
+
+	out = ClientAnswers{
+		A:     make(map[string]RecordA),
+		Cname: make(map[string]RecordCname),
+		Ptr:   make(map[string]RecordPtr),
+		Txt:   make(map[string]RecordTxt),
+		Tlsa:  make(map[string][]RecordTlsa),
+	}
+
+	for token := range dns.ParseZone(file, origin, path) {
+		if token.Error != nil {
+			err = token.Error
+			continue
+		}
+
+		hdr := token.RR.Header()
+		name := strings.ToLower(hdr.Name)
+		ttl := hdr.Ttl
+		switch rr := token.RR.(type) {
+		case *dns.A:
+			rec := out.A[name]
+			rec.Ttl = &ttl
+			rec.Answer = append(rec.Answer, rr.A.String())
+			out.A[name] = rec
+		case *dns.CNAME:
+			out.Cname[name] = RecordCname{Ttl: &ttl, Answer: strings.ToLower(rr.Target)}
+		case *dns.PTR:
+			out.Ptr[name] = RecordPtr{Ttl: &ttl, Answer: strings.ToLower(rr.Ptr)}
+		case *dns.TXT:
+			rec := out.Txt[name]
+			rec.Ttl = &ttl
+			rec.Answer = append(rec.Answer, strings.Join(rr.Txt, ""))
+			out.Txt[name] = rec
+		case *dns.TLSA:
+			rec := RecordTlsa{Ttl: &ttl, Usage: rr.Usage, Selector: rr.Selector, MatchingType: rr.MatchingType, Certificate: rr.Certificate}
+			out.Tlsa[name] = append(out.Tlsa[name], rec)
+		default:
+			log.Warnf("Skipping unsupported %s record for %s in %s", dns.TypeToString[hdr.Rrtype], name, path)
+			validationWarning(path, "Skipping unsupported %s record for %s", dns.TypeToString[hdr.Rrtype], name)
+		}
+	}
+
+	return out, err
+}
+
+// Makes a name relative to the origin fully-qualified, "@" being the origin itself
+func qualify(name string, origin string) string {
+	name = strings.ToLower(name)
+	if name == "@" || name == "" {
+		return origin
+	}
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "." + origin
+}
+
+func sourceKey(qtype uint16, name string) string {
+	return dns.TypeToString[qtype] + " " + name
+}
+
+// Records the file every record without one came from
+func tagSources(client *ClientAnswers, source string) {
+	if client.Sources == nil {
+		client.Sources = make(map[string]string)
+	}
+	tag := func(key string) {
+		if _, ok := client.Sources[key]; !ok {
+			client.Sources[key] = source
+		}
+	}
+
+	for name := range client.A {
+		tag(sourceKey(dns.TypeA, name))
+	}
+	for name := range client.Cname {
+		tag(sourceKey(dns.TypeCNAME, name))
+	}
+	for name := range client.Ptr {
+		tag(sourceKey(dns.TypePTR, name))
+	}
+	for name := range client.Txt {
+		tag(sourceKey(dns.TypeTXT, name))
+	}
+	for name := range client.Tlsa {
+		tag(sourceKey(dns.TypeTLSA, name))
+	}
+	for name := range client.Srv {
+		tag(sourceKey(dns.TypeSRV, name))
+	}
+	for name := range client.Https {
+		tag(sourceKey(TypeHTTPS, name))
+	}
+	for _, p := range client.Patterns {
+		tag(sourceKey(dns.TypeA, p.Match))
+	}
+	for name := range client.SuffixDefaults {
+		tag(sourceKey(dns.TypeA, name))
+	}
+}
+
+// Adds the records from src that dst doesn't already have
+func mergeAnswers(dst *ClientAnswers, src ClientAnswers, source string) {
+	if dst.Sources == nil {
+		dst.Sources = make(map[string]string)
+	}
+	if dst.A == nil {
+		dst.A = make(map[string]RecordA)
+	}
+	if dst.Cname == nil {
+		dst.Cname = make(map[string]RecordCname)
+	}
+	if dst.Ptr == nil {
+		dst.Ptr = make(map[string]RecordPtr)
+	}
+	if dst.Txt == nil {
+		dst.Txt = make(map[string]RecordTxt)
+	}
+	if dst.Tlsa == nil {
+		dst.Tlsa = make(map[string][]RecordTlsa)
+	}
+	if dst.Srv == nil {
+		dst.Srv = make(map[string][]RecordSrv)
+	}
+	if dst.Https == nil {
+		dst.Https = make(map[string][]RecordHttps)
+	}
+	if dst.Alias == nil {
+		dst.Alias = make(map[string]RecordAlias)
+	}
+	if dst.SuffixDefaults == nil {
+		dst.SuffixDefaults = make(map[string]RecordA)
+	}
+	if dst.Delegate == nil {
+		dst.Delegate = make(map[string][]string)
+	}
+
+	for name, val := range src.A {
+		if _, ok := dst.A[name]; ok {
+			log.Warnf("Ignoring A record for %s from %s, already defined", name, source)
+			validationWarning(source, "Ignoring A record for %s, already defined", name)
+			continue
+		}
+		dst.A[name] = val
+		dst.Sources[sourceKey(dns.TypeA, name)] = sourceOf(src, sourceKey(dns.TypeA, name), source)
+	}
+	for name, val := range src.Cname {
+		if _, ok := dst.Cname[name]; ok {
+			log.Warnf("Ignoring CNAME record for %s from %s, already defined", name, source)
+			validationWarning(source, "Ignoring CNAME record for %s, already defined", name)
+			continue
+		}
+		dst.Cname[name] = val
+		dst.Sources[sourceKey(dns.TypeCNAME, name)] = sourceOf(src, sourceKey(dns.TypeCNAME, name), source)
+	}
+	for name, val := range src.Ptr {
+		if _, ok := dst.Ptr[name]; ok {
+			log.Warnf("Ignoring PTR record for %s from %s, already defined", name, source)
+			validationWarning(source, "Ignoring PTR record for %s, already defined", name)
+			continue
+		}
+		dst.Ptr[name] = val
+		dst.Sources[sourceKey(dns.TypePTR, name)] = sourceOf(src, sourceKey(dns.TypePTR, name), source)
+	}
+	for name, val := range src.Txt {
+		if _, ok := dst.Txt[name]; ok {
+			log.Warnf("Ignoring TXT record for %s from %s, already defined", name, source)
+			validationWarning(source, "Ignoring TXT record for %s, already defined", name)
+			continue
+		}
+		dst.Txt[name] = val
+		dst.Sources[sourceKey(dns.TypeTXT, name)] = sourceOf(src, sourceKey(dns.TypeTXT, name), source)
+	}
+	for name, val := range src.Tlsa {
+		if _, ok := dst.Tlsa[name]; ok {
+			log.Warnf("Ignoring TLSA records for %s from %s, already defined", name, source)
+			validationWarning(source, "Ignoring TLSA records for %s, already defined", name)
+			continue
+		}
+		dst.Tlsa[name] = val
+		dst.Sources[sourceKey(dns.TypeTLSA, name)] = sourceOf(src, sourceKey(dns.TypeTLSA, name), source)
+	}
+	for name, val := range src.Srv {
+		if _, ok := dst.Srv[name]; ok {
+			log.Warnf("Ignoring SRV records for %s from %s, already defined", name, source)
+			validationWarning(source, "Ignoring SRV records for %s, already defined", name)
+			continue
+		}
+		dst.Srv[name] = val
+		dst.Sources[sourceKey(dns.TypeSRV, name)] = sourceOf(src, sourceKey(dns.TypeSRV, name), source)
+	}
+	for name, val := range src.Https {
+		if _, ok := dst.Https[name]; ok {
+			log.Warnf("Ignoring HTTPS records for %s from %s, already defined", name, source)
+			validationWarning(source, "Ignoring HTTPS records for %s, already defined", name)
+			continue
+		}
+		dst.Https[name] = val
+		dst.Sources[sourceKey(TypeHTTPS, name)] = sourceOf(src, sourceKey(TypeHTTPS, name), source)
+	}
+	for name, val := range src.Alias {
+		if _, ok := dst.Alias[name]; ok {
+			log.Warnf("Ignoring ALIAS record for %s from %s, already defined", name, source)
+			validationWarning(source, "Ignoring ALIAS record for %s, already defined", name)
+			continue
+		}
+		dst.Alias[name] = val
+	}
+	defined := make(map[string]bool)
+	for _, p := range dst.Patterns {
+		defined[p.Match] = true
+	}
+	for _, p := range src.Patterns {
+		if defined[p.Match] {
+			log.Warnf("Ignoring pattern %s from %s, already defined", p.Match, source)
+			validationWarning(source, "Ignoring pattern %s, already defined", p.Match)
+			continue
+		}
+		dst.Patterns = append(dst.Patterns, p)
+		dst.Sources[sourceKey(dns.TypeA, p.Match)] = sourceOf(src, sourceKey(dns.TypeA, p.Match), source)
+	}
+	for name, val := range src.SuffixDefaults {
+		if _, ok := dst.SuffixDefaults[name]; ok {
+			log.Warnf("Ignoring suffix default for %s from %s, already defined", name, source)
+			validationWarning(source, "Ignoring suffix default for %s, already defined", name)
+			continue
+		}
+		dst.SuffixDefaults[name] = val
+		dst.Sources[sourceKey(dns.TypeA, name)] = sourceOf(src, sourceKey(dns.TypeA, name), source)
+	}
+	for name, val := range src.Delegate {
+		if _, ok := dst.Delegate[name]; ok {
+			log.Warnf("Ignoring delegation of %s from %s, already defined", name, source)
+			validationWarning(source, "Ignoring delegation of %s, already defined", name)
+			continue
+		}
+		dst.Delegate[name] = val
+	}
+}
+
+// Where a record came from: where it was loaded from if that is known, or else the source it is merged from
+func sourceOf(src ClientAnswers, key string, source string) string {
+	if file, ok := src.Sources[key]; ok {
+		return file
+	}
+	return source
+}
+
 func ConvertPtrIps(answers *Answers) {
 	// Convert PTR keys that are IP addresses into "4.3.2.1.in-addr.arpa." form.
 	for _, client := range *answers {
@@ -40,8 +530,67 @@ func ConvertPtrIps(answers *Answers) {
 
 				delete(client.Ptr, origKey)
 				client.Ptr[newKey] = val
+				if source, ok := client.Sources[sourceKey(dns.TypePTR, origKey)]; ok {
+					delete(client.Sources, sourceKey(dns.TypePTR, origKey))
+					client.Sources[sourceKey(dns.TypePTR, newKey)] = source
+				}
 				log.Debug("Transformed PTR for ", origKey, " to ", newKey, " => ", val.Answer)
 			}
 		}
 	}
 }
+
+// Expands A answers given as a range of addresses in the same /24, like "10.0.0.10-20" or
+// "10.0.0.10-10.0.0.20", into each of the addresses.
+func ExpandRanges(answers *Answers) error {
+	for key, client := range *answers {
+		for name, rec := range client.A {
+			var expanded []string
+			for _, answer := range rec.Answer {
+				addrs, err := expandRange(answer)
+				if err != nil {
+					return fmt.Errorf("%s: A record %s: %v", key, name, err)
+				}
+				expanded = append(expanded, addrs...)
+			}
+			rec.Answer = expanded
+			client.A[name] = rec
+		}
+	}
+
+	return nil
+}
+
+func expandRange(answer string) ([]string, error) {
+	parts := strings.SplitN(answer, "-", 2)
+	if len(parts) == 1 {
+		return []string{answer}, nil
+	}
+
+	start := net.ParseIP(parts[0]).To4()
+	if start == nil {
+		return nil, fmt.Errorf("Invalid range %s, the start is not an IPv4 address", answer)
+	}
+
+	var end net.IP
+	if last, err := strconv.Atoi(parts[1]); err == nil && last >= 0 && last <= 255 {
+		end = net.IPv4(start[0], start[1], start[2], byte(last)).To4()
+	} else {
+		end = net.ParseIP(parts[1]).To4()
+	}
+	if end == nil {
+		return nil, fmt.Errorf("Invalid range %s, the end is neither a last octet nor an IPv4 address", answer)
+	}
+	if !start.Mask(net.CIDRMask(24, 32)).Equal(end.Mask(net.CIDRMask(24, 32))) {
+		return nil, fmt.Errorf("Invalid range %s, it spans more than one /24", answer)
+	}
+	if start[3] > end[3] {
+		return nil, fmt.Errorf("Invalid range %s, it ends before it starts", answer)
+	}
+
+	var addrs []string
+	for last := int(start[3]); last <= int(end[3]); last++ {
+		addrs = append(addrs, net.IPv4(start[0], start[1], start[2], byte(last)).String())
+	}
+	return addrs, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/miekg/dns"
+	"gopkg.in/check.v1"
+)
+
+type ParseTests struct{}
+
+var _ = check.Suite(&ParseTests{})
+
+func writeFile(c *check.C, dir, name, content string) {
+	err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	c.Assert(err, check.IsNil)
+}
+
+func (t *ParseTests) TestParseAnswersDir(c *check.C) {
+	dir := c.MkDir()
+	writeFile(c, dir, "example.com.json", `{
+		"a": {
+			"www": {"answer": ["10.0.0.1"]},
+			"@": {"answer": ["10.0.0.2"]},
+			"other.org.": {"answer": ["10.0.0.3"]}
+		},
+		"cname": {
+			"app": {"answer": "www"}
+		},
+		"ptr": {
+			"10.0.0.1": {"answer": "www"}
+		}
+	}`)
+	writeFile(c, dir, "example.net.zone", `$TTL 60
+@     IN A   10.1.0.1
+www   IN A   10.1.0.2
+www   IN A   10.1.0.3
+app   IN CNAME www
+info  IN TXT "hello"
+`)
+	// Already defined by example.com.json, which is read first
+	writeFile(c, dir, "other.org.zone", "@ 60 IN A 10.2.0.1\n")
+	writeFile(c, dir, "README", "not a zone")
+
+	zones, err := ParseAnswersDir(dir)
+	c.Assert(err, check.IsNil)
+
+	c.Check(zones.A["www.example.com."].Answer, check.DeepEquals, []string{"10.0.0.1"})
+	c.Check(zones.A["example.com."].Answer, check.DeepEquals, []string{"10.0.0.2"})
+	c.Check(zones.A["other.org."].Answer, check.DeepEquals, []string{"10.0.0.3"})
+	c.Check(zones.Cname["app.example.com."].Answer, check.Equals, "www.example.com.")
+	c.Check(zones.Ptr["10.0.0.1"].Answer, check.Equals, "www.example.com.")
+
+	c.Check(zones.A["example.net."].Answer, check.DeepEquals, []string{"10.1.0.1"})
+	c.Check(zones.A["www.example.net."].Answer, check.DeepEquals, []string{"10.1.0.2", "10.1.0.3"})
+	c.Check(*zones.A["www.example.net."].Ttl, check.Equals, uint32(60))
+	c.Check(zones.Cname["app.example.net."].Answer, check.Equals, "www.example.net.")
+	c.Check(zones.Txt["info.example.net."].Answer, check.DeepEquals, []string{"hello"})
+}
+
+func (t *ParseTests) TestParseAnswersDirInvalid(c *check.C) {
+	dir := c.MkDir()
+	writeFile(c, dir, "example.com.zone", "www IN A not-an-ip\n")
+
+	_, err := ParseAnswersDir(dir)
+	c.Check(err, check.NotNil)
+}
+
+func (t *ParseTests) TestParseAnswersDirRecords(c *check.C) {
+	dir := c.MkDir()
+	writeFile(c, dir, "example.com.json", `{
+		"srv": {
+			"_http._tcp": [{"priority": 10, "weight": 5, "port": 80, "target": "www"}]
+		},
+		"https": {
+			"@": [{"priority": 1, "target": ".", "alpn": ["h2"]}],
+			"alt": [{"priority": 0, "target": "cdn.example.net."}]
+		},
+		"alias": {
+			"@": {"answer": "lb"}
+		},
+		"patterns": [{"match": "ip-*", "answer": "10.0.0.$1"}],
+		"suffixdefaults": {
+			"*.dev": {"answer": ["10.0.9.1"]}
+		},
+		"delegate": {
+			"lab": ["10.0.0.53"]
+		}
+	}`)
+
+	zones, err := ParseAnswersDir(dir)
+	c.Assert(err, check.IsNil)
+
+	c.Assert(zones.Srv["_http._tcp.example.com."], check.HasLen, 1)
+	c.Check(zones.Srv["_http._tcp.example.com."][0].Target, check.Equals, "www.example.com.")
+	c.Assert(zones.Https["example.com."], check.HasLen, 1)
+	c.Check(zones.Https["example.com."][0].Target, check.Equals, ".")
+	c.Check(zones.Https["alt.example.com."][0].Target, check.Equals, "cdn.example.net.")
+	c.Check(zones.Alias["example.com."].Answer, check.Equals, "lb.example.com.")
+	c.Assert(zones.Patterns, check.HasLen, 1)
+	c.Check(zones.Patterns[0].Match, check.Equals, "ip-*.example.com.")
+	c.Check(zones.SuffixDefaults["*.dev.example.com."].Answer, check.DeepEquals, []string{"10.0.9.1"})
+	c.Check(zones.Delegate["lab.example.com."], check.DeepEquals, []string{"10.0.0.53"})
+	c.Check(zones.Sources["SRV _http._tcp.example.com."], check.Equals, filepath.Join(dir, "example.com.json"))
+
+	// Settings of a client entry have no place in a zone
+	writeFile(c, dir, "example.com.json", `{"recurse": ["8.8.8.8"]}`)
+	_, err = ParseAnswersDir(dir)
+	c.Check(err, check.ErrorMatches, `.*"recurse" is not a kind of record a zone file can have`)
+}
+
+func (t *ParseTests) TestParseAnswersTemplate(c *check.C) {
+	*templateAnswers = true
+	defer func() { *templateAnswers = false }()
+	os.Setenv("RANCHER_DNS_TEST_IP", "10.0.0.1")
+	defer os.Unsetenv("RANCHER_DNS_TEST_IP")
+
+	dir := c.MkDir()
+	writeFile(c, dir, "answers.json", `{
+		"default": {
+			"a": {
+				"env.": {"answer": ["{{ env "RANCHER_DNS_TEST_IP" }}"]},
+				{{- range $i := seq 1 3 }}
+				"pod-{{ $i }}.": {"answer": ["10.1.0.{{ add $i 10 }}"]},
+				{{- end }}
+				"last.": {"answer": ["10.2.0.1"]}
+			}
+		}
+	}`)
+
+	answers, err := ParseAnswers(filepath.Join(dir, "answers.json"))
+	c.Assert(err, check.IsNil)
+	a := answers[DEFAULT_KEY].A
+	c.Check(a, check.HasLen, 5)
+	c.Check(a["env."].Answer, check.DeepEquals, []string{"10.0.0.1"})
+	c.Check(a["pod-1."].Answer, check.DeepEquals, []string{"10.1.0.11"})
+	c.Check(a["pod-3."].Answer, check.DeepEquals, []string{"10.1.0.13"})
+
+	writeFile(c, dir, "broken.json", `{"default": {{ nope }}}`)
+	_, err = ParseAnswers(filepath.Join(dir, "broken.json"))
+	c.Check(err, check.NotNil)
+}
+
+func (t *ParseTests) TestExpandRanges(c *check.C) {
+	dir := c.MkDir()
+	writeFile(c, dir, "answers.yaml", `
+default:
+  a:
+    pool.:
+      answer: ["10.0.0.10-12", "10.0.0.1"]
+    wide.:
+      answer: ["10.0.1.254-10.0.1.255"]
+`)
+
+	answers, err := ParseAnswers(filepath.Join(dir, "answers.yaml"))
+	c.Assert(err, check.IsNil)
+	c.Check(answers[DEFAULT_KEY].A["pool."].Answer, check.DeepEquals, []string{"10.0.0.10", "10.0.0.11", "10.0.0.12", "10.0.0.1"})
+	c.Check(answers[DEFAULT_KEY].A["wide."].Answer, check.DeepEquals, []string{"10.0.1.254", "10.0.1.255"})
+
+	for _, bad := range []string{"10.0.0.20-10", "10.0.0.10-10.0.1.20", "10.0.0.10-300", "fe80::1-2", "10.0.0.10-x"} {
+		_, err := expandRange(bad)
+		c.Check(err, check.NotNil, check.Commentf(bad))
+	}
+}
+
+func (t *ParseTests) TestAnswerSources(c *check.C) {
+	dir := c.MkDir()
+	zonesDir := filepath.Join(dir, "zones")
+	c.Assert(os.Mkdir(zonesDir, 0755), check.IsNil)
+	writeFile(c, dir, "answers.json", `{"default": {"a": {"web.example.com.": {"answer": ["10.0.0.1"]}}}}`)
+	writeFile(c, zonesDir, "example.com.zone", "www 60 IN A 10.0.0.2\nweb 60 IN A 10.0.0.3\n")
+	writeFile(c, zonesDir, "example.net.json", `{"ptr": {"10.0.0.4": {"answer": "host"}}}`)
+
+	answers, err := ParseAnswers(filepath.Join(dir, "answers.json"))
+	c.Assert(err, check.IsNil)
+	*answersDir = zonesDir
+	defer func() { *answersDir = "" }()
+	c.Assert(loadAnswersDir(answers), check.IsNil)
+
+	sources := answers[DEFAULT_KEY].Sources
+	c.Check(sources["A web.example.com."], check.Equals, filepath.Join(dir, "answers.json"))
+	c.Check(sources["A www.example.com."], check.Equals, filepath.Join(zonesDir, "example.com.zone"))
+	c.Check(sources["PTR 4.0.0.10.in-addr.arpa."], check.Equals, filepath.Join(zonesDir, "example.net.json"))
+
+	// Only what is answered with counts, looking records up doesn't
+	zone := filepath.Join(zonesDir, "example.com.zone")
+	before := answersBySource.Get(zone)
+	www, ok := answers.Matching(dns.TypeA, "10.1.1.1", "www.example.com.")
+	c.Check(ok, check.Equals, true)
+	web, ok := answers.Matching(dns.TypeA, "10.1.1.1", "web.example.com.")
+	c.Check(ok, check.Equals, true)
+	c.Check(answersBySource.Get(zone), check.Equals, before)
+
+	answers.countSources("10.1.1.1", append(www, web...))
+	c.Check(answersBySource.Get(zone), check.Equals, before+1)
+	c.Check(answersBySource.Get(filepath.Join(dir, "answers.json")) > 0, check.Equals, true)
+}
+
+func (t *ParseTests) TestReferences(c *check.C) {
+	dir := c.MkDir()
+	writeFile(c, dir, "answers.json", `{
+		"$def": {
+			"pool": {"answer": ["10.0.0.1", "10.0.0.2"], "limit": 1},
+			"addrs": ["10.0.0.3"],
+			"both": {"$use": "pool", "limit": 2}
+		},
+		"default": {
+			"a": {
+				"web.": {"$use": "pool"},
+				"www.": {"$use": "pool", "canary": "10.0.0.9"},
+				"api.": {"answer": {"$use": "addrs"}},
+				"all.": {"$use": "both"},
+				"gone.": {"$use": "missing"}
+			}
+		}
+	}`)
+
+	answers, err := ParseAnswers(filepath.Join(dir, "answers.json"))
+	c.Assert(err, check.IsNil)
+	_, ok := answers[REF_DEFS]
+	c.Check(ok, check.Equals, false)
+
+	a := answers[DEFAULT_KEY].A
+	c.Check(a["web."].Answer, check.DeepEquals, []string{"10.0.0.1", "10.0.0.2"})
+	c.Check(a["web."].Limit, check.Equals, 1)
+	c.Check(a["www."].Canary, check.Equals, "10.0.0.9")
+	c.Check(a["www."].Limit, check.Equals, 1)
+	c.Check(a["api."].Answer, check.DeepEquals, []string{"10.0.0.3"})
+	c.Check(a["all."].Limit, check.Equals, 2)
+	_, ok = a["gone."]
+	c.Check(ok, check.Equals, false)
+
+	*strict = true
+	defer func() { *strict = false }()
+	_, err = ParseAnswers(filepath.Join(dir, "answers.json"))
+	c.Check(err, check.ErrorMatches, `.*"missing" is not defined`)
+
+	// Unquoted scalars are left as they were written
+	writeFile(c, dir, "scalars.yaml", "$def:\n  pool: {answer: [10.0.0.1]}\ndefault:\n  a:\n    web.: {$use: pool, limit: 0x1}\n  txt:\n    info.: {answer: [yes, 1.10, 0x1F, ~]}\n")
+	answers, err = ParseAnswers(filepath.Join(dir, "scalars.yaml"))
+	c.Assert(err, check.IsNil)
+	c.Check(answers[DEFAULT_KEY].Txt["info."].Answer, check.DeepEquals, []string{"yes", "1.10", "0x1F", ""})
+	c.Check(answers[DEFAULT_KEY].A["web."].Limit, check.Equals, 1)
+
+	writeFile(c, dir, "loop.json", `{"$def": {"a": {"$use": "b"}, "b": {"$use": "a"}}, "default": {"a": {"x.": {"$use": "a"}}}}`)
+	_, err = ParseAnswers(filepath.Join(dir, "loop.json"))
+	c.Check(err, check.ErrorMatches, `.*refers to itself`)
+}
+
+func (t *ParseTests) TestDuplicateKeys(c *check.C) {
+	dups, err := duplicateKeys([]byte(`{
+		"10.1.1.1": {"a": {"web.": {"answer": ["10.0.0.1"]}}},
+		"default": {
+			"a": {
+				"web.": {"answer": ["10.0.0.2"]},
+				"db.": {"answer": ["10.0.0.3"]},
+				"web.": {"answer": ["10.0.0.4"]}
+			},
+			"cname": {"www.": {"answer": "web."}}
+		},
+		"10.1.1.1": {}
+	}`))
+	c.Assert(err, check.IsNil)
+	c.Check(dups, check.DeepEquals, []string{"default > a > web.", "10.1.1.1"})
+
+	_, err = duplicateKeys([]byte("default:\n  a: {}\n"))
+	c.Check(err, check.NotNil)
+
+	dir := c.MkDir()
+	writeFile(c, dir, "answers.json", `{"default": {"a": {"web.": {"answer": ["10.0.0.1"]}, "web.": {"answer": ["10.0.0.2"]}}}}`)
+	answers, err := ParseAnswers(filepath.Join(dir, "answers.json"))
+	c.Assert(err, check.IsNil)
+	c.Check(answers[DEFAULT_KEY].A["web."].Answer, check.DeepEquals, []string{"10.0.0.2"})
+
+	*strict = true
+	defer func() { *strict = false }()
+	_, err = ParseAnswers(filepath.Join(dir, "answers.json"))
+	c.Check(err, check.ErrorMatches, `.*duplicate key default > a > web\.`)
+
+	// Broken files don't load at all
+	writeFile(c, dir, "broken.json", `{"default": {`)
+	_, err = ParseAnswers(filepath.Join(dir, "broken.json"))
+	c.Check(err, check.NotNil)
+}
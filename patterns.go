@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Answers A queries for every name of a given shape, instead of listing each one. Match has as many labels as
+// the names it matches, and every "*" in it matches part of a single label, at least one character. What they
+// match is captured as $1, $2... in order. The address is Answer with the captures substituted, or the entry in
+// Lookup for the first capture.
+type RecordPattern struct {
+	Ttl    *uint32           `json:"-"`
+	Match  string            `json:"match"`
+	Answer string            `json:"answer,omitempty"`
+	Lookup map[string]string `json:"lookup,omitempty"`
+}
+
+// The labels the name has where the pattern has a "*", if it has the pattern's shape
+func (p RecordPattern) captures(fqdn string) ([]string, bool) {
+	want := dns.SplitDomainName(strings.ToLower(p.Match))
+	have := dns.SplitDomainName(strings.ToLower(fqdn))
+	if len(want) != len(have) {
+		return nil, false
+	}
+
+	var captured []string
+	for i, label := range want {
+		more, ok := globLabel(label, have[i])
+		if !ok {
+			return nil, false
+		}
+		captured = append(captured, more...)
+	}
+	return captured, true
+}
+
+// Matches a label against a pattern like "ip-*-*", returning what each "*" matched
+func globLabel(pattern, label string) ([]string, bool) {
+	star := strings.Index(pattern, "*")
+	if star < 0 {
+		return nil, pattern == label
+	}
+	if !strings.HasPrefix(label, pattern[:star]) {
+		return nil, false
+	}
+
+	rest := label[star:]
+	for n := 1; n <= len(rest); n++ {
+		if more, ok := globLabel(pattern[star+1:], rest[n:]); ok {
+			return append([]string{rest[:n]}, more...), true
+		}
+	}
+	return nil, false
+}
+
+// The address the pattern gives the name, if it matches and makes a valid IPv4 address
+func (p RecordPattern) Address(fqdn string) (string, bool) {
+	captured, ok := p.captures(fqdn)
+	if !ok {
+		return "", false
+	}
+
+	var addr string
+	if len(p.Lookup) > 0 {
+		if addr, ok = p.Lookup[captured[0]]; !ok {
+			return "", false
+		}
+	} else {
+		// Highest first, so $1 doesn't eat the start of $10
+		addr = p.Answer
+		for i := len(captured); i > 0; i-- {
+			addr = strings.Replace(addr, "$"+strconv.Itoa(i), captured[i-1], -1)
+		}
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() == nil {
+		return "", false
+	}
+	return ip.String(), true
+}
+
+// The first of the client's patterns that gives the name an address
+func (client ClientAnswers) matchPattern(fqdn string) (RecordPattern, string, bool) {
+	for _, p := range client.Patterns {
+		if addr, ok := p.Address(fqdn); ok {
+			return p, addr, true
+		}
+	}
+	return RecordPattern{}, "", false
+}
+
+func validatePattern(p RecordPattern) error {
+	if !strings.HasSuffix(p.Match, ".") {
+		return fmt.Errorf("Pattern %s must be fully-qualified", p.Match)
+	}
+	if !strings.Contains(p.Match, "*") {
+		return fmt.Errorf("Pattern %s has no \"*\"", p.Match)
+	}
+	if p.Answer == "" && len(p.Lookup) == 0 {
+		return fmt.Errorf("Pattern %s needs an answer or a lookup table", p.Match)
+	}
+	for key, addr := range p.Lookup {
+		if ip := net.ParseIP(addr); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("Pattern %s looks up %s to %q, which is not an IPv4 address", p.Match, key, addr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// In network-segmented environments some addresses can't be reached from some clients. The "default" section's
+// "reachable" map lists, for networks of clients, the networks of the addresses they can use. A answers for those
+// clients leave the other addresses out, unless that leaves none.
+
+// A network of clients and the networks they can reach, parsed from the default section's "reachable" map
+type reachableRule struct {
+	clients   []*net.IPNet
+	reachable []*net.IPNet
+}
+
+// Parses the default section's reachable and region networks once per load, so answering doesn't have to on
+// every query. Called on answers before they are served; entries that don't parse were already rejected by
+// validation and are left out.
+func prepareNetworks(answers Answers) {
+	client, ok := answers[DEFAULT_KEY]
+	if !ok {
+		return
+	}
+
+	client.reachableRules = nil
+	for from, to := range client.Reachable {
+		clients, err := parseNetworks(from, "client network")
+		if err != nil {
+			continue
+		}
+		networks, err := parseNetworks(strings.Join(to, ","), "reachable network")
+		if err != nil {
+			continue
+		}
+		client.reachableRules = append(client.reachableRules, reachableRule{clients: clients, reachable: networks})
+	}
+	client.regionNetworks = parseRegions(client.Regions)
+	answers[DEFAULT_KEY] = client
+}
+
+// The networks the client can reach, if any entry of the map is for it
+func (answers *Answers) reachableFrom(clientAddr string) (reachable []*net.IPNet, ok bool) {
+	for _, rule := range (*answers)[DEFAULT_KEY].reachableRules {
+		if inNetworks(rule.clients, clientAddr) {
+			reachable = append(reachable, rule.reachable...)
+			ok = true
+		}
+	}
+	return
+}
+
+// The addresses in the reachable networks, or all of them if there are none
+func filterReachable(addrs []string, reachable []*net.IPNet) []string {
+	var out []string
+	for _, addr := range addrs {
+		if inNetworks(reachable, addr) {
+			out = append(out, addr)
+		}
+	}
+
+	if len(out) == 0 {
+		return addrs
+	}
+	return out
+}
+
+func validateReachable(reachable map[string][]string) error {
+	for from, to := range reachable {
+		if _, err := parseNetworks(from, "client network"); err != nil {
+			return err
+		}
+		if _, err := parseNetworks(strings.Join(to, ","), "reachable network"); err != nil {
+			return fmt.Errorf("%s: %v", from, err)
+		}
+	}
+	return nil
+}
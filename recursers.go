@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Addresses of recursive servers given by hostname, looked up on every load and every --recurse-refresh
+var (
+	recurserAddrs      = map[string][]string{}
+	recurserAddrsMutex sync.RWMutex
+	lookupHost         = net.LookupHost
+)
+
+// Host and port of a recursive server, port 53 unless given
+func splitRecurser(recurser string) (host string, port string) {
+	if host, port, err := net.SplitHostPort(recurser); err == nil {
+		return host, port
+	}
+	return recurser, "53"
+}
+
+// Looks up the recursive servers in the answers given by name. A name that doesn't resolve keeps
+// the addresses it had before, if any.
+func resolveRecurserNames(answers Answers) {
+	names := map[string]bool{}
+	for _, client := range answers {
+		for _, recurser := range client.Recurse {
+			if host, _ := splitRecurser(recurser); net.ParseIP(host) == nil {
+				names[host] = true
+			}
+		}
+	}
+
+	resolved := map[string][]string{}
+	for name := range names {
+		addrs, err := lookupHost(name)
+		if err != nil || len(addrs) == 0 {
+			recurserAddrsMutex.RLock()
+			previous := recurserAddrs[name]
+			recurserAddrsMutex.RUnlock()
+			log.WithFields(log.Fields{"recurser": name, "previous": previous}).Warnf("Failed to resolve recursive server: %v", err)
+			resolved[name] = previous
+			continue
+		}
+		sort.Strings(addrs)
+		resolved[name] = addrs
+	}
+
+	recurserAddrsMutex.Lock()
+	recurserAddrs = resolved
+	recurserAddrsMutex.Unlock()
+}
+
+// The addresses to send queries for a recursive server to
+func recurserAddresses(recurser string) []string {
+	host, port := splitRecurser(recurser)
+	if net.ParseIP(host) != nil {
+		return []string{recurser}
+	}
+
+	recurserAddrsMutex.RLock()
+	addrs := recurserAddrs[host]
+	recurserAddrsMutex.RUnlock()
+
+	out := make([]string, len(addrs))
+	for i, addr := range addrs {
+		out[i] = net.JoinHostPort(addr, port)
+	}
+	return out
+}
+
+func watchRecursers() {
+	if *recurseRefresh <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(*recurseRefresh) {
+			resolveRecurserNames(withInstanceAnswers(getAnswers()))
+		}
+	}()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+var staleRefreshes = newCounterVec("rancher_dns_stale_refreshes_total", "Expired cached responses refreshed in the background after being served, by result", "result")
+
+// Refreshes expired global cache entries in the background once they have been served, with --stale-refresh-workers
+var staleRefresh *refreshPool
+
+// A fixed number of workers recursing for served stale entries, so a burst of them can't start a goroutine each.
+// Only one refresh of an entry is queued or running at a time, and when the queue is full the refresh is
+// skipped: the entry is still there to be served, and the next query for it tries again.
+type refreshPool struct {
+	jobs    chan refreshJob
+	mutex   sync.Mutex
+	pending map[string]bool
+}
+
+type refreshJob struct {
+	key       string
+	req       *dns.Msg
+	recursers []string
+}
+
+func newRefreshPool(workers int) *refreshPool {
+	p := &refreshPool{jobs: make(chan refreshJob, workers), pending: make(map[string]bool)}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Queues a refresh of the global cache entry unless one is already on its way
+func (p *refreshPool) Refresh(key string, req *dns.Msg, recursers []string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.pending[key] {
+		return
+	}
+
+	select {
+	case p.jobs <- refreshJob{key: key, req: req.Copy(), recursers: recursers}:
+		p.pending[key] = true
+	default:
+		staleRefreshes.Inc("dropped")
+		log.WithFields(log.Fields{"key": key}).Debug("Stale refresh queue full, skipped")
+	}
+}
+
+func (p *refreshPool) work() {
+	for job := range p.jobs {
+		msg, err := ResolveTryAll(rootCtx, job.req, job.recursers)
+		if err == nil && msg != nil {
+			prepareRecursive(rootCtx, job.req, msg, job.recursers)
+			replaceInGlobalCache(job.key, msg)
+			staleRefreshes.Inc("refreshed")
+		} else {
+			staleRefreshes.Inc("failed")
+			log.WithFields(log.Fields{"key": job.key}).Debugf("Stale refresh failed: %v", err)
+		}
+
+		p.mutex.Lock()
+		delete(p.pending, job.key)
+		p.mutex.Unlock()
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+
+	log "github.com/Sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Answers files can define a value once under a top-level "$def" and use it anywhere as {"$use": "name"}, the
+// JSON equivalent of YAML anchors and aliases (which work too). A use with other keys next to "$use" is the
+// definition with those keys replaced, so {"$use": "pool", "ttl": 60} is the pool with its own TTL.
+const (
+	REF_DEFS = "$def"
+	REF_USE  = "$use"
+)
+
+// Replaces every "$use" in the answers file with its definition and drops "$def". Undefined references are
+// an error with --strict, otherwise the value using one is left out with a warning.
+func expandReferences(path string, data []byte) ([]byte, error) {
+	if !bytes.Contains(data, []byte(REF_DEFS)) && !bytes.Contains(data, []byte(REF_USE)) {
+		return data, nil
+	}
+
+	var root refValue
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	doc, _ := root.value.(map[interface{}]interface{})
+
+	defs, ok := doc[REF_DEFS].(map[interface{}]interface{})
+	if _, present := doc[REF_DEFS]; present && !ok {
+		return nil, fmt.Errorf("%s: %s must be a map of names to values", path, REF_DEFS)
+	}
+	delete(doc, REF_DEFS)
+
+	r := &refExpander{path: path, defs: defs, expanding: map[string]bool{}}
+	expanded, ok, err := r.expand(doc)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		expanded = map[interface{}]interface{}{}
+	}
+	out, err := yaml.Marshal(expanded)
+	if err != nil {
+		return nil, err
+	}
+	return restoreScalars(out), nil
+}
+
+// Unquoted scalars that YAML reads as something other than a string, like yes, 1.10 or 0x1F, are kept as they
+// were written. Decoded and encoded again they would come back as true, 1.1 and 31, which is what a string
+// field like a TXT answer would then get.
+type refScalar string
+
+func (s refScalar) String() string {
+	return string(s)
+}
+
+// Written out as a placeholder only letters and hex digits, which restoreScalars replaces with the text
+func (s refScalar) MarshalYAML() (interface{}, error) {
+	return refScalarPrefix + hex.EncodeToString([]byte(s)), nil
+}
+
+const refScalarPrefix = "rancher-dns-scalar-"
+
+var refScalarPattern = regexp.MustCompile(refScalarPrefix + "([0-9a-f]+)")
+
+func restoreScalars(data []byte) []byte {
+	return refScalarPattern.ReplaceAllFunc(data, func(placeholder []byte) []byte {
+		text, err := hex.DecodeString(string(placeholder[len(refScalarPrefix):]))
+		if err != nil {
+			return placeholder
+		}
+		return text
+	})
+}
+
+// A document decoded like into an interface{}, except for the scalars kept as refScalar
+type refValue struct {
+	value interface{}
+}
+
+func (v *refValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var mapping map[interface{}]refValue
+	if err := unmarshal(&mapping); err == nil && mapping != nil {
+		out := make(map[interface{}]interface{}, len(mapping))
+		for key, item := range mapping {
+			out[key] = item.value
+		}
+		v.value = out
+		return nil
+	}
+
+	var list []refValue
+	if err := unmarshal(&list); err == nil && list != nil {
+		out := make([]interface{}, len(list))
+		for i, item := range list {
+			out[i] = item.value
+		}
+		v.value = out
+		return nil
+	}
+
+	if err := unmarshal(&v.value); err != nil {
+		return err
+	}
+	switch v.value.(type) {
+	case string, nil:
+	default:
+		// Into a string, a scalar is the text it was written as
+		var text string
+		if err := unmarshal(&text); err != nil {
+			return err
+		}
+		v.value = refScalar(text)
+	}
+	return nil
+}
+
+type refExpander struct {
+	path      string
+	defs      map[interface{}]interface{}
+	expanding map[string]bool
+}
+
+// The value with its references expanded, ok false when it uses an undefined one and should be left out
+func (r *refExpander) expand(value interface{}) (interface{}, bool, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		if name, ok := v[REF_USE]; ok {
+			return r.use(fmt.Sprint(name), v)
+		}
+
+		out := make(map[interface{}]interface{}, len(v))
+		for key, item := range v {
+			expanded, ok, err := r.expand(item)
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				out[key] = expanded
+			}
+		}
+		return out, true, nil
+
+	case []interface{}:
+		out := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			expanded, ok, err := r.expand(item)
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				out = append(out, expanded)
+			}
+		}
+		return out, true, nil
+	}
+
+	return value, true, nil
+}
+
+func (r *refExpander) use(name string, site map[interface{}]interface{}) (interface{}, bool, error) {
+	def, ok := r.defs[name]
+	if !ok {
+		if *strict {
+			return nil, false, fmt.Errorf("%s: %s %q is not defined", r.path, REF_USE, name)
+		}
+		log.WithFields(log.Fields{"path": r.path, "ref": name}).Warnf("Leaving out a value that uses an undefined %s", REF_USE)
+		validationWarning(r.path, "Leaving out a value that uses undefined %s %q", REF_USE, name)
+		return nil, false, nil
+	}
+
+	if r.expanding[name] {
+		return nil, false, fmt.Errorf("%s: %s %q refers to itself", r.path, REF_DEFS, name)
+	}
+	r.expanding[name] = true
+	expanded, ok, err := r.expand(def)
+	delete(r.expanding, name)
+	if err != nil || !ok || len(site) == 1 {
+		return expanded, ok, err
+	}
+
+	// Keys next to "$use" override the definition's
+	fields, isMap := expanded.(map[interface{}]interface{})
+	if !isMap {
+		return nil, false, fmt.Errorf("%s: %s %q isn't a map, it can't have other keys next to it", r.path, REF_USE, name)
+	}
+	out := make(map[interface{}]interface{}, len(fields)+len(site))
+	for key, item := range fields {
+		out[key] = item
+	}
+	for key, item := range site {
+		if key == REF_USE {
+			continue
+		}
+		expanded, ok, err := r.expand(item)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			out[key] = expanded
+		}
+	}
+	return out, true, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Geo-routing by region. The "default" section's "regions" map names the networks clients of each region are in,
+// and an A record's "regionprefs" lists the addresses preferred for each region. A client in a region with
+// preferences is answered with only those, unless none of them is left after draining and health checks.
+
+// A network of a region, see prepareNetworks
+type regionNetwork struct {
+	region  string
+	network *net.IPNet
+}
+
+// The region of the client, the one with the most specific network containing it
+func (answers *Answers) regionOf(clientAddr string) (string, bool) {
+	ip := net.ParseIP(clientAddr)
+	if ip == nil {
+		return "", false
+	}
+
+	best, bestOnes := "", -1
+	for _, rn := range (*answers)[DEFAULT_KEY].regionNetworks {
+		if ones, _ := rn.network.Mask.Size(); rn.network.Contains(ip) && ones > bestOnes {
+			best, bestOnes = rn.region, ones
+		}
+	}
+	return best, bestOnes >= 0
+}
+
+// The networks of every region, in the order of the regions' names so that the first of two equally specific
+// networks wins
+func parseRegions(regions map[string][]string) []regionNetwork {
+	var out []regionNetwork
+	for _, region := range sortedKeys(regions) {
+		parsed, err := parseNetworks(strings.Join(regions[region], ","), "region network")
+		if err != nil {
+			continue
+		}
+		for _, network := range parsed {
+			out = append(out, regionNetwork{region: region, network: network})
+		}
+	}
+	return out
+}
+
+// The addresses preferred for the region, in their order in the pool, or the whole pool if none of them is in it
+func preferRegion(addrs []string, preferred []string) []string {
+	var out []string
+	for _, addr := range addrs {
+		if contains(preferred, addr) {
+			out = append(out, addr)
+		}
+	}
+
+	if len(out) == 0 {
+		return addrs
+	}
+	return out
+}
+
+func validateRegions(regions map[string][]string) error {
+	for region, networks := range regions {
+		if _, err := parseNetworks(strings.Join(networks, ","), "region network"); err != nil {
+			return fmt.Errorf("%s: %v", region, err)
+		}
+	}
+	return nil
+}
+
+// Every region the record has preferences for must be one the default section defines. Files in --answers-dir
+// are checked without the answers file's regions, so only the names' addresses are.
+func validateRegionPrefs(prefs map[string][]string, regions map[string][]string) error {
+	if len(regions) == 0 {
+		return nil
+	}
+	for _, region := range sortedKeys(prefs) {
+		if _, ok := regions[region]; !ok {
+			return fmt.Errorf("Unknown region %s", region)
+		}
+	}
+	return nil
+}
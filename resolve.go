@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -8,10 +12,17 @@ import (
 	"strings"
 )
 
-func ResolveTryAll(req *dns.Msg, resolvers []string) (resp *dns.Msg, err error) {
+// Local address recursive queries originate from, nil to let the OS pick
+var recurseSourceIp net.IP
+
+func ResolveTryAll(ctx context.Context, req *dns.Msg, resolvers []string) (resp *dns.Msg, err error) {
 	for _, resolver := range resolvers {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		log.WithFields(log.Fields{"fqdn": req.Question[0].Name, "resolver": resolver}).Debug("Recursing")
-		resp, err = Resolve(req, resolver)
+		resp, err = Resolve(ctx, req, resolver)
 		if err == nil {
 			break
 		}
@@ -21,34 +32,174 @@ func ResolveTryAll(req *dns.Msg, resolvers []string) (resp *dns.Msg, err error)
 }
 
 // Proxy a request to an external server
-func Resolve(req *dns.Msg, resolver string) (resp *dns.Msg, err error) {
-	resp, err = resolveTransport(req, "udp", resolver)
+func Resolve(ctx context.Context, req *dns.Msg, resolver string) (resp *dns.Msg, err error) {
+	for counter, _ := ctx.Value(recursionsKey{}).(*recursionCounter); counter != nil; counter = counter.parent {
+		atomic.AddInt32(&counter.count, 1)
+	}
+
+	// The whole exchange, a TCP retry included, gets --recurser-timeout, and whatever it still has running
+	// (like the goroutine closing the connection) is cancelled once it is over
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(*recurserTimeout)*time.Second)
+	defer cancel()
+
+	clientOpt := req.IsEdns0()
+	req = withRecurseUdpSize(req)
+
+	resp, err = resolveTransport(ctx, req, "udp", resolver)
+
+	// A truncated answer may unpack cleanly or come back with ErrTruncated,
+	// either way the full answer has to be fetched over TCP from the same host
+	if resp != nil && resp.Truncated && (err == nil || err == dns.ErrTruncated) {
+		log.WithFields(log.Fields{"fqdn": req.Question[0].Name, "resolver": resolver}).Debug("Response truncated, retrying with TCP")
+		resp, err = resolveTransport(ctx, req, "tcp", resolver)
+	}
+
 	if err != nil {
-		if resp != nil && resp.Truncated {
-			log.Debug("Response truncated, retrying with TCP")
-			resp, err = resolveTransport(req, "tcp", resolver)
-		} else {
-			log.WithFields(log.Fields{"fqdn": req.Question[0].Name, "resolver": resolver}).Warn("Recurser error: ", err)
+		log.WithFields(log.Fields{"fqdn": req.Question[0].Name, "resolver": resolver}).Warn("Recurser error: ", err)
+		traceHop(ctx, "%s %s recursed to %s failed: %v", dns.TypeToString[req.Question[0].Qtype], req.Question[0].Name, resolver, err)
+	} else {
+		traceHop(ctx, "%s %s recursed to %s: %s, %d records", dns.TypeToString[req.Question[0].Qtype], req.Question[0].Name, resolver, dns.RcodeToString[resp.Rcode], len(resp.Answer))
+		if clientOpt == nil {
+			// The OPT was ours, a client that didn't send one mustn't get one back
+			resp.Extra = withoutOpt(resp.Extra)
 		}
 	}
 
 	return
 }
 
-func resolveTransport(req *dns.Msg, transport, resolver string) (resp *dns.Msg, err error) {
+// The query to send upstream, advertising --recurse-udp-size so larger answers don't need TCP
+func withRecurseUdpSize(req *dns.Msg) *dns.Msg {
+	if *recurseUdpSize == 0 {
+		return req
+	}
+
+	out := req.Copy()
+	if opt := out.IsEdns0(); opt != nil {
+		opt.SetUDPSize(uint16(*recurseUdpSize))
+	} else {
+		out.SetEdns0(uint16(*recurseUdpSize), false)
+	}
+	return out
+}
+
+func withoutOpt(rrs []dns.RR) []dns.RR {
+	var out []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+type recursionsKey struct{}
+
+// Counters nest, an upstream query counts for every one of them
+type recursionCounter struct {
+	count  int32
+	parent *recursionCounter
+}
+
+// A context that counts the upstream queries made with it
+func countRecursions(ctx context.Context) (context.Context, *int32) {
+	parent, _ := ctx.Value(recursionsKey{}).(*recursionCounter)
+	counter := &recursionCounter{parent: parent}
+	return context.WithValue(ctx, recursionsKey{}, counter), &counter.count
+}
+
+type unresolvedKey struct{}
+
+// A context that counts the names that could not be resolved because upstream failed or was out of reach
+func countUnresolved(ctx context.Context) (context.Context, *int32) {
+	var count int32
+	return context.WithValue(ctx, unresolvedKey{}, &count), &count
+}
+
+// Notes that a name could not be resolved, for whoever is counting
+func markUnresolved(ctx context.Context) {
+	if count, ok := ctx.Value(unresolvedKey{}).(*int32); ok {
+		atomic.AddInt32(count, 1)
+	}
+}
+
+// The dns.Client can neither be cancelled nor told which local address to use, so dial the connection ourselves
+func resolveTransport(ctx context.Context, req *dns.Msg, transport, resolver string) (resp *dns.Msg, err error) {
 	// Default to port 53
 	if !strings.Contains(resolver, ":") {
 		resolver = resolver + ":53"
 	}
 
 	t := time.Duration(*recurserTimeout) * time.Second
-	c := &dns.Client{
-		Net:          transport,
-		DialTimeout:  t,
-		ReadTimeout:  t,
-		WriteTimeout: t,
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(t)
+	}
+	d := net.Dialer{Deadline: deadline}
+	if recurseSourceIp != nil {
+		if transport == "tcp" {
+			d.LocalAddr = &net.TCPAddr{IP: recurseSourceIp}
+		} else {
+			d.LocalAddr = &net.UDPAddr{IP: recurseSourceIp}
+		}
+	}
+
+	conn, err := d.DialContext(ctx, transport, resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	co := &dns.Conn{Conn: conn}
+	defer co.Close()
+
+	// Closing the connection is what unblocks a pending read when the context is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			co.Close()
+		case <-done:
+		}
+	}()
+
+	if opt := req.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		co.UDPSize = opt.UDPSize()
 	}
 
-	resp, _, err = c.Exchange(req, resolver)
+	co.SetDeadline(deadline)
+	if err = co.WriteMsg(req); err != nil {
+		return nil, err
+	}
+
+	resp, err = co.ReadMsg()
+	if err == nil && resp.Id != req.Id {
+		err = dns.ErrId
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
 	return
 }
+
+// Make sure the recursion source address is one this host actually has
+func setRecurseSource(source string) error {
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return fmt.Errorf("Invalid IP address: %s", source)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			recurseSourceIp = ip
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s is not bound to a local interface", source)
+}
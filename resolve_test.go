@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/check.v1"
+)
+
+type ResolveTests struct{}
+
+var _ = check.Suite(&ResolveTests{})
+
+func (t *ResolveTests) TestCancel(c *check.C) {
+	// Never answers
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer pc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	_, err = ResolveTryAll(ctx, req, []string{pc.LocalAddr().String(), pc.LocalAddr().String()})
+	c.Check(err, check.Equals, context.Canceled)
+	c.Check(time.Since(start) < time.Second, check.Equals, true)
+}
+
+func (t *ResolveTests) TestExchangeTimeout(c *check.C) {
+	// Answers truncated after a while, then never over TCP
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	c.Assert(err, check.IsNil)
+	defer l.Close()
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(700 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Truncated = true
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	*recurserTimeout = 1
+	defer func() { *recurserTimeout = 2 }()
+
+	// The TCP retry only gets what is left of --recurser-timeout
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	_, err = Resolve(context.Background(), req, pc.LocalAddr().String())
+	c.Check(err, check.NotNil)
+	c.Check(time.Since(start) < 1500*time.Millisecond, check.Equals, true)
+}
+
+func (t *ResolveTests) TestCountRecursions(c *check.C) {
+	upstream, _, stop := startUpstream(c)
+	defer stop()
+
+	ctx, recursions := countRecursions(context.Background())
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	_, err := ResolveTryAll(ctx, req, []string{upstream})
+	c.Assert(err, check.IsNil)
+	c.Check(atomic.LoadInt32(recursions), check.Equals, int32(1))
+}
+
+func (t *ResolveTests) TestRecurserNames(c *check.C) {
+	lookups := map[string][]string{"resolver.internal": {"10.0.0.2", "10.0.0.1"}}
+	lookupHost = func(host string) ([]string, error) {
+		if addrs, ok := lookups[host]; ok {
+			return addrs, nil
+		}
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	defer func() {
+		lookupHost = net.LookupHost
+		resolveRecurserNames(Answers{})
+	}()
+
+	answers := Answers{
+		"10.1.1.2": ClientAnswers{Recurse: []string{"resolver.internal:5353"}},
+		DEFAULT_KEY: ClientAnswers{
+			Recurse: []string{"8.8.8.8", "resolver.internal", "missing.internal"},
+		},
+	}
+	resolveRecurserNames(answers)
+	c.Check(answers.Recursers("10.1.1.1"), check.DeepEquals, []string{"8.8.8.8", "10.0.0.1:53", "10.0.0.2:53"})
+	c.Check(answers.Recursers("10.1.1.2"), check.DeepEquals, []string{"10.0.0.1:5353", "10.0.0.2:5353", "8.8.8.8", "10.0.0.1:53", "10.0.0.2:53"})
+
+	// A failed lookup keeps the last known addresses
+	delete(lookups, "resolver.internal")
+	resolveRecurserNames(answers)
+	c.Check(answers.Recursers("10.1.1.1"), check.DeepEquals, []string{"8.8.8.8", "10.0.0.1:53", "10.0.0.2:53"})
+}
+
+func (t *ResolveTests) TestTruncatedRetriesTcp(c *check.C) {
+	// The upstream only has room for the full answer over TCP
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	c.Assert(err, check.IsNil)
+
+	var tcpQueries int32
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+			atomic.AddInt32(&tcpQueries, 1)
+			for i := 1; i <= 40; i++ {
+				hdr := dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}
+				m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.ParseIP(fmt.Sprintf("10.0.0.%d", i))})
+			}
+		} else {
+			m.Truncated = true
+		}
+		w.WriteMsg(m)
+	})
+
+	udp := &dns.Server{PacketConn: pc, Handler: handler}
+	tcp := &dns.Server{Listener: l, Handler: handler}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	defer udp.Shutdown()
+	defer tcp.Shutdown()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp, err := ResolveTryAll(context.Background(), req, []string{pc.LocalAddr().String()})
+	c.Assert(err, check.IsNil)
+	c.Check(resp.Truncated, check.Equals, false)
+	c.Check(resp.Answer, check.HasLen, 40)
+	c.Check(atomic.LoadInt32(&tcpQueries), check.Equals, int32(1))
+}
+
+func (t *ResolveTests) TestRecurseUdpSize(c *check.C) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+
+	var advertised int32
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		atomic.StoreInt32(&advertised, 0)
+		if opt := req.IsEdns0(); opt != nil {
+			atomic.StoreInt32(&advertised, int32(opt.UDPSize()))
+			m.SetEdns0(4096, false)
+		}
+		w.WriteMsg(m)
+	})
+	server := &dns.Server{PacketConn: pc, Handler: handler}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	upstream := []string{pc.LocalAddr().String()}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	// Not the client's EDNS, so it is taken back out of the response
+	resp, err := ResolveTryAll(context.Background(), req, upstream)
+	c.Assert(err, check.IsNil)
+	c.Check(atomic.LoadInt32(&advertised), check.Equals, int32(1232))
+	c.Check(resp.IsEdns0(), check.IsNil)
+	c.Check(req.IsEdns0(), check.IsNil)
+
+	req.SetEdns0(512, true)
+	resp, err = ResolveTryAll(context.Background(), req, upstream)
+	c.Assert(err, check.IsNil)
+	c.Check(atomic.LoadInt32(&advertised), check.Equals, int32(1232))
+	c.Check(resp.IsEdns0(), check.NotNil)
+	c.Check(req.IsEdns0().UDPSize(), check.Equals, uint16(512))
+
+	*recurseUdpSize = 0
+	defer func() { *recurseUdpSize = 1232 }()
+	req = new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	_, err = ResolveTryAll(context.Background(), req, upstream)
+	c.Assert(err, check.IsNil)
+	c.Check(atomic.LoadInt32(&advertised), check.Equals, int32(0))
+}
@@ -20,6 +20,11 @@ func Respond(w dns.ResponseWriter, req *dns.Msg, m *dns.Msg) {
 		bufsize = 512
 	}
 
+	// Whatever the client advertises, cap UDP responses so they can't be used for amplification
+	if !tcp && *maxResponse > 0 && bufsize > uint16(*maxResponse) {
+		bufsize = uint16(*maxResponse)
+	}
+
 	// Make sure the payload fits the buffer size. If the message is too large we strip the Extra section.
 	// If it's still too large we return a truncated message for UDP queries and ServerFailure for TCP queries.
 	if m.Len() > int(bufsize) {
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Swapped out by tests
+var now = time.Now
+
+const minutesPerDay = 24 * 60
+
+// The weights in effect at the given time
+func (rec RecordA) ActiveWeights(t time.Time) map[string]int {
+	minute := t.Hour()*60 + t.Minute()
+	for _, window := range rec.Schedule {
+		from, to, err := window.minutes()
+		if err != nil {
+			continue
+		}
+		if inWindow(minute, from, to) {
+			return window.Weights
+		}
+	}
+
+	return rec.Weights
+}
+
+func (w WeightSchedule) minutes() (from int, to int, err error) {
+	start, err := time.Parse("15:04", w.From)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid schedule start %q", w.From)
+	}
+	end, err := time.Parse("15:04", w.To)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid schedule end %q", w.To)
+	}
+
+	return start.Hour()*60 + start.Minute(), end.Hour()*60 + end.Minute(), nil
+}
+
+func inWindow(minute, from, to int) bool {
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// Schedule windows must be well-formed and must not overlap, otherwise which weights apply would be ambiguous
+func validateSchedule(schedule []WeightSchedule) error {
+	covered := make([]int, minutesPerDay)
+	for i, window := range schedule {
+		from, to, err := window.minutes()
+		if err != nil {
+			return err
+		}
+		if from == to {
+			return fmt.Errorf("Schedule window %s-%s is empty", window.From, window.To)
+		}
+
+		for minute := 0; minute < minutesPerDay; minute++ {
+			if !inWindow(minute, from, to) {
+				continue
+			}
+			if covered[minute] != 0 {
+				other := schedule[covered[minute]-1]
+				return fmt.Errorf("Schedule windows %s-%s and %s-%s overlap", other.From, other.To, window.From, window.To)
+			}
+			covered[minute] = i + 1
+		}
+	}
+
+	return nil
+}
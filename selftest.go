@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/cache"
+)
+
+// A query to send and what the answer has to look like
+type selfCheck struct {
+	name   string
+	qtype  uint16
+	expect func(m *dns.Msg) error
+}
+
+// Serves the loaded answers on an ephemeral loopback port, sends one query for each record type
+// in the default answers and reports how each went. Returns the exit code.
+func selftest() int {
+	globalCache = cache.New(int(*cacheCapacity), int(*defaultTtl))
+	clientSpecificCaches = make(map[string]*cache.Cache)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Printf("FAIL cannot listen: %v\n", err)
+		return 1
+	}
+
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(route), NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	defer server.Shutdown()
+
+	checks := selftestChecks(getAnswers())
+	if len(checks) == 0 {
+		fmt.Println("FAIL no records to test in the default answers")
+		return 1
+	}
+
+	failed := runSelftest(pc.LocalAddr().String(), checks)
+	fmt.Printf("%d passed, %d failed\n", len(checks)-failed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func runSelftest(addr string, checks []selfCheck) (failed int) {
+	client := &dns.Client{DialTimeout: time.Second, ReadTimeout: time.Second, WriteTimeout: time.Second}
+	for _, check := range checks {
+		req := new(dns.Msg)
+		req.SetQuestion(check.name, check.qtype)
+		resp, _, err := client.Exchange(req, addr)
+		if err == nil {
+			err = check.expect(resp)
+		}
+
+		qtype := dns.TypeToString[check.qtype]
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s %s: %v\n", qtype, check.name, err)
+		} else {
+			fmt.Printf("PASS %s %s\n", qtype, check.name)
+		}
+	}
+
+	return
+}
+
+// The first name (alphabetically) of each record type in the default answers
+func selftestChecks(answers Answers) []selfCheck {
+	var checks []selfCheck
+	defaults := answers[DEFAULT_KEY]
+
+	usable := func(names []string) (string, bool) {
+		for _, name := range names {
+			if _, _, delegated := answers.DelegationFor("127.0.0.1", name); !delegated {
+				return name, true
+			}
+		}
+		return "", false
+	}
+
+	if name, ok := usable(sortedKeys(defaults.A)); ok {
+		rec := defaults.A[name]
+		allowed := append([]string{rec.Canary}, rec.Answer...)
+		checks = append(checks, selfCheck{name, dns.TypeA, func(m *dns.Msg) error {
+			found := 0
+			for _, rr := range m.Answer {
+				if a, ok := rr.(*dns.A); ok {
+					if !contains(allowed, a.A.String()) {
+						return fmt.Errorf("unexpected address %s", a.A)
+					}
+					found++
+				}
+			}
+			if found == 0 {
+				return fmt.Errorf("no addresses in %s answer", dns.RcodeToString[m.Rcode])
+			}
+			return nil
+		}})
+	}
+
+	if name, ok := usable(sortedKeys(defaults.Cname)); ok {
+		target := dns.Fqdn(defaults.Cname[name].Answer)
+		checks = append(checks, selfCheck{name, dns.TypeCNAME, func(m *dns.Msg) error {
+			if len(m.Answer) == 0 {
+				return fmt.Errorf("no CNAME in %s answer", dns.RcodeToString[m.Rcode])
+			}
+			if cname, ok := m.Answer[0].(*dns.CNAME); !ok || cname.Target != target {
+				return fmt.Errorf("expected %s, got %s", target, m.Answer[0])
+			}
+			return nil
+		}})
+	}
+
+	if name, ok := usable(sortedKeys(defaults.Ptr)); ok {
+		target := defaults.Ptr[name].Answer
+		checks = append(checks, selfCheck{name, dns.TypePTR, func(m *dns.Msg) error {
+			if len(m.Answer) == 0 {
+				return fmt.Errorf("no PTR in %s answer", dns.RcodeToString[m.Rcode])
+			}
+			if ptr, ok := m.Answer[0].(*dns.PTR); !ok || ptr.Ptr != target {
+				return fmt.Errorf("expected %s, got %s", target, m.Answer[0])
+			}
+			return nil
+		}})
+	}
+
+	if name, ok := usable(sortedKeys(defaults.Txt)); ok {
+		expected := append([]string{}, defaults.Txt[name].Answer...)
+		sort.Strings(expected)
+		checks = append(checks, selfCheck{name, dns.TypeTXT, func(m *dns.Msg) error {
+			var got []string
+			for _, rr := range m.Answer {
+				if txt, ok := rr.(*dns.TXT); ok {
+					got = append(got, strings.Join(txt.Txt, ""))
+				}
+			}
+			sort.Strings(got)
+			if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+				return fmt.Errorf("expected %q, got %q", expected, got)
+			}
+			return nil
+		}})
+	}
+
+	return checks
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type SelftestTests struct{}
+
+var _ = check.Suite(&SelftestTests{})
+
+func (t *SelftestTests) TestSelftest(c *check.C) {
+	setAnswers(Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"web.": {Answer: []string{"10.0.0.1", "10.0.0.2"}},
+			},
+			Cname: map[string]RecordCname{
+				"www.": {Answer: "web."},
+			},
+			Txt: map[string]RecordTxt{
+				"web.": {Answer: []string{"one", "two"}},
+			},
+		},
+	})
+	c.Check(selftestChecks(getAnswers()), check.HasLen, 3)
+	c.Check(selftest(), check.Equals, 0)
+
+	setAnswers(Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Txt: map[string]RecordTxt{
+				"web.": {Answer: []string{strings.Repeat("x", 300)}},
+			},
+		},
+	})
+	c.Check(selftest(), check.Equals, 1)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SOA serials per zone, the time (in seconds since the epoch) of the reload that last changed the zone's records.
+// Being times they keep going up across restarts, which secondaries rely on. Each instance has its own, by name,
+// the main answers' are under "".
+var (
+	serialsMutex sync.RWMutex
+	zoneSerials  = make(map[string]map[string]uint32)
+	zoneDigests  = make(map[string]map[string]string)
+	startSerial  = uint32(time.Now().Unix())
+)
+
+func zoneSerial(zone string) uint32 {
+	return instanceZoneSerial("", zone)
+}
+
+func instanceZoneSerial(instance string, zone string) uint32 {
+	serialsMutex.RLock()
+	defer serialsMutex.RUnlock()
+	if serial, ok := zoneSerials[instance][zone]; ok {
+		return serial
+	}
+	return startSerial
+}
+
+func updateSerials(answers Answers) {
+	updateInstanceSerials("", answers)
+}
+
+func updateInstanceSerials(instance string, answers Answers) {
+	digests := answers.zoneDigests()
+	serial := uint32(now().Unix())
+
+	serialsMutex.Lock()
+	defer serialsMutex.Unlock()
+	serials := zoneSerials[instance]
+	if serials == nil {
+		serials = make(map[string]uint32)
+		zoneSerials[instance] = serials
+	}
+	for zone, digest := range digests {
+		if old, ok := zoneDigests[instance][zone]; ok && old == digest {
+			continue
+		}
+		// Two changes within a second, or a clock that went back, still get a higher serial
+		if old, ok := serials[zone]; ok && serial <= old {
+			serials[zone] = old + 1
+		} else {
+			serials[zone] = serial
+		}
+	}
+	zoneDigests[instance] = digests
+}
+
+// A hash of all the records in each zone, for every client
+func (answers *Answers) zoneDigests() map[string]string {
+	hashes := make(map[string]hash.Hash)
+	write := func(name string, format string, args ...interface{}) {
+		zone := answers.zoneOf(name)
+		h, ok := hashes[zone]
+		if !ok {
+			h = sha1.New()
+			hashes[zone] = h
+		}
+		fmt.Fprintf(h, format+"\n", args...)
+	}
+
+	keys := []string{}
+	for key := range *answers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writeA := func(key, kind, name string, rec RecordA) {
+		write(name, "%s %s %s %s %s %s %d %s %d %t %t %s %s", key, kind, name, ttlString(rec.Ttl), strings.Join(rec.Answer, ","), rec.Canary, rec.Limit, weightsString(rec.Weights), rec.HealthPort, rec.FallbackRecurse, rec.ExcludeSelf, healthyTtlsString(rec.HealthyTtls), rec.RecurseWhenUp)
+		for _, window := range rec.Schedule {
+			write(name, "%s %s %s schedule %s-%s %s", key, kind, name, window.From, window.To, weightsString(window.Weights))
+		}
+		for _, region := range sortedKeys(rec.RegionPrefs) {
+			write(name, "%s %s %s region %s %s", key, kind, name, region, strings.Join(rec.RegionPrefs[region], ","))
+		}
+	}
+
+	for _, key := range keys {
+		client := (*answers)[key]
+		for _, name := range sortedKeys(client.A) {
+			writeA(key, "A", name, client.A[name])
+		}
+		for _, name := range sortedKeys(client.SuffixDefaults) {
+			writeA(key, "SUFFIX-A", name, client.SuffixDefaults[name])
+		}
+		for _, name := range sortedKeys(client.Cname) {
+			rec := client.Cname[name]
+			write(name, "%s CNAME %s %s %s %s %d", key, name, ttlString(rec.Ttl), rec.Answer, weightsString(rec.Targets), rec.HealthPort)
+		}
+		for _, name := range sortedKeys(client.Ptr) {
+			rec := client.Ptr[name]
+			write(name, "%s PTR %s %s %s", key, name, ttlString(rec.Ttl), rec.Answer)
+		}
+		for _, name := range sortedKeys(client.Alias) {
+			rec := client.Alias[name]
+			write(name, "%s ALIAS %s %s %s", key, name, ttlString(rec.Ttl), rec.Answer)
+		}
+		for _, name := range sortedKeys(client.Txt) {
+			rec := client.Txt[name]
+			write(name, "%s TXT %s %s %q", key, name, ttlString(rec.Ttl), rec.Answer)
+		}
+		for _, p := range client.Patterns {
+			write(p.Match, "%s PATTERN %s %s %s", key, p.Match, ttlString(p.Ttl), p.Answer)
+			for _, k := range sortedKeys(p.Lookup) {
+				write(p.Match, "%s PATTERN %s lookup %s %s", key, p.Match, k, p.Lookup[k])
+			}
+		}
+		for _, name := range sortedKeys(client.Srv) {
+			for _, rec := range client.Srv[name] {
+				write(name, "%s SRV %s %s %d %d %d %s", key, name, ttlString(rec.Ttl), rec.Priority, rec.Weight, rec.Port, rec.Target)
+			}
+		}
+		for _, name := range sortedKeys(client.Https) {
+			for _, rec := range client.Https[name] {
+				write(name, "%s HTTPS %s %s %d %s %s %d %s %s", key, name, ttlString(rec.Ttl), rec.Priority, rec.Target, strings.Join(rec.Alpn, ","), rec.Port, strings.Join(rec.Ipv4Hint, ","), strings.Join(rec.Ipv6Hint, ","))
+			}
+		}
+		for _, name := range sortedKeys(client.Tlsa) {
+			for _, rec := range client.Tlsa[name] {
+				write(name, "%s TLSA %s %s %d %d %d %s", key, name, ttlString(rec.Ttl), rec.Usage, rec.Selector, rec.MatchingType, rec.Certificate)
+			}
+		}
+	}
+
+	digests := make(map[string]string)
+	for zone, h := range hashes {
+		digests[zone] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	return digests
+}
+
+func ttlString(ttl *uint32) string {
+	if ttl == nil {
+		return "-"
+	}
+	return fmt.Sprint(*ttl)
+}
+
+// The keys of any of the record maps, sorted. Panics on a type of map it doesn't know.
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch records := m.(type) {
+	case map[string]RecordA:
+		for k := range records {
+			keys = append(keys, k)
+		}
+	case map[string]RecordCname:
+		for k := range records {
+			keys = append(keys, k)
+		}
+	case map[string]RecordPtr:
+		for k := range records {
+			keys = append(keys, k)
+		}
+	case map[string]RecordAlias:
+		for k := range records {
+			keys = append(keys, k)
+		}
+	case map[string]RecordTxt:
+		for k := range records {
+			keys = append(keys, k)
+		}
+	case map[string][]RecordTlsa:
+		for k := range records {
+			keys = append(keys, k)
+		}
+	case map[string][]RecordSrv:
+		for k := range records {
+			keys = append(keys, k)
+		}
+	case map[string][]RecordHttps:
+		for k := range records {
+			keys = append(keys, k)
+		}
+	case map[string]string:
+		for k := range records {
+			keys = append(keys, k)
+		}
+	case map[string]int:
+		for k := range records {
+			keys = append(keys, k)
+		}
+	case map[string][]string:
+		for k := range records {
+			keys = append(keys, k)
+		}
+	default:
+		// A new kind of map has to be added above, silently having no keys would leave its records out
+		panic(fmt.Sprintf("sortedKeys: unsupported map type %T", m))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func healthyTtlsString(steps []HealthyTtl) string {
+	parts := make([]string, len(steps))
+	for i, step := range steps {
+		parts[i] = fmt.Sprintf("%d=%d", step.Healthy, step.Ttl)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func weightsString(weights map[string]int) string {
+	addrs := sortedKeys(weights)
+	parts := make([]string, len(addrs))
+	for i, addr := range addrs {
+		parts[i] = fmt.Sprintf("%s=%d", addr, weights[addr])
+	}
+	return strings.Join(parts, ",")
+}
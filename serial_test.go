@@ -0,0 +1,75 @@
+package main
+
+import (
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type SerialTests struct{}
+
+var _ = check.Suite(&SerialTests{})
+
+func serialAnswers(web string) Answers {
+	return Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Authoritative: []string{"one.internal", "two.internal"},
+			A: map[string]RecordA{
+				"web.one.internal.": {Answer: []string{web}},
+				"db.two.internal.":  {Answer: []string{"10.0.2.1"}},
+			},
+		},
+	}
+}
+
+func (t *SerialTests) TestSerialBumpedOnChange(c *check.C) {
+	// All within the same second
+	start := time.Now()
+	defer func() { now = time.Now }()
+	now = func() time.Time { return start }
+
+	updateSerials(serialAnswers("10.0.1.1"))
+	one := zoneSerial("one.internal.")
+	two := zoneSerial("two.internal.")
+
+	// Nothing changed
+	updateSerials(serialAnswers("10.0.1.1"))
+	c.Check(zoneSerial("one.internal."), check.Equals, one)
+	c.Check(zoneSerial("two.internal."), check.Equals, two)
+
+	// Only the zone that changed gets a new serial
+	updateSerials(serialAnswers("10.0.1.2"))
+	c.Check(zoneSerial("one.internal."), check.Equals, one+1)
+	c.Check(zoneSerial("two.internal."), check.Equals, two)
+
+	// An instance's answers have serials of their own
+	updateInstanceSerials("green", serialAnswers("10.0.1.3"))
+	c.Check(instanceZoneSerial("green", "one.internal."), check.Equals, one)
+	updateInstanceSerials("green", serialAnswers("10.0.1.4"))
+	c.Check(instanceZoneSerial("green", "one.internal."), check.Equals, one+1)
+	c.Check(zoneSerial("one.internal."), check.Equals, one+1)
+}
+
+func (t *SerialTests) TestSerialIsTime(c *check.C) {
+	defer func() { now = time.Now }()
+	zoneSerials, zoneDigests = make(map[string]map[string]uint32), make(map[string]map[string]string)
+	now = func() time.Time { return time.Unix(1500000000, 0) }
+	updateSerials(serialAnswers("10.0.3.1"))
+	c.Check(zoneSerial("one.internal."), check.Equals, uint32(1500000000))
+
+	// After a restart, a later change has a higher serial
+	zoneSerials, zoneDigests = make(map[string]map[string]uint32), make(map[string]map[string]string)
+	now = func() time.Time { return time.Unix(1500000100, 0) }
+	updateSerials(serialAnswers("10.0.3.2"))
+	c.Check(zoneSerial("one.internal."), check.Equals, uint32(1500000100))
+
+	// And a clock that went back doesn't make it go down
+	now = func() time.Time { return time.Unix(1400000000, 0) }
+	updateSerials(serialAnswers("10.0.3.3"))
+	c.Check(zoneSerial("one.internal."), check.Equals, uint32(1500000101))
+}
+
+func (t *SerialTests) TestSortedKeys(c *check.C) {
+	c.Check(sortedKeys(map[string]int{"b": 1, "a": 2}), check.DeepEquals, []string{"a", "b"})
+	c.Check(func() { sortedKeys(map[string]bool{"a": true}) }, check.PanicMatches, "sortedKeys: unsupported map type map\\[string\\]bool")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Clients allowed to pick their address with a session token
+var sessionClients []*net.IPNet
+
+func parseSessionClients(list string) (err error) {
+	sessionClients, err = parseNetworks(list, "session client")
+	return err
+}
+
+func sessionClientAllowed(clientIp string) bool {
+	return inNetworks(sessionClients, clientIp)
+}
+
+// Parses a comma-delimited list of IP addresses and CIDRs
+func parseNetworks(list string, what string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range splitTrim(list, ",") {
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry = entry + "/32"
+			} else {
+				entry = entry + "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s %s: %v", what, entry, err)
+		}
+		networks = append(networks, ipNet)
+	}
+
+	return networks, nil
+}
+
+func inNetworks(networks []*net.IPNet, clientIp string) bool {
+	ip := net.ParseIP(clientIp)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range networks {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The session token the client sent in the configured EDNS option, if it is allowed to send one
+func sessionToken(clientIp string, req *dns.Msg) string {
+	if *sessionOption == 0 {
+		return ""
+	}
+
+	opt := req.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+
+	for _, option := range opt.Option {
+		local, ok := option.(*dns.EDNS0_LOCAL)
+		if !ok || local.Code != uint16(*sessionOption) || len(local.Data) == 0 {
+			continue
+		}
+
+		if !sessionClientAllowed(clientIp) {
+			return ""
+		}
+		return string(local.Data)
+	}
+
+	return ""
+}
+
+// Puts the A/AAAA records in an order that only depends on the token and the addresses in the pool,
+// so the same token keeps getting the same first address. CNAME records at the start are left alone.
+func stickyOrder(items *[]dns.RR, token string) {
+	start := 0
+	for start < len(*items) {
+		rrtype := (*items)[start].Header().Rrtype
+		if rrtype == dns.TypeA || rrtype == dns.TypeAAAA {
+			break
+		}
+		start++
+	}
+
+	pool := (*items)[start:]
+	if len(pool) <= 1 {
+		return
+	}
+
+	sort.Sort(byAddress(pool))
+
+	h := fnv.New32a()
+	h.Write([]byte(token))
+	offset := int(h.Sum32() % uint32(len(pool)))
+
+	rotated := append(append([]dns.RR{}, pool[offset:]...), pool[:offset]...)
+	copy(pool, rotated)
+}
+
+type byAddress []dns.RR
+
+func (r byAddress) Len() int           { return len(r) }
+func (r byAddress) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byAddress) Less(i, j int) bool { return r[i].String() < r[j].String() }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// A second answers file that every query is also answered from, to see what a proposed config would change
+// before promoting it. Only the differences are logged, the shadow answers are never sent to a client.
+var (
+	shadowAnswers Answers
+	shadowMutex   sync.RWMutex
+	shadowResults = newCounterVec("rancher_dns_shadow_queries_total", "Queries also answered from --shadow-answers, by whether the answer was the same", "result")
+)
+
+func loadShadowAnswers() error {
+	parsed, err := ParseAnswers(*shadowFile)
+	if err != nil {
+		return err
+	}
+	prepareAnswers(parsed)
+
+	shadowMutex.Lock()
+	shadowAnswers = parsed
+	shadowMutex.Unlock()
+	log.Infof("Loaded shadow answers")
+	return nil
+}
+
+func getShadowAnswers() Answers {
+	shadowMutex.RLock()
+	defer shadowMutex.RUnlock()
+	return shadowAnswers
+}
+
+// Comparisons waiting for one of the shadow workers. A few workers go through them so a busy server doesn't start a
+// goroutine per query; when the queue is full the comparison is skipped and counted as dropped.
+const (
+	shadowWorkers   = 2
+	shadowQueueSize = 256
+)
+
+type shadowJob struct {
+	live     Answers
+	clientIp string
+	question dns.Question
+}
+
+var shadowQueue chan shadowJob
+
+func startShadowWorkers() {
+	shadowQueue = make(chan shadowJob, shadowQueueSize)
+	for i := 0; i < shadowWorkers; i++ {
+		go func() {
+			for job := range shadowQueue {
+				compareShadow(job.live, job.clientIp, job.question)
+			}
+		}()
+	}
+}
+
+// Queues the comparison of the live answer with the shadow one, unless the workers are too far behind
+func queueShadow(live Answers, clientIp string, question dns.Question) {
+	select {
+	case shadowQueue <- shadowJob{live: live, clientIp: clientIp, question: question}:
+	default:
+		shadowResults.Inc("dropped")
+	}
+}
+
+// Answers the question from the live and the shadow answers, logging when they differ
+func compareShadow(live Answers, clientIp string, question dns.Question) {
+	shadow := getShadowAnswers()
+	if shadow == nil {
+		return
+	}
+
+	fqdn := strings.ToLower(question.Name)
+	want := rrStrings(localAnswer(allCandidates(live), clientIp, question.Qtype, fqdn))
+	got := rrStrings(localAnswer(allCandidates(shadow), clientIp, question.Qtype, fqdn))
+	if strings.Join(want, "\n") == strings.Join(got, "\n") {
+		shadowResults.Inc("same")
+		return
+	}
+
+	shadowResults.Inc("different")
+	log.WithFields(log.Fields{"client": clientIp, "question": fqdn, "type": dns.Type(question.Qtype).String(), "live": want, "shadow": got}).Info("Shadow answers differ")
+}
+
+// The answers with limit and weighted CNAMEs answering with every address and target they could pick from,
+// so that the same records always compare the same. A weighted CNAME is followed to its first target.
+func allCandidates(answers Answers) Answers {
+	out := make(Answers, len(answers))
+	for key, client := range answers {
+		client.allCandidates = true
+		out[key] = client
+	}
+	return out
+}
+
+// What the answers have for the question without recursing, which is cancelled before it starts
+func localAnswer(answers Answers, clientIp string, qtype uint16, fqdn string) []dns.RR {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var records []dns.RR
+	if qtype == dns.TypeA {
+		records, _ = answers.Addresses(ctx, clientIp, fqdn, nil, 1)
+	} else {
+		records, _ = answers.Matching(qtype, clientIp, fqdn)
+	}
+	return records
+}
+
+func rrStrings(records []dns.RR) []string {
+	out := make([]string, 0, len(records))
+	for _, rr := range records {
+		out = append(out, rr.String())
+	}
+	sort.Strings(out)
+	return out
+}
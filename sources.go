@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Somewhere records come from besides the answers file. They are merged into the default answers on every
+// load, the answers file and --answers-dir winning over them.
+type AnswerSource interface {
+	Name() string
+	Fetch() (ClientAnswers, error)
+}
+
+// Keeps the last records a source returned, so a source that is down doesn't take its records with it
+type cachedSource struct {
+	source AnswerSource
+	mutex  sync.RWMutex
+	last   ClientAnswers
+}
+
+var answerSources []*cachedSource
+
+func addAnswerSource(source AnswerSource) {
+	answerSources = append(answerSources, &cachedSource{source: source})
+}
+
+// Fetches the source again, returning whether its records changed
+func (s *cachedSource) refresh() bool {
+	fetched, err := s.source.Fetch()
+	if err != nil {
+		log.WithFields(log.Fields{"source": s.source.Name()}).Warnf("Failed to fetch answers, keeping the previous ones: %v", err)
+		return false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if reflect.DeepEqual(fetched, s.last) {
+		return false
+	}
+	s.last = fetched
+	return true
+}
+
+func (s *cachedSource) answers() ClientAnswers {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.last
+}
+
+func refreshSources() (changed bool) {
+	for _, s := range answerSources {
+		if s.refresh() {
+			changed = true
+		}
+	}
+	return
+}
+
+func mergeSources(into Answers) {
+	if len(answerSources) == 0 {
+		return
+	}
+
+	defaults := into[DEFAULT_KEY]
+	for _, s := range answerSources {
+		mergeAnswers(&defaults, s.answers(), s.source.Name())
+	}
+	into[DEFAULT_KEY] = defaults
+}
+
+// Reloads the answers whenever a source's records change, the same way SIGHUP does
+func watchSources(interval time.Duration) {
+	if len(answerSources) == 0 || interval <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			if refreshSources() {
+				log.Info("Answer sources changed, reloading answers")
+				reloadChan <- nil
+			}
+		}
+	}()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	startTime = time.Now()
+
+	// Clients allowed to query --status-name
+	statusClients []*net.IPNet
+)
+
+func parseStatusClients(list string) (err error) {
+	statusClients, err = parseNetworks(list, "status client")
+	return err
+}
+
+func isStatusName(fqdn string) bool {
+	return *statusName != "" && fqdn == dns.Fqdn(strings.ToLower(*statusName))
+}
+
+// An operational summary as TXT records, for when only DNS can reach us
+func statusRecords(answers Answers, name string) []dns.RR {
+	records := 0
+	for _, client := range answers.Clients() {
+		records += client.Records
+	}
+
+	var reloaded string
+	if loaded := answersLoadedAt(); !loaded.IsZero() {
+		reloaded = loaded.UTC().Format(time.RFC3339)
+	}
+
+	lines := []string{
+		"version=" + VERSION,
+		"uptime=" + (time.Since(startTime) / time.Second * time.Second).String(),
+		"last-reload=" + reloaded,
+		fmt.Sprintf("clients=%d", len(answers)),
+		fmt.Sprintf("records=%d", records),
+		fmt.Sprintf("offline=%t", isOffline()),
+	}
+
+	var out []dns.RR
+	for _, line := range lines {
+		hdr := dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}
+		out = append(out, &dns.TXT{Hdr: hdr, Txt: []string{line}})
+	}
+	return out
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// The steps taken to answer one query, logged as a single line once it is answered
+type resolutionTrace struct {
+	mutex sync.Mutex
+	hops  []string
+}
+
+type traceKey struct{}
+
+// Whether queries for the name are traced, with --trace-resolution and the name in --trace-names (if given)
+func traceEnabled(fqdn string) bool {
+	return *traceResolution && (*traceNames == "" || inZones(fqdn, *traceNames))
+}
+
+// A context the steps of the resolution are recorded in, and a writer that logs them along with the response
+func startTrace(ctx context.Context, w dns.ResponseWriter, clientIp string, question dns.Question) (context.Context, dns.ResponseWriter) {
+	trace := &resolutionTrace{}
+	ctx = context.WithValue(ctx, traceKey{}, trace)
+	return ctx, &traceResponseWriter{ResponseWriter: w, trace: trace, clientIp: clientIp, question: question}
+}
+
+// Records a step of the resolution, if it is being traced
+func traceHop(ctx context.Context, format string, args ...interface{}) {
+	trace, ok := ctx.Value(traceKey{}).(*resolutionTrace)
+	if !ok {
+		return
+	}
+
+	trace.mutex.Lock()
+	trace.hops = append(trace.hops, fmt.Sprintf(format, args...))
+	trace.mutex.Unlock()
+}
+
+type traceResponseWriter struct {
+	dns.ResponseWriter
+	trace    *resolutionTrace
+	clientIp string
+	question dns.Question
+}
+
+func (w *traceResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.trace.mutex.Lock()
+	chain := strings.Join(w.trace.hops, " -> ")
+	w.trace.mutex.Unlock()
+
+	answer := make([]string, len(m.Answer))
+	for i, rr := range m.Answer {
+		answer[i] = strings.Replace(rr.String(), "\t", " ", -1)
+	}
+
+	log.WithFields(log.Fields{
+		"question": w.question.Name,
+		"type":     dns.TypeToString[w.question.Qtype],
+		"client":   w.clientIp,
+		"chain":    chain,
+		"rcode":    dns.RcodeToString[m.Rcode],
+		"answer":   strings.Join(answer, ", "),
+	}).Info("Resolution trace")
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -1,13 +1,54 @@
 package main
 
 type RecordA struct {
-	Ttl    *uint32  `json:"-"`
-	Answer []string `json:"answer"`
+	Ttl      *uint32          `json:"-"`
+	Answer   []string         `json:"answer"`
+	Canary   string           `json:"canary,omitempty"`
+	Limit    int              `json:"limit,omitempty"`
+	Weights  map[string]int   `json:"weights,omitempty"`
+	Schedule []WeightSchedule `json:"schedule,omitempty"`
+
+	// TCP port the addresses are health checked on, unhealthy ones are left out of answers
+	HealthPort      int  `json:"healthport,omitempty"`
+	FallbackRecurse bool `json:"fallbackrecurse,omitempty"`
+
+	// host:port health checked like healthport: while it accepts connections the name is recursed for,
+	// while it doesn't the record's own answer (a maintenance page, say) is served instead
+	RecurseWhenUp string `json:"recursewhenup,omitempty"`
+
+	// Leave the querying client's own address out of the answer
+	ExcludeSelf bool `json:"excludeself,omitempty"`
+
+	// TTLs by how many addresses are healthy, so clients come back sooner while the pool is degraded
+	HealthyTtls []HealthyTtl `json:"healthyttls,omitempty"`
+
+	// Region => the addresses clients in it are answered with
+	RegionPrefs map[string][]string `json:"regionprefs,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// The TTL to answer with while at least Healthy addresses are healthy and not drained
+type HealthyTtl struct {
+	Healthy int    `json:"healthy"`
+	Ttl     uint32 `json:"ttl"`
+}
+
+// Weights that replace the record's own during a daily time window, "15:04" in local time.
+// A window whose end is before its start wraps around midnight.
+type WeightSchedule struct {
+	From    string         `json:"from"`
+	To      string         `json:"to"`
+	Weights map[string]int `json:"weights"`
 }
 
 type RecordCname struct {
-	Ttl    *uint32 `json:"-"`
-	Answer string  `json:"answer"`
+	Ttl        *uint32        `json:"-"`
+	Answer     string         `json:"answer"`
+	Targets    map[string]int `json:"targets,omitempty"`
+	HealthPort int            `json:"healthport,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type RecordPtr struct {
@@ -20,14 +61,83 @@ type RecordTxt struct {
 	Answer []string `json:"answer"`
 }
 
+// A DANE certificate association, keyed on names like _443._tcp.example.com.
+type RecordTlsa struct {
+	Ttl          *uint32 `json:"-"`
+	Usage        uint8   `json:"usage"`
+	Selector     uint8   `json:"selector"`
+	MatchingType uint8   `json:"matchingtype"`
+	Certificate  string  `json:"certificate"`
+}
+
+type RecordSrv struct {
+	Ttl      *uint32 `json:"-"`
+	Priority uint16  `json:"priority"`
+	Weight   uint16  `json:"weight"`
+	Port     uint16  `json:"port"`
+	Target   string  `json:"target"`
+}
+
+// An HTTPS service binding. Priority 0 is AliasMode, pointing at the target's own HTTPS records, anything else is
+// ServiceMode. A target of "." is the record's own name.
+type RecordHttps struct {
+	Ttl      *uint32  `json:"-"`
+	Priority uint16   `json:"priority"`
+	Target   string   `json:"target"`
+	Alpn     []string `json:"alpn,omitempty"`
+	Port     uint16   `json:"port,omitempty"`
+	Ipv4Hint []string `json:"ipv4hint,omitempty"`
+	Ipv6Hint []string `json:"ipv6hint,omitempty"`
+}
+
+type RecordAlias struct {
+	Ttl    *uint32 `json:"-"`
+	Answer string  `json:"answer"`
+}
+
 type ClientAnswers struct {
-	Search        []string               `json:"search"`
-	Recurse       []string               `json:"recurse"`
-	Authoritative []string               `json:"authorative"`
-	A             map[string]RecordA     `json:"a"`
-	Cname         map[string]RecordCname `json:"cname"`
-	Ptr           map[string]RecordPtr   `json:"-"`
-	Txt           map[string]RecordTxt   `json:"-"`
+	Search        []string                 `json:"search"`
+	Recurse       []string                 `json:"recurse"`
+	Authoritative []string                 `json:"authorative"`
+	A             map[string]RecordA       `json:"a"`
+	Cname         map[string]RecordCname   `json:"cname"`
+	Ptr           map[string]RecordPtr     `json:"-"`
+	Txt           map[string]RecordTxt     `json:"-"`
+	Alias         map[string]RecordAlias   `json:"alias"`
+	Tlsa          map[string][]RecordTlsa  `json:"tlsa"`
+	Srv           map[string][]RecordSrv   `json:"srv"`
+	Https         map[string][]RecordHttps `json:"https"`
+	Patterns      []RecordPattern          `json:"patterns"`
+	Delegate      map[string][]string      `json:"delegate"`
+
+	// A records for every name under a suffix, keyed like *.internal., that has no records of its own
+	SuffixDefaults map[string]RecordA `json:"suffixdefaults,omitempty"`
+
+	// Lowest TTL recursive answers are sent with, so a chatty client asks less often
+	TtlFloor uint32 `json:"ttlfloor,omitempty"`
+
+	// Milliseconds the client's queries get to be answered before they are given up on with SERVFAIL
+	Timeout uint32 `json:"timeout,omitempty"`
+
+	// Client networks => the networks with addresses they can reach, only used in the default section
+	Reachable map[string][]string `json:"reachable,omitempty"`
+
+	// Region => the client networks in it, only used in the default section
+	Regions map[string][]string `json:"regions,omitempty"`
+
+	// The file each record was loaded from, by sourceKey
+	Sources map[string]string `json:"-" yaml:"-"`
+
+	// The names other names are under, by indexNames
+	nonTerminals map[string]bool
+
+	// Set on the copies the shadow answers are compared with, which answer with every candidate rather than
+	// a random pick of them
+	allCandidates bool
+
+	// Reachable and Regions parsed by prepareNetworks
+	reachableRules []reachableRule
+	regionNetworks []regionNetwork
 }
 
 type Answers map[string]ClientAnswers
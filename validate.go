@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Checks the parts of the answers that can't be checked by parsing alone
+func validateAnswers(answers Answers) error {
+	for key, client := range answers {
+		for name, rec := range client.A {
+			if err := validateSchedule(rec.Schedule); err != nil {
+				return fmt.Errorf("%s: A record %s: %v", key, name, err)
+			}
+			if err := validateHealthyTtls(rec.HealthyTtls); err != nil {
+				return fmt.Errorf("%s: A record %s: %v", key, name, err)
+			}
+			if err := validateWeights(rec); err != nil {
+				return fmt.Errorf("%s: A record %s: %v", key, name, err)
+			}
+			if err := validateRegionPrefs(rec.RegionPrefs, answers[DEFAULT_KEY].Regions); err != nil {
+				return fmt.Errorf("%s: A record %s: %v", key, name, err)
+			}
+			if err := validateGate(rec.RecurseWhenUp); err != nil {
+				return fmt.Errorf("%s: A record %s: %v", key, name, err)
+			}
+		}
+		for name, rec := range client.SuffixDefaults {
+			if !strings.HasPrefix(name, "*.") || !strings.HasSuffix(name, ".") {
+				return fmt.Errorf("%s: suffix default %s must look like *.example.com.", key, name)
+			}
+			if err := validateSchedule(rec.Schedule); err != nil {
+				return fmt.Errorf("%s: suffix default %s: %v", key, name, err)
+			}
+		}
+		for name, recs := range client.Https {
+			for _, rec := range recs {
+				if err := validateHttps(rec); err != nil {
+					return fmt.Errorf("%s: HTTPS record %s: %v", key, name, err)
+				}
+			}
+		}
+		for name, recs := range client.Tlsa {
+			for _, rec := range recs {
+				if err := validateTlsa(rec); err != nil {
+					return fmt.Errorf("%s: TLSA record %s: %v", key, name, err)
+				}
+			}
+		}
+		for name, rec := range client.Cname {
+			if err := validateTargets(rec); err != nil {
+				return fmt.Errorf("%s: CNAME record %s: %v", key, name, err)
+			}
+		}
+		if err := validateReachable(client.Reachable); err != nil {
+			return fmt.Errorf("%s: reachable: %v", key, err)
+		}
+		if err := validateRegions(client.Regions); err != nil {
+			return fmt.Errorf("%s: regions: %v", key, err)
+		}
+		for _, p := range client.Patterns {
+			if err := validatePattern(p); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateHealthyTtls(steps []HealthyTtl) error {
+	seen := map[int]bool{}
+	for _, step := range steps {
+		if step.Healthy < 0 {
+			return fmt.Errorf("Healthy count %d is negative", step.Healthy)
+		}
+		if seen[step.Healthy] {
+			return fmt.Errorf("Healthy count %d has more than one TTL", step.Healthy)
+		}
+		seen[step.Healthy] = true
+	}
+	return nil
+}
+
+func validateGate(gate string) error {
+	if gate == "" {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(gate)
+	if err != nil {
+		return fmt.Errorf("recursewhenup %q must be host:port", gate)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("recursewhenup %q has an invalid port", gate)
+	}
+	return nil
+}
+
+// Like weighted CNAMEs, weighted A records need an address that can be picked, in every schedule window too.
+// A canary is still answered with, so it may be all that's left.
+func validateWeights(rec RecordA) error {
+	if rec.Canary != "" || len(rec.Answer) == 0 {
+		return nil
+	}
+
+	if rec.Weights != nil && !anyWeighted(rec.Answer, rec.Weights) {
+		return fmt.Errorf("Every address has weight 0")
+	}
+	for _, window := range rec.Schedule {
+		if !anyWeighted(rec.Answer, window.Weights) {
+			return fmt.Errorf("Every address has weight 0 from %s to %s", window.From, window.To)
+		}
+	}
+	return nil
+}
+
+func anyWeighted(addrs []string, weights map[string]int) bool {
+	for _, addr := range addrs {
+		if weightOf(weights, addr) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Weighted CNAMEs need at least one target that can be picked
+func validateTargets(rec RecordCname) error {
+	if len(rec.Targets) == 0 {
+		return nil
+	}
+
+	picked := false
+	for target, weight := range rec.Targets {
+		if !strings.HasSuffix(target, ".") {
+			return fmt.Errorf("Target %s must be fully-qualified", target)
+		}
+		if weight > 0 {
+			picked = true
+		}
+	}
+	if !picked {
+		return fmt.Errorf("Every target has weight 0")
+	}
+	return nil
+}
+
+// Digest lengths in bytes for the TLSA matching types, 0 being the full certificate or key
+var tlsaDigestLengths = map[uint8]int{1: sha256.Size, 2: sha512.Size}
+
+func validateTlsa(rec RecordTlsa) error {
+	if rec.Usage > 3 {
+		return fmt.Errorf("Unknown usage %d", rec.Usage)
+	}
+	if rec.Selector > 1 {
+		return fmt.Errorf("Unknown selector %d", rec.Selector)
+	}
+	if rec.MatchingType > 2 {
+		return fmt.Errorf("Unknown matching type %d", rec.MatchingType)
+	}
+
+	data, err := hex.DecodeString(rec.Certificate)
+	if err != nil {
+		return fmt.Errorf("Certificate association data is not hex: %v", err)
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("Certificate association data is empty")
+	}
+	if length, ok := tlsaDigestLengths[rec.MatchingType]; ok && len(data) != length {
+		return fmt.Errorf("Certificate association data is %d bytes, matching type %d needs %d", len(data), rec.MatchingType, length)
+	}
+
+	return nil
+}
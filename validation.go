@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const (
+	ISSUE_ERROR   = "error"
+	ISSUE_WARNING = "warning"
+)
+
+// Something wrong with the answers found while loading them. Errors kept them from loading, so the
+// previous answers are still served; warnings were loaded anyway.
+type validationIssue struct {
+	Severity string `json:"severity"`
+	Path     string `json:"path,omitempty"`
+	Message  string `json:"message"`
+}
+
+type validationReport struct {
+	Checked time.Time         `json:"checked"`
+	Errors  int               `json:"errors"`
+	Issues  []validationIssue `json:"issues"`
+}
+
+// The issues of a load in progress and the report of the last one that finished, for the main answers or an instance
+type validation struct {
+	pending []validationIssue
+	last    validationReport
+}
+
+func newValidation() *validation {
+	return &validation{last: validationReport{Issues: []validationIssue{}}}
+}
+
+var (
+	mainValidation = newValidation()
+
+	// Loads are validated one at a time, so whatever a load finds goes to its own validation
+	loadMutex       sync.Mutex
+	validationMutex sync.Mutex
+	validating      *validation
+)
+
+// Starts collecting the issues of a load, which has to be finished before another one can start
+func startValidation(v *validation) {
+	loadMutex.Lock()
+	validationMutex.Lock()
+	validating = v
+	v.pending = nil
+	validationMutex.Unlock()
+}
+
+// Records a problem that didn't stop the answers from loading, besides logging it where it was found.
+// Outside a load, e.g. when the Consul catalog is merged in, it is only logged.
+func validationWarning(path string, format string, args ...interface{}) {
+	validationMutex.Lock()
+	defer validationMutex.Unlock()
+	if validating != nil {
+		validating.pending = append(validating.pending, validationIssue{Severity: ISSUE_WARNING, Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// Ends a load: the issues recorded since it started, the error it failed with if any, and what lintAnswers
+// finds in the answers now served become its report. Those of the main answers are the gauge too.
+func finishValidation(v *validation, path string, err error, loaded Answers) {
+	defer loadMutex.Unlock()
+	for _, warning := range lintAnswers(loaded) {
+		log.Warn(warning)
+		validationWarning("", "%s", warning)
+	}
+
+	validationMutex.Lock()
+	defer validationMutex.Unlock()
+
+	issues := v.pending
+	validating = nil
+	v.pending = nil
+	if err != nil {
+		issues = append(issues, validationIssue{Severity: ISSUE_ERROR, Path: path, Message: err.Error()})
+	}
+	if issues == nil {
+		issues = []validationIssue{}
+	}
+
+	v.last = validationReport{Checked: time.Now(), Issues: issues}
+	warnings := 0
+	for _, issue := range issues {
+		if issue.Severity == ISSUE_ERROR {
+			v.last.Errors++
+		} else {
+			warnings++
+		}
+	}
+	if v == mainValidation {
+		validationIssues.Set(ISSUE_ERROR, v.last.Errors)
+		validationIssues.Set(ISSUE_WARNING, warnings)
+	}
+}
+
+func (v *validation) report() validationReport {
+	validationMutex.Lock()
+	defer validationMutex.Unlock()
+	return v.last
+}
+
+func lastValidation() validationReport {
+	return mainValidation.report()
+}
+
+// Problems in answers that load fine but won't answer the way they look like they should: A records with
+// something other than an IPv4 address, names with a CNAME and other records, and CNAMEs that loop
+func lintAnswers(answers Answers) []string {
+	var warnings []string
+	keys := make([]string, 0, len(answers))
+	for key := range answers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		client := answers[key]
+		for _, name := range sortedKeys(client.A) {
+			for _, addr := range client.A[name].Answer {
+				if ip := net.ParseIP(addr); ip == nil || ip.To4() == nil {
+					warnings = append(warnings, fmt.Sprintf("%s: A record %s has invalid IPv4 address %q", key, name, addr))
+				}
+			}
+		}
+
+		for _, name := range sortedKeys(client.Cname) {
+			if _, ok := client.A[name]; ok {
+				warnings = append(warnings, fmt.Sprintf("%s: %s has both a CNAME and an A record, answered as --precedence=%s says", key, name, *precedence))
+			}
+			if _, ok := client.Txt[name]; ok {
+				warnings = append(warnings, fmt.Sprintf("%s: %s has both a CNAME and a TXT record", key, name))
+			}
+			if loop := cnameLoop(answers, key, name); loop != "" {
+				warnings = append(warnings, fmt.Sprintf("%s: CNAME loop %s", key, loop))
+			}
+		}
+	}
+	return warnings
+}
+
+// The chain of local CNAMEs from the name back to itself, empty if following them ends anywhere else.
+// Targets are looked up in the section first, then in the default one, just like answering does.
+func cnameLoop(answers Answers, key string, name string) string {
+	chain := name
+	seen := map[string]bool{name: true}
+	for current := name; ; {
+		target := ""
+		for _, section := range []string{key, DEFAULT_KEY} {
+			if rec, ok := answers[section].Cname[current]; ok && rec.Answer != "" {
+				target = dns.Fqdn(rec.Answer)
+				break
+			}
+		}
+		if target == "" {
+			return ""
+		}
+
+		chain += " -> " + target
+		if target == name {
+			return chain
+		}
+		if seen[target] {
+			// A loop, but one this name only leads into. It is reported for the names in it.
+			return ""
+		}
+		seen[target] = true
+		current = target
+	}
+}
+
+// The report of the main answers, or with ?instance= that instance's
+func httpValidation(w http.ResponseWriter, req *http.Request) {
+	if name := req.URL.Query().Get("instance"); name != "" {
+		inst := findInstance(name)
+		if inst == nil {
+			w.WriteHeader(404)
+			io.WriteString(w, "No instance named "+name)
+			return
+		}
+		writeJson(w, inst.validation.report())
+		return
+	}
+	writeJson(w, lastValidation())
+}
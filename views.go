@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const viewsFetchTimeout = 10 * time.Second
+
+// Which view (top-level key in the answers) each client is answered from, as assigned by another system through
+// --views. Keys are client IP addresses or CIDRs, the most specific one containing the client wins. A client
+// with its own section in the answers keeps it, and one without a view gets the default answers.
+type viewMap struct {
+	byIp  map[string]string
+	byNet map[*net.IPNet]string
+}
+
+var (
+	viewsMutex  sync.RWMutex
+	views       viewMap
+	viewsSource map[string]string
+)
+
+// The section of the answers the client is answered from: its own, else the view it is mapped to, if the answers
+// have that view. Anything else, like the default section, is itself.
+func (answers *Answers) sectionFor(clientIp string) string {
+	if _, ok := (*answers)[clientIp]; ok {
+		return clientIp
+	}
+	if view, ok := viewOf(clientIp); ok {
+		if _, ok := (*answers)[view]; ok {
+			return view
+		}
+	}
+	return clientIp
+}
+
+func viewOf(clientIp string) (string, bool) {
+	viewsMutex.RLock()
+	defer viewsMutex.RUnlock()
+
+	if view, ok := views.byIp[clientIp]; ok {
+		return view, true
+	}
+	if len(views.byNet) == 0 {
+		return "", false
+	}
+
+	ip := net.ParseIP(clientIp)
+	if ip == nil {
+		return "", false
+	}
+	best, bestOnes := "", -1
+	for network, view := range views.byNet {
+		if ones, _ := network.Mask.Size(); network.Contains(ip) && ones > bestOnes {
+			best, bestOnes = view, ones
+		}
+	}
+	return best, bestOnes >= 0
+}
+
+func parseViews(mapping map[string]string) (viewMap, error) {
+	out := viewMap{byIp: make(map[string]string), byNet: make(map[*net.IPNet]string)}
+	for client, view := range mapping {
+		if view == "" || view == DEFAULT_KEY {
+			continue
+		}
+		if strings.Contains(client, "/") {
+			_, network, err := net.ParseCIDR(client)
+			if err != nil {
+				return out, fmt.Errorf("Invalid view client %q: %v", client, err)
+			}
+			out.byNet[network] = view
+			continue
+		}
+		ip := net.ParseIP(client)
+		if ip == nil {
+			return out, fmt.Errorf("Invalid view client %q", client)
+		}
+		out.byIp[ip.String()] = view
+	}
+	return out, nil
+}
+
+// The mapping as a JSON or YAML object of clients to view names, from a file or an http(s) URL
+func fetchViews(source string) (map[string]string, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := &http.Client{Timeout: viewsFetchTimeout}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s answered %s", source, resp.Status)
+		}
+		data, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+	} else if data, err = ioutil.ReadFile(source); err != nil {
+		return nil, err
+	}
+
+	mapping := map[string]string{}
+	if err := yaml.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+	return mapping, nil
+}
+
+// Fetches the mapping again. When that fails the one fetched last is kept, and until one is fetched at all every
+// client is answered as if it had none.
+func loadViews(source string) error {
+	mapping, err := fetchViews(source)
+	if err == nil {
+		var parsed viewMap
+		if parsed, err = parseViews(mapping); err == nil {
+			viewsMutex.Lock()
+			changed := !reflect.DeepEqual(mapping, viewsSource)
+			views, viewsSource = parsed, mapping
+			viewsMutex.Unlock()
+
+			if changed {
+				// Cached local answers were for the clients' previous views
+				clearClientSpecificCaches()
+				log.WithFields(log.Fields{"source": source, "clients": len(mapping)}).Info("Loaded views")
+			}
+			return nil
+		}
+	}
+
+	log.WithFields(log.Fields{"source": source}).Errorf("Failed to load views, keeping the previous ones: %v", err)
+	return err
+}
+
+func watchViews(source string, interval time.Duration) {
+	if source == "" {
+		return
+	}
+
+	loadViews(source)
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			loadViews(source)
+		}
+	}()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Where --whoami-name takes the client's address from
+const (
+	WHOAMI_TRANSPORT = "transport"
+	WHOAMI_ECS       = "ecs"
+)
+
+func isWhoamiName(fqdn string) bool {
+	return *whoamiName != "" && fqdn == dns.Fqdn(strings.ToLower(*whoamiName))
+}
+
+// The client's address as an A or AAAA record, whichever the address is and was asked for, or as TXT
+func whoamiRecords(clientIp string, req *dns.Msg) []dns.RR {
+	question := req.Question[0]
+	ip := net.ParseIP(clientIp)
+	text := clientIp
+	if *whoamiSource == WHOAMI_ECS {
+		if subnet := ecsSubnet(req); subnet != nil {
+			ip = subnet.IP
+			text = subnet.String()
+		}
+	}
+	if ip == nil {
+		return nil
+	}
+
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: 0}
+	switch {
+	case question.Qtype == dns.TypeTXT:
+		return []dns.RR{&dns.TXT{Hdr: hdr, Txt: []string{text}}}
+	case question.Qtype == dns.TypeA && ip.To4() != nil:
+		return []dns.RR{&dns.A{Hdr: hdr, A: ip.To4()}}
+	case question.Qtype == dns.TypeAAAA && ip.To4() == nil:
+		return []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ip}}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+)
+
+// Wildcard records (RFC 4592) have an owner name like *.example.com. and stand in for names under it
+// that aren't defined themselves, for every type. A name that exists, or is under one that does before a
+// wildcard is reached, is never covered.
+
+// Whether the name has records of any type in this section
+func (client ClientAnswers) hasName(fqdn string) bool {
+	_, a := client.A[fqdn]
+	_, cname := client.Cname[fqdn]
+	_, ptr := client.Ptr[fqdn]
+	_, txt := client.Txt[fqdn]
+	_, alias := client.Alias[fqdn]
+	_, tlsa := client.Tlsa[fqdn]
+	_, srv := client.Srv[fqdn]
+	_, https := client.Https[fqdn]
+	return a || cname || ptr || txt || alias || tlsa || srv || https
+}
+
+// Whether the name exists in this section: it has records, or it is an empty non-terminal, a name without records
+// of its own that others are under. Like one with records, it stops a wildcard above it from covering the names below.
+func (client ClientAnswers) nameExists(fqdn string) bool {
+	return client.hasName(fqdn) || client.nonTerminals[fqdn]
+}
+
+// Indexes the names above every owner name in each section, so nameExists is a lookup rather than a walk over
+// every record. Called on answers before they are served, like prepareNetworks.
+func indexNames(answers Answers) {
+	for key, client := range answers {
+		above := map[string]bool{}
+		add := func(owner string) {
+			name := owner
+			for {
+				dot := strings.Index(name, ".")
+				if dot < 0 || dot == len(name)-1 {
+					return
+				}
+				name = name[dot+1:]
+				if above[name] {
+					// And so are the ones above it
+					return
+				}
+				above[name] = true
+			}
+		}
+
+		for name := range client.A {
+			add(name)
+		}
+		for name := range client.Cname {
+			add(name)
+		}
+		for name := range client.Ptr {
+			add(name)
+		}
+		for name := range client.Txt {
+			add(name)
+		}
+		for name := range client.Alias {
+			add(name)
+		}
+		for name := range client.Tlsa {
+			add(name)
+		}
+		for name := range client.Srv {
+			add(name)
+		}
+		for name := range client.Https {
+			add(name)
+		}
+
+		client.nonTerminals = above
+		answers[key] = client
+	}
+}
+
+// The suffix default covering the name, the one for its longest suffix. Unlike a wildcard it covers names
+// however deep, even under names that exist, as long as the name has no records of its own.
+func (client ClientAnswers) suffixDefault(fqdn string) (string, bool) {
+	if len(client.SuffixDefaults) == 0 || client.hasName(fqdn) {
+		return "", false
+	}
+
+	name := fqdn
+	for {
+		dot := strings.Index(name, ".")
+		if dot < 0 || dot == len(name)-1 {
+			return "", false
+		}
+		name = name[dot+1:]
+
+		if owner := "*." + name; len(client.SuffixDefaults[owner].Answer) > 0 {
+			return owner, true
+		}
+	}
+}
+
+// The wildcard owner name that covers the name, walking up from its parent to the closest name that exists
+func (client ClientAnswers) wildcardName(fqdn string) (string, bool) {
+	if client.nameExists(fqdn) {
+		return "", false
+	}
+
+	name := fqdn
+	for {
+		dot := strings.Index(name, ".")
+		if dot < 0 || dot == len(name)-1 {
+			return "", false
+		}
+		name = name[dot+1:]
+
+		if wildcard := "*." + name; client.hasName(wildcard) {
+			return wildcard, true
+		}
+		if client.nameExists(name) {
+			return "", false
+		}
+	}
+}